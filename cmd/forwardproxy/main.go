@@ -0,0 +1,42 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/PeterKWIlliams/http/internal/proxy"
+	"github.com/PeterKWIlliams/http/internal/server"
+)
+
+func main() {
+	port := flag.Int("port", 3128, "port to listen on")
+	allow := flag.String("allow", "", "comma separated host:port destinations, e.g. github.com:443,*.golang.org:443")
+	idle := flag.Duration("idle-timeout", 5*time.Minute, "close tunnels idle for this long")
+	flag.Parse()
+
+	allowlist, err := proxy.ParseAllowlist(strings.Split(*allow, ",")...)
+	if err != nil {
+		log.Fatalf("invalid allowlist: %v", err)
+	}
+	forwardProxy := &proxy.ForwardProxy{
+		Allow:       allowlist,
+		IdleTimeout: *idle,
+	}
+
+	server, err := server.Serve(*port, forwardProxy.Serve, server.WithName("forwardproxy"))
+	if err != nil {
+		log.Fatalf("Error starting server: %v", err)
+	}
+	defer server.Close()
+	log.Println("Forward proxy started on port", *port)
+
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
+	<-sigChan
+	log.Println("Forward proxy stopped")
+}
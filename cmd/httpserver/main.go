@@ -1,101 +1,240 @@
 package main
 
 import (
-	"io"
+	"context"
+	"crypto/tls"
+	"flag"
 	"log"
-	"net/http"
+	"net"
+	"net/url"
 	"os"
 	"os/signal"
 	"strconv"
 	"strings"
+	"sync"
 	"syscall"
+	"time"
 
-	"github.com/PeterKWIlliams/http/internal/headers"
+	"github.com/PeterKWIlliams/http/internal/accesslog"
+	"github.com/PeterKWIlliams/http/internal/cidr"
+	"github.com/PeterKWIlliams/http/internal/compress"
+	"github.com/PeterKWIlliams/http/internal/fileserver"
+	"github.com/PeterKWIlliams/http/internal/metrics"
+	"github.com/PeterKWIlliams/http/internal/proxy"
+	"github.com/PeterKWIlliams/http/internal/proxyproto"
 	"github.com/PeterKWIlliams/http/internal/request"
 	"github.com/PeterKWIlliams/http/internal/response"
 	"github.com/PeterKWIlliams/http/internal/server"
 )
 
-const port = 32020
+const (
+	port            = 32020
+	shutdownTimeout = 30 * time.Second
+)
 
-func main() {
-	server, err := server.Serve(port, routingHandler)
-	if err != nil {
-		log.Fatalf("Error starting server: %v", err)
-	}
-	defer server.Close()
-	log.Println("Server started on port", port)
+var (
+	tlsPort    = flag.Int("tls-port", 32443, "port for HTTPS when a certificate is given")
+	certFile   = flag.String("tls-cert", "", "TLS certificate file; reloaded on change or SIGHUP")
+	keyFile    = flag.String("tls-key", "", "TLS private key file")
+	unixSocket = flag.String("unix-socket", "", "also serve on this Unix domain socket")
+	proxyFrom  = flag.String("proxy-protocol", "", "comma-separated CIDRs of load balancers that send PROXY protocol headers")
+	proxies    = flag.String("trusted-proxies", "", "comma-separated CIDRs of proxies whose X-Forwarded-For and Forwarded headers are trusted")
+	accessLog  = flag.String("access-log", "", "write an access log to this file, or to stdout for -; the file is reopened on SIGHUP")
+	logFormat  = flag.String("access-log-format", "combined", "access log format: common, combined or json")
+	logMaxSize = flag.Int64("access-log-max-size", 100, "rotate the access log file after this many megabytes")
+	logBackups = flag.Int("access-log-backups", accesslog.DefaultMaxBackups, "rotated access log files to keep")
+	metricsAt  = flag.String("metrics-path", "/metrics", "serve Prometheus metrics at this path; empty disables")
+)
 
-	sigChan := make(chan os.Signal, 1)
-	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
-	<-sigChan
-	log.Println("Server gracefully stopped")
+var httpbin = &proxy.ReverseProxy{
+	Upstream:    &url.URL{Scheme: "https", Host: "httpbin.org"},
+	StripPrefix: "/httpbin",
+	Client:      proxy.NewClient(30 * time.Second),
 }
 
-func routingHandler(w *response.Writer, req *request.Request) {
-	resHeaders := response.GetDefaultHeaders(0)
-	resHeaders.Set("content-type", "text/html")
-	if strings.HasPrefix(req.RequestLine.RequestTarget, "/httpbin/") {
-		targetPath := strings.TrimPrefix(req.RequestLine.RequestTarget, "/httpbin/")
-		url := "https://httpbin.org/" + targetPath
-
-		log.Printf("Proxying request for %s to %s", req.RequestLine.RequestTarget, url)
+var static = &fileserver.FileServer{
+	Root:    "static",
+	Prefix:  "/static",
+	Listing: true,
+}
 
-		resp, err := http.Get(url)
+func main() {
+	flag.Parse()
+	trustedProxies, err := cidr.ParseList(*proxies)
+	if err != nil {
+		log.Fatalf("Invalid -trusted-proxies: %v", err)
+	}
+	middlewares := []server.Middleware{server.RequestID()}
+	if len(trustedProxies) > 0 {
+		middlewares = append(middlewares, proxy.TrustProxies(trustedProxies))
+	}
+	serverOpts := []server.Option{server.WithName("httpserver")}
+	var registry *metrics.Registry
+	if *metricsAt != "" {
+		registry = metrics.NewRegistry()
+		m := metrics.NewServerMetrics(registry, route)
+		middlewares = append(middlewares, m.Middleware())
+		serverOpts = append(serverOpts, server.WithConnState(m.ConnState), server.WithParseErrorHook(m.ParseError))
+	}
+	if *accessLog != "" {
+		format, err := accesslog.ParseFormat(*logFormat)
 		if err != nil {
-			log.Printf("httpbin GET request failed for %s: %v", url, err)
-			err = server.WriteError(w, response.InternalServerError, "Proxy request failed")
+			log.Fatalf("Invalid -access-log-format: %v", err)
+		}
+		opts := accesslog.Options{Format: format, Output: os.Stdout}
+		if *accessLog != "-" {
+			f, err := accesslog.OpenRotatingFile(*accessLog, *logMaxSize<<20, *logBackups)
 			if err != nil {
-				log.Printf("could not write proxy error response: %v", err)
+				log.Fatalf("Error opening access log: %v", err)
 			}
-			return
+			defer f.Close()
+			opts.Output = f
+			// SIGHUP also reopens the log, for rotation by external
+			// tools such as logrotate.
+			hup := make(chan os.Signal, 1)
+			signal.Notify(hup, syscall.SIGHUP)
+			go func() {
+				for range hup {
+					if err := f.Reopen(); err != nil {
+						log.Printf("Error reopening access log: %v", err)
+					}
+				}
+			}()
 		}
-		defer resp.Body.Close()
+		middlewares = append(middlewares, accesslog.Middleware(opts))
+	}
+	middlewares = append(middlewares, compress.DecodeRequest(0), compress.Middleware(compress.Options{}))
+	if registry != nil {
+		middlewares = append(middlewares, metrics.Endpoint(*metricsAt, registry))
+	}
+	handler := server.Chain(routingHandler, middlewares...)
 
-		resHeaders := headers.NewHeaders()
-		resHeaders.Set("transfer-encoding", "chunked")
-		if contentType := resp.Header.Get("Content-Type"); contentType != "" {
-			resHeaders.Set("content-type", contentType)
+	// Sockets come from systemd (FileDescriptorName= http, https or unix)
+	// or from the previous process after a SIGUSR2 upgrade.
+	inherited, err := server.InheritedListeners()
+	if err != nil {
+		log.Fatalf("Error using inherited sockets: %v", err)
+	}
+	var listeners []server.NamedListener
+	listen := func(name string, create func() (net.Listener, error)) net.Listener {
+		l, ok := server.FindListener(inherited, name)
+		if !ok {
+			if l, err = create(); err != nil {
+				log.Fatalf("Error listening for %s: %v", name, err)
+			}
 		}
-		resHeaders.Set("connection", "close")
+		listeners = append(listeners, server.NamedListener{Name: name, Listener: l})
+		return l
+	}
+
+	trusted, err := cidr.ParseList(*proxyFrom)
+	if err != nil {
+		log.Fatalf("Invalid -proxy-protocol: %v", err)
+	}
+	// Listeners are handed on to a new process unwrapped, so the PROXY
+	// protocol wrapper is only added for serving.
+	withProxyProtocol := func(l net.Listener) net.Listener {
+		if len(trusted) == 0 {
+			return l
+		}
+		return &proxyproto.Listener{Listener: l, Trusted: trusted}
+	}
+
+	srv := server.New(handler, serverOpts...)
+	servers := []*server.Server{srv}
+	listener := listen("http", func() (net.Listener, error) {
+		return net.Listen("tcp", ":"+strconv.Itoa(port))
+	})
+	go srv.Serve(withProxyProtocol(listener))
+	log.Println("Server started on", listener.Addr())
+
+	if *unixSocket != "" {
+		listener := listen("unix", func() (net.Listener, error) {
+			return server.ListenUnix(*unixSocket, 0o660)
+		})
+		go srv.Serve(listener)
+		log.Println("Serving on unix socket", *unixSocket)
+	}
 
-		err = w.WriteStatusLine(response.StatusCode(resp.StatusCode))
+	if *certFile != "" {
+		reloader, err := server.NewCertReloader(*certFile, *keyFile)
 		if err != nil {
-			log.Printf("could not write statusLine %v", err)
-			return
+			log.Fatalf("Error loading certificate: %v", err)
 		}
-		err = w.WriteHeaders(resHeaders)
+		stop := make(chan struct{})
+		defer close(stop)
+		go reloader.Watch(server.DefaultCertCheckInterval, stop)
+
+		tlsSrv := server.New(handler, serverOpts...)
+		servers = append(servers, tlsSrv)
+		listener := listen("https", func() (net.Listener, error) {
+			return net.Listen("tcp", ":"+strconv.Itoa(*tlsPort))
+		})
+		go tlsSrv.ServeTLS(withProxyProtocol(listener), &tls.Config{GetCertificate: reloader.GetCertificate})
+		log.Println("TLS server started on", listener.Addr())
+	}
+
+	// SIGUSR2 starts a new copy of the binary on the same sockets and
+	// drains this one once it is up. Under systemd this needs Type=notify
+	// and NotifyAccess=all so the new process can become the main one.
+	// The handler goes in before readiness is reported, as a SIGUSR2 sent
+	// as soon as we are ready would otherwise kill the process.
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM, syscall.SIGUSR2)
+
+	if err := server.NotifyReady(); err != nil {
+		log.Printf("Error reporting readiness: %v", err)
+	}
+	for sig := range sigChan {
+		if sig != syscall.SIGUSR2 {
+			break
+		}
+		proc, err := server.Reexec(listeners, server.DefaultReexecTimeout)
 		if err != nil {
-			log.Printf("could not write headers %v", err)
-			return
+			log.Printf("Upgrade failed, still serving: %v", err)
+			continue
 		}
+		log.Println("Handed over to process", proc.Pid)
+		break
+	}
 
-		buffer := make([]byte, 32)
-		for {
-			n, err := resp.Body.Read(buffer)
-			if n > 0 {
-				log.Printf("Read %d bytes from httpbin", n)
-				_, writeErr := w.WriteChunkedBody(buffer[:n])
-				if writeErr != nil {
-					log.Printf("error writing chunked body %v", writeErr)
-					return
-				}
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	var wg sync.WaitGroup
+	for _, s := range servers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := s.Shutdown(ctx); err != nil {
+				log.Printf("Error shutting down: %v", err)
 			}
+		}()
+	}
+	wg.Wait()
+	log.Println("Server gracefully stopped")
+}
 
-			if err != nil {
-				if err == io.EOF {
-					_, doneErr := w.WriteChunkedBodyDone()
-					if doneErr != nil {
-						log.Printf("error writing chunked body done %v", doneErr)
-					}
-					log.Printf("Finished proxying %s", url)
-					return
-				}
-				log.Printf("Error reading from httpbin body: %v", err)
-				return
-			}
-		}
+// route gives the metrics label for the routes routingHandler knows.
+func route(req *request.Request) string {
+	target := req.RequestLine.RequestTarget
+	switch {
+	case strings.HasPrefix(target, "/static/"):
+		return "/static"
+	case strings.HasPrefix(target, "/httpbin/"):
+		return "/httpbin"
+	case target == *metricsAt, target == "/yourproblem", target == "/myproblem":
+		return target
+	}
+	return "other"
+}
 
+func routingHandler(w *response.Writer, req *request.Request) {
+	resHeaders := response.GetDefaultHeaders(0)
+	resHeaders.Set("content-type", "text/html")
+	if strings.HasPrefix(req.RequestLine.RequestTarget, "/static/") {
+		static.Serve(w, req)
+	} else if strings.HasPrefix(req.RequestLine.RequestTarget, "/httpbin/") {
+		httpbin.Serve(w, req)
 	} else {
 		switch req.RequestLine.RequestTarget {
 		case "/yourproblem":
@@ -133,20 +272,7 @@ func routingHandler(w *response.Writer, req *request.Request) {
 			return
 
 		default:
-			body, err := os.ReadFile("message3.html")
-			if err != nil {
-				err = server.WriteError(w, response.InternalServerError, "could not retrieve file")
-				if err != nil {
-					log.Printf("Could not write error %v", err)
-				}
-				return
-			}
-			resHeaders.Set("content-length", strconv.Itoa(len(body)))
-			resHeaders.Set("content-type", "text/html")
-			err = w.Write(response.OK, resHeaders, body)
-			if err != nil {
-				log.Printf("Error writing default response body:%v", err)
-			}
+			fileserver.ServeFile(w, req, "message3.html")
 		}
 	}
 }
@@ -0,0 +1,216 @@
+// Package accesslog records one line per request served, in the Common or
+// Combined Log Format or as JSON through log/slog.
+package accesslog
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/PeterKWIlliams/http/internal/request"
+	"github.com/PeterKWIlliams/http/internal/response"
+	"github.com/PeterKWIlliams/http/internal/server"
+)
+
+type Format int
+
+const (
+	Common Format = iota
+	Combined
+	JSON
+)
+
+// clfTime is the timestamp layout of the Common Log Format.
+const clfTime = "02/Jan/2006:15:04:05 -0700"
+
+// ParseFormat accepts "common", "combined" or "json".
+func ParseFormat(name string) (Format, error) {
+	switch strings.ToLower(name) {
+	case "common", "clf":
+		return Common, nil
+	case "combined":
+		return Combined, nil
+	case "json":
+		return JSON, nil
+	}
+	return 0, fmt.Errorf("unknown access log format %q", name)
+}
+
+type Options struct {
+	Format Format
+	// Output receives the log lines. It defaults to os.Stdout and is only
+	// written by one request at a time.
+	Output io.Writer
+	// Handler, when set, receives JSON entries as slog records instead of
+	// Output, so they can go wherever slog can send them.
+	Handler slog.Handler
+}
+
+// Entry is what gets recorded about a request.
+type Entry struct {
+	Time       time.Time
+	Method     string
+	Target     string
+	Proto      string
+	Status     response.StatusCode
+	Bytes      int64
+	Duration   time.Duration
+	RemoteAddr string
+	UserAgent  string
+	Referer    string
+	RequestID  string
+}
+
+// Middleware logs every request once its response is complete. The
+// Common and Combined formats carry only the fields they define; JSON
+// entries also include the duration and request ID.
+//
+// It finishes the response itself before logging so that bytes held back
+// by body encoders are counted, which means middlewares placed outside it
+// cannot add to the body. Put it after RequestID and TrustProxies so it
+// sees the request ID and the real client address.
+func Middleware(opts Options) server.Middleware {
+	out := opts.Output
+	if out == nil {
+		out = os.Stdout
+	}
+	var mu sync.Mutex
+	write := func(line []byte) {
+		mu.Lock()
+		defer mu.Unlock()
+		if _, err := out.Write(line); err != nil {
+			log.Printf("Error writing access log: %v", err)
+		}
+	}
+	var logger *slog.Logger
+	if opts.Format == JSON {
+		h := opts.Handler
+		if h == nil {
+			h = slog.NewJSONHandler(out, nil)
+		}
+		logger = slog.New(h)
+	}
+
+	return func(next server.Handler) server.Handler {
+		return func(w *response.Writer, req *request.Request) {
+			start := time.Now()
+			next(w, req)
+			if err := w.Finish(); err != nil {
+				log.Printf("Error finishing response: %v", err)
+			}
+			e := newEntry(w, req, start)
+			switch opts.Format {
+			case JSON:
+				logger.LogAttrs(context.Background(), slog.LevelInfo, "request", e.attrs()...)
+			case Combined:
+				write(e.appendCombined(nil))
+			default:
+				write(e.appendCommon(nil))
+			}
+		}
+	}
+}
+
+func newEntry(w *response.Writer, req *request.Request, start time.Time) Entry {
+	e := Entry{
+		Time:       start,
+		Method:     req.RequestLine.Method,
+		Target:     req.RequestLine.RequestTarget,
+		Proto:      "HTTP/" + req.RequestLine.HttpVersion,
+		Status:     w.StatusCode(),
+		Bytes:      w.BodyBytes(),
+		Duration:   time.Since(start),
+		RemoteAddr: req.RemoteAddr,
+	}
+	if e.Status == 0 && w.Hijacked() {
+		// The handler took over the connection without recording
+		// what, if anything, it answered.
+		e.Status = response.SwitchingProtocols
+	} else if e.Status == 0 {
+		e.Status = response.OK
+	}
+	e.UserAgent, _ = req.Headers.Get("user-agent")
+	e.Referer, _ = req.Headers.Get("referer")
+	e.RequestID = request.IDFromContext(req.Context())
+	return e
+}
+
+// appendCommon formats host ident authuser [time] "request" status bytes.
+func (e Entry) appendCommon(b []byte) []byte {
+	host := e.RemoteAddr
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	b = append(b, orDash(host)...)
+	b = append(b, " - - ["...)
+	b = e.Time.AppendFormat(b, clfTime)
+	b = append(b, "] "...)
+	b = appendQuoted(b, e.Method+" "+e.Target+" "+e.Proto)
+	b = append(b, ' ')
+	b = strconv.AppendInt(b, int64(e.Status), 10)
+	b = append(b, ' ')
+	if e.Bytes > 0 {
+		b = strconv.AppendInt(b, e.Bytes, 10)
+	} else {
+		b = append(b, '-')
+	}
+	return append(b, '\n')
+}
+
+// appendCombined adds the quoted referer and user agent to a Common line.
+func (e Entry) appendCombined(b []byte) []byte {
+	b = e.appendCommon(b)
+	b = append(b[:len(b)-1], ' ')
+	b = appendQuoted(b, orDash(e.Referer))
+	b = append(b, ' ')
+	b = appendQuoted(b, orDash(e.UserAgent))
+	return append(b, '\n')
+}
+
+func (e Entry) attrs() []slog.Attr {
+	return []slog.Attr{
+		slog.String("method", e.Method),
+		slog.String("target", e.Target),
+		slog.String("proto", e.Proto),
+		slog.Int("status", int(e.Status)),
+		slog.Int64("bytes", e.Bytes),
+		slog.Duration("duration", e.Duration),
+		slog.String("remote_addr", e.RemoteAddr),
+		slog.String("user_agent", e.UserAgent),
+		slog.String("referer", e.Referer),
+		slog.String("request_id", e.RequestID),
+	}
+}
+
+// appendQuoted writes s in double quotes, escaping quotes, backslashes and
+// control characters so a client cannot forge log lines.
+func appendQuoted(b []byte, s string) []byte {
+	b = append(b, '"')
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == '"' || c == '\\':
+			b = append(b, '\\', c)
+		case c < ' ' || c == 0x7f:
+			b = append(b, fmt.Sprintf(`\x%02x`, c)...)
+		default:
+			b = append(b, c)
+		}
+	}
+	return append(b, '"')
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
@@ -0,0 +1,194 @@
+package accesslog
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/PeterKWIlliams/http/internal/compress"
+	"github.com/PeterKWIlliams/http/internal/headers"
+	"github.com/PeterKWIlliams/http/internal/request"
+	"github.com/PeterKWIlliams/http/internal/response"
+	"github.com/PeterKWIlliams/http/internal/server"
+)
+
+func serve(t *testing.T, opts Options, h headers.Headers) string {
+	t.Helper()
+	var log bytes.Buffer
+	opts.Output = &log
+	body := []byte(strings.Repeat("hello, world\n", 100))
+	handler := server.Chain(func(w *response.Writer, req *request.Request) {
+		w.Write(response.OK, response.GetDefaultHeaders(len(body)), body)
+	}, Middleware(opts))
+
+	req := &request.Request{
+		RequestLine: request.RequestLine{Method: "GET", RequestTarget: "/a?b=c", HttpVersion: "1.1"},
+		Headers:     h,
+		RemoteAddr:  "192.0.2.7:5555",
+	}
+	handler(&response.Writer{Writer: io.Discard}, req.WithContext(request.ContextWithID(req.Context(), "abc123")))
+	return log.String()
+}
+
+func TestMiddleware(t *testing.T) {
+	h := headers.NewHeaders()
+	h.Set("user-agent", `curl/8 "quoted"`)
+	h.Set("referer", "https://example.com/")
+
+	line := serve(t, Options{Format: Common}, h)
+	assert.Regexp(t, regexp.MustCompile(`^192\.0\.2\.7 - - \[\d{2}/\w{3}/\d{4}:\d{2}:\d{2}:\d{2} [+-]\d{4}\] "GET /a\?b=c HTTP/1\.1" 200 1300\n$`), line)
+
+	line = serve(t, Options{Format: Combined}, h)
+	assert.True(t, strings.HasSuffix(line, `"GET /a?b=c HTTP/1.1" 200 1300 "https://example.com/" "curl/8 \"quoted\""`+"\n"), line)
+
+	line = serve(t, Options{Format: JSON}, h)
+	var entry map[string]any
+	require.NoError(t, json.Unmarshal([]byte(line), &entry))
+	assert.Equal(t, "GET", entry["method"])
+	assert.Equal(t, "/a?b=c", entry["target"])
+	assert.Equal(t, float64(200), entry["status"])
+	assert.Equal(t, float64(1300), entry["bytes"])
+	assert.Equal(t, "192.0.2.7:5555", entry["remote_addr"])
+	assert.Equal(t, `curl/8 "quoted"`, entry["user_agent"])
+	assert.Equal(t, "abc123", entry["request_id"])
+	assert.Contains(t, entry, "duration")
+
+	// Test: Control characters cannot split a log line
+	h = headers.NewHeaders()
+	h.Set("user-agent", "evil\n127.0.0.1 - - fake")
+	line = serve(t, Options{Format: Combined}, h)
+	assert.Equal(t, 1, strings.Count(line, "\n"))
+	assert.Contains(t, line, `"evil\x0a127.0.0.1 - - fake"`)
+}
+
+func TestMiddleware_CountsEncodedBytes(t *testing.T) {
+	var log, out bytes.Buffer
+	body := []byte(strings.Repeat("hello, world\n", 1000))
+	handler := server.Chain(func(w *response.Writer, req *request.Request) {
+		w.Write(response.OK, response.GetDefaultHeaders(len(body)), body)
+	}, Middleware(Options{Output: &log}), compress.Middleware(compress.Options{Encodings: []string{"gzip"}}))
+
+	h := headers.NewHeaders()
+	h.Set("accept-encoding", "gzip")
+	req := &request.Request{RequestLine: request.RequestLine{Method: "GET", RequestTarget: "/", HttpVersion: "1.1"}, Headers: h}
+	handler(&response.Writer{Writer: &out}, req)
+
+	// Test: The logged size is the compressed body, including what the
+	// encoder flushed when the response was finished
+	resp, err := http.ReadResponse(bufio.NewReader(&out), nil)
+	require.NoError(t, err)
+	gz, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	zr, err := gzip.NewReader(bytes.NewReader(gz))
+	require.NoError(t, err)
+	decoded, err := io.ReadAll(zr)
+	require.NoError(t, err)
+	assert.Equal(t, body, decoded)
+	assert.True(t, strings.HasSuffix(log.String(), " 200 "+strconv.Itoa(len(gz))+"\n"), log.String())
+}
+
+func TestMiddleware_Hijacked(t *testing.T) {
+	logStatus := func(answered response.StatusCode) string {
+		var log bytes.Buffer
+		handler := Middleware(Options{Output: &log})(func(w *response.Writer, req *request.Request) {
+			_, _, err := w.Hijack()
+			require.NoError(t, err)
+			if answered != 0 {
+				w.SetHijackedStatus(answered)
+			}
+		})
+		serverConn, clientConn := net.Pipe()
+		defer serverConn.Close()
+		defer clientConn.Close()
+		req := &request.Request{RequestLine: request.RequestLine{Method: "CONNECT", RequestTarget: "example.com:443", HttpVersion: "1.1"}, Headers: headers.NewHeaders()}
+		handler(&response.Writer{Writer: serverConn}, req)
+		return log.String()
+	}
+
+	// Test: The status the handler wrote itself is logged
+	assert.Contains(t, logStatus(response.OK), `" 200 `)
+
+	// Test: Without one, a hijacked request is logged as 101
+	assert.Contains(t, logStatus(0), `" 101 `)
+}
+
+func TestMiddleware_NoResponse(t *testing.T) {
+	// Test: A handler that writes nothing is logged as 200, never 0
+	var log bytes.Buffer
+	handler := Middleware(Options{Output: &log})(func(w *response.Writer, req *request.Request) {})
+	req := &request.Request{RequestLine: request.RequestLine{Method: "GET", RequestTarget: "/", HttpVersion: "1.1"}, Headers: headers.NewHeaders()}
+	handler(&response.Writer{Writer: io.Discard}, req)
+	assert.Contains(t, log.String(), `" 200 -`)
+}
+
+func TestRotatingFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.log")
+	f, err := OpenRotatingFile(path, 10, 2)
+	require.NoError(t, err)
+	defer f.Close()
+
+	for _, line := range []string{"one\n", "two\n", "three\n", "four\n", "five\n"} {
+		_, err := f.Write([]byte(line))
+		require.NoError(t, err)
+	}
+	read := func(name string) string {
+		b, err := os.ReadFile(name)
+		require.NoError(t, err)
+		return string(b)
+	}
+	assert.Equal(t, "four\nfive\n", read(path))
+	assert.Equal(t, "three\n", read(path+".1"))
+	assert.Equal(t, "one\ntwo\n", read(path+".2"))
+	_, err = os.Stat(path + ".3")
+	assert.True(t, os.IsNotExist(err))
+
+	// Test: A reopened file keeps its size, so the next write rotates and
+	// the oldest backup is dropped
+	require.NoError(t, f.Reopen())
+	_, err = f.Write([]byte("six\n"))
+	require.NoError(t, err)
+	assert.Equal(t, "six\n", read(path))
+	assert.Equal(t, "four\nfive\n", read(path+".1"))
+	assert.Equal(t, "three\n", read(path+".2"))
+}
+
+func TestRotatingFile_RotateFails(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.log")
+	f, err := OpenRotatingFile(path, 10, 1)
+	require.NoError(t, err)
+	defer f.Close()
+
+	// Test: When the file cannot be moved aside, writes go on to it and
+	// rotation is retried once another MaxSize bytes have been written
+	require.NoError(t, os.MkdirAll(filepath.Join(path+".1", "blocker"), 0o755))
+	for _, line := range []string{"one\n", "two\n", "three\n"} {
+		_, err := f.Write([]byte(line))
+		require.NoError(t, err)
+	}
+	b, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, "one\ntwo\nthree\n", string(b))
+
+	require.NoError(t, os.RemoveAll(path+".1"))
+	_, err = f.Write([]byte("four\n"))
+	require.NoError(t, err)
+	b, err = os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, "four\n", string(b))
+	b, err = os.ReadFile(path + ".1")
+	require.NoError(t, err)
+	assert.Equal(t, "one\ntwo\nthree\n", string(b))
+}
@@ -0,0 +1,33 @@
+package cidr
+
+import (
+	"net/netip"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseList(t *testing.T) {
+	prefixes, err := ParseList(" 10.1.2.3/8, 127.0.0.1,,2001:db8::/32 ")
+	require.NoError(t, err)
+	assert.Equal(t, []netip.Prefix{
+		netip.MustParsePrefix("10.0.0.0/8"),
+		netip.MustParsePrefix("127.0.0.1/32"),
+		netip.MustParsePrefix("2001:db8::/32"),
+	}, prefixes)
+
+	assert.True(t, Contains(prefixes, netip.MustParseAddr("10.9.9.9")))
+	assert.True(t, Contains(prefixes, netip.MustParseAddr("2001:db8::1")))
+	assert.False(t, Contains(prefixes, netip.MustParseAddr("127.0.0.2")))
+	assert.False(t, Contains(nil, netip.MustParseAddr("10.9.9.9")))
+
+	prefixes, err = ParseList("")
+	require.NoError(t, err)
+	assert.Empty(t, prefixes)
+
+	_, err = ParseList("10.0.0.0/33")
+	assert.Error(t, err)
+	_, err = ParseList("localhost")
+	assert.Error(t, err)
+}
@@ -0,0 +1,162 @@
+package compress
+
+import (
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+
+	"github.com/PeterKWIlliams/http/internal/headers"
+	"github.com/PeterKWIlliams/http/internal/request"
+	"github.com/PeterKWIlliams/http/internal/response"
+	"github.com/PeterKWIlliams/http/internal/server"
+)
+
+const (
+	Brotli  = "br"
+	Gzip    = "gzip"
+	Deflate = "deflate"
+)
+
+const DefaultMinSize = 1024
+
+type Options struct {
+	// MinSize is the smallest Content-Length worth compressing. Bodies
+	// without a Content-Length are always compressed.
+	MinSize int
+	// Level is passed to the encoder; zero selects each encoder's default.
+	Level int
+	// Encodings lists the supported codings in order of preference.
+	Encodings []string
+}
+
+var defaultEncodings = []string{Brotli, Gzip, Deflate}
+
+// Media types whose payloads are already compressed.
+var incompressibleTypes = map[string]struct{}{
+	"application/gzip":             {},
+	"application/x-gzip":           {},
+	"application/zip":              {},
+	"application/zstd":             {},
+	"application/x-bzip2":          {},
+	"application/x-7z-compressed":  {},
+	"application/x-rar-compressed": {},
+	"application/x-xz":             {},
+	"application/pdf":              {},
+	"font/woff":                    {},
+	"font/woff2":                   {},
+}
+
+func Middleware(opts Options) server.Middleware {
+	if opts.MinSize <= 0 {
+		opts.MinSize = DefaultMinSize
+	}
+	if len(opts.Encodings) == 0 {
+		opts.Encodings = defaultEncodings
+	}
+	return func(next server.Handler) server.Handler {
+		return func(w *response.Writer, req *request.Request) {
+			acceptEncoding, _ := req.Headers.Get("accept-encoding")
+			w.OnWriteHeaders(func(statusCode response.StatusCode, h headers.Headers) {
+				if !compressible(statusCode, h) {
+					return
+				}
+				addVary(h, "Accept-Encoding")
+
+				if req.RequestLine.Method == "HEAD" {
+					return
+				}
+				if cl, err := h.Get("content-length"); err == nil {
+					if n, err := strconv.Atoi(cl); err == nil && n < opts.MinSize {
+						return
+					}
+				}
+				coding := negotiate(acceptEncoding, opts.Encodings)
+				if coding == "" {
+					return
+				}
+
+				h.Set("content-encoding", coding)
+				h.Delete("content-length")
+				if te, err := h.Get("transfer-encoding"); err != nil || !strings.Contains(strings.ToLower(te), "chunked") {
+					h.Set("transfer-encoding", "chunked")
+				}
+				w.WrapBody(encoder(coding, opts.Level))
+			})
+			next(w, req)
+		}
+	}
+}
+
+func compressible(statusCode response.StatusCode, h headers.Headers) bool {
+	if statusCode < 200 || statusCode == 204 || statusCode == 206 || statusCode == 304 {
+		return false
+	}
+	if ce, err := h.Get("content-encoding"); err == nil && ce != "" && ce != "identity" {
+		return false
+	}
+	if _, err := h.Get("content-range"); err == nil {
+		return false
+	}
+	ct, _ := h.Get("content-type")
+	mediaType := strings.ToLower(strings.TrimSpace(strings.Split(ct, ";")[0]))
+	if _, found := incompressibleTypes[mediaType]; found {
+		return false
+	}
+	if strings.HasPrefix(mediaType, "image/") && mediaType != "image/svg+xml" {
+		return false
+	}
+	if strings.HasPrefix(mediaType, "video/") || strings.HasPrefix(mediaType, "audio/") {
+		return false
+	}
+	return true
+}
+
+func addVary(h headers.Headers, fieldName string) {
+	vary, err := h.Get("vary")
+	if err != nil || vary == "" {
+		h.Set("vary", fieldName)
+		return
+	}
+	for _, v := range strings.Split(vary, ",") {
+		v = strings.TrimSpace(v)
+		if v == "*" || strings.EqualFold(v, fieldName) {
+			return
+		}
+	}
+	h.Set("vary", vary+", "+fieldName)
+}
+
+func encoder(coding string, level int) response.BodyWrapper {
+	return func(dst io.Writer) io.WriteCloser {
+		level := level
+		switch coding {
+		case Brotli:
+			if level == 0 {
+				level = brotli.DefaultCompression
+			}
+			return brotli.NewWriterLevel(dst, level)
+		case Deflate:
+			if level == 0 {
+				level = zlib.DefaultCompression
+			}
+			zw, err := zlib.NewWriterLevel(dst, level)
+			if err != nil {
+				zw = zlib.NewWriter(dst)
+			}
+			return zw
+		default:
+			if level == 0 {
+				level = gzip.DefaultCompression
+			}
+			gw, err := gzip.NewWriterLevel(dst, level)
+			if err != nil {
+				gw = gzip.NewWriter(dst)
+			}
+			return gw
+		}
+	}
+}
@@ -0,0 +1,90 @@
+package compress
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/PeterKWIlliams/http/internal/request"
+	"github.com/PeterKWIlliams/http/internal/response"
+)
+
+func TestNegotiate(t *testing.T) {
+	supported := []string{Brotli, Gzip, Deflate}
+
+	assert.Equal(t, "", negotiate("", supported))
+	assert.Equal(t, "gzip", negotiate("gzip", supported))
+	assert.Equal(t, "br", negotiate("gzip, deflate, br", supported))
+	assert.Equal(t, "gzip", negotiate("br;q=0.5, gzip;q=0.8", supported))
+	assert.Equal(t, "deflate", negotiate("br;q=0, gzip;q=0, *", supported))
+	assert.Equal(t, "", negotiate("br;q=0, *;q=0", supported))
+	assert.Equal(t, "gzip", negotiate("x-gzip", supported))
+	assert.Equal(t, "", negotiate("identity", supported))
+	assert.Equal(t, "", negotiate("gzip;q=abc", supported))
+}
+
+func serve(t *testing.T, acceptEncoding string, contentType string, body []byte) *http.Response {
+	t.Helper()
+	raw := "GET / HTTP/1.1\r\nHost: localhost\r\n"
+	if acceptEncoding != "" {
+		raw += "Accept-Encoding: " + acceptEncoding + "\r\n"
+	}
+	req, err := request.RequestFromReader(strings.NewReader(raw + "\r\n"))
+	require.NoError(t, err)
+
+	var out bytes.Buffer
+	w := &response.Writer{Writer: &out}
+	handler := Middleware(Options{MinSize: 16})(func(w *response.Writer, req *request.Request) {
+		h := response.GetDefaultHeaders(len(body))
+		h.Set("content-type", contentType)
+		require.NoError(t, w.Write(response.OK, h, body))
+	})
+	handler(w, req)
+	require.NoError(t, w.Finish())
+
+	resp, err := http.ReadResponse(bufio.NewReader(&out), nil)
+	require.NoError(t, err)
+	return resp
+}
+
+func TestMiddleware_Gzip(t *testing.T) {
+	body := []byte(strings.Repeat("hello compression ", 100))
+	resp := serve(t, "gzip;q=1, br;q=0.5", "text/plain", body)
+
+	assert.Equal(t, "gzip", resp.Header.Get("Content-Encoding"))
+	assert.Equal(t, "Accept-Encoding", resp.Header.Get("Vary"))
+	assert.Equal(t, []string{"chunked"}, resp.TransferEncoding)
+
+	gr, err := gzip.NewReader(resp.Body)
+	require.NoError(t, err)
+	decoded, err := io.ReadAll(gr)
+	require.NoError(t, err)
+	assert.Equal(t, body, decoded)
+}
+
+func TestMiddleware_Skips(t *testing.T) {
+	// Test: Body below the minimum size
+	resp := serve(t, "gzip", "text/plain", []byte("tiny"))
+	assert.Equal(t, "", resp.Header.Get("Content-Encoding"))
+	assert.Equal(t, "4", resp.Header.Get("Content-Length"))
+
+	// Test: Already compressed media type
+	body := bytes.Repeat([]byte{0xff}, 100)
+	resp = serve(t, "gzip", "image/png", body)
+	assert.Equal(t, "", resp.Header.Get("Content-Encoding"))
+	assert.Equal(t, "", resp.Header.Get("Vary"))
+	assert.Equal(t, strconv.Itoa(len(body)), resp.Header.Get("Content-Length"))
+
+	// Test: Client does not accept any supported coding
+	resp = serve(t, "", "text/plain", body)
+	assert.Equal(t, "", resp.Header.Get("Content-Encoding"))
+	assert.Equal(t, "Accept-Encoding", resp.Header.Get("Vary"))
+}
@@ -0,0 +1,125 @@
+package compress
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"strconv"
+	"strings"
+
+	"github.com/PeterKWIlliams/http/internal/headers"
+	"github.com/PeterKWIlliams/http/internal/request"
+	"github.com/PeterKWIlliams/http/internal/response"
+	"github.com/PeterKWIlliams/http/internal/server"
+)
+
+const DefaultMaxDecodedSize = 10 << 20
+
+var (
+	errUnsupportedEncoding = errors.New("unsupported content encoding")
+	errDecodedTooLarge     = errors.New("decoded body exceeds maximum size")
+)
+
+// DecodeRequest replaces gzip and deflate encoded request bodies with their
+// decoded form before calling the next handler. Decoding stops once the
+// output grows past maxSize, which guards against decompression bombs.
+func DecodeRequest(maxSize int64) server.Middleware {
+	if maxSize <= 0 {
+		maxSize = DefaultMaxDecodedSize
+	}
+	return func(next server.Handler) server.Handler {
+		return func(w *response.Writer, req *request.Request) {
+			contentEncoding, err := req.Headers.Get("content-encoding")
+			if err != nil || len(req.Body) == 0 {
+				next(w, req)
+				return
+			}
+
+			body, err := decodeBody(req.Body, contentEncoding, maxSize)
+			if err != nil {
+				statusCode := response.BadRequest
+				switch {
+				case errors.Is(err, errUnsupportedEncoding):
+					statusCode = response.UnsupportedMediaType
+					w.OnWriteHeaders(func(_ response.StatusCode, h headers.Headers) {
+						h.Set("accept-encoding", "gzip, deflate")
+					})
+				case errors.Is(err, errDecodedTooLarge):
+					statusCode = response.PayloadTooLarge
+				}
+				if err := server.WriteError(w, statusCode, err.Error()); err != nil {
+					log.Printf("could not write decode error: %v", err)
+				}
+				return
+			}
+
+			req.Body = body
+			req.Contentlength = len(body)
+			req.Headers.Delete("content-encoding")
+			req.Headers.Set("content-length", strconv.Itoa(len(body)))
+			next(w, req)
+		}
+	}
+}
+
+// decodeBody undoes each coding in the Content-Encoding list, last applied
+// first.
+func decodeBody(body []byte, contentEncoding string, maxSize int64) ([]byte, error) {
+	codings := strings.Split(contentEncoding, ",")
+	for i := len(codings) - 1; i >= 0; i-- {
+		coding := strings.ToLower(strings.TrimSpace(codings[i]))
+		var err error
+		switch coding {
+		case "", "identity":
+			continue
+		case Gzip, "x-gzip":
+			body, err = decodeGzip(body, maxSize)
+		case Deflate:
+			body, err = decodeDeflate(body, maxSize)
+		default:
+			return nil, fmt.Errorf("%w: %s", errUnsupportedEncoding, coding)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return body, nil
+}
+
+func decodeGzip(body []byte, maxSize int64) ([]byte, error) {
+	gr, err := gzip.NewReader(bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("invalid gzip body: %w", err)
+	}
+	defer gr.Close()
+	return readLimited(gr, maxSize)
+}
+
+// decodeDeflate accepts zlib-wrapped data as RFC 9110 specifies, falling
+// back to raw DEFLATE which some clients send instead.
+func decodeDeflate(body []byte, maxSize int64) ([]byte, error) {
+	zr, err := zlib.NewReader(bytes.NewReader(body))
+	if err != nil {
+		fr := flate.NewReader(bytes.NewReader(body))
+		defer fr.Close()
+		return readLimited(fr, maxSize)
+	}
+	defer zr.Close()
+	return readLimited(zr, maxSize)
+}
+
+func readLimited(r io.Reader, maxSize int64) ([]byte, error) {
+	decoded, err := io.ReadAll(io.LimitReader(r, maxSize+1))
+	if err != nil {
+		return nil, fmt.Errorf("invalid encoded body: %w", err)
+	}
+	if int64(len(decoded)) > maxSize {
+		return nil, errDecodedTooLarge
+	}
+	return decoded, nil
+}
@@ -0,0 +1,68 @@
+package compress
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/PeterKWIlliams/http/internal/request"
+	"github.com/PeterKWIlliams/http/internal/response"
+)
+
+func encodedRequest(t *testing.T, contentEncoding string, body []byte) *request.Request {
+	t.Helper()
+	raw := "POST /upload HTTP/1.1\r\n" +
+		"Host: localhost\r\n" +
+		"Content-Encoding: " + contentEncoding + "\r\n" +
+		"Content-Length: " + strconv.Itoa(len(body)) + "\r\n" +
+		"\r\n" + string(body)
+	req, err := request.RequestFromReader(strings.NewReader(raw))
+	require.NoError(t, err)
+	return req
+}
+
+func TestDecodeRequest(t *testing.T) {
+	plain := []byte(strings.Repeat("decode me ", 50))
+
+	var gz bytes.Buffer
+	gw := gzip.NewWriter(&gz)
+	_, _ = gw.Write(plain)
+	require.NoError(t, gw.Close())
+
+	var zl bytes.Buffer
+	zw := zlib.NewWriter(&zl)
+	_, _ = zw.Write(plain)
+	require.NoError(t, zw.Close())
+
+	for coding, encoded := range map[string][]byte{"gzip": gz.Bytes(), "deflate": zl.Bytes()} {
+		var got []byte
+		handler := DecodeRequest(0)(func(w *response.Writer, req *request.Request) {
+			got = req.Body
+			_, err := req.Headers.Get("content-encoding")
+			assert.Error(t, err)
+		})
+		handler(&response.Writer{Writer: &bytes.Buffer{}}, encodedRequest(t, coding, encoded))
+		assert.Equal(t, plain, got, coding)
+	}
+
+	// Test: Decoded body larger than the limit
+	var out bytes.Buffer
+	called := false
+	handler := DecodeRequest(100)(func(w *response.Writer, req *request.Request) { called = true })
+	handler(&response.Writer{Writer: &out}, encodedRequest(t, "gzip", gz.Bytes()))
+	assert.False(t, called)
+	assert.True(t, strings.HasPrefix(out.String(), "HTTP/1.1 413 "))
+
+	// Test: Unsupported coding
+	out.Reset()
+	handler(&response.Writer{Writer: &out}, encodedRequest(t, "compress", []byte("abc")))
+	assert.False(t, called)
+	assert.True(t, strings.HasPrefix(out.String(), "HTTP/1.1 415 "))
+	assert.Contains(t, out.String(), "accept-encoding: gzip, deflate\r\n")
+}
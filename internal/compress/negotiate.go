@@ -0,0 +1,77 @@
+package compress
+
+import (
+	"strconv"
+	"strings"
+)
+
+type acceptedEncoding struct {
+	coding string
+	q      float64
+}
+
+func parseAcceptEncoding(value string) []acceptedEncoding {
+	var accepted []acceptedEncoding
+	for _, part := range strings.Split(value, ",") {
+		params := strings.Split(part, ";")
+		coding := strings.ToLower(strings.TrimSpace(params[0]))
+		if coding == "" {
+			continue
+		}
+		q := 1.0
+		for _, param := range params[1:] {
+			name, val, found := strings.Cut(strings.TrimSpace(param), "=")
+			if !found || strings.ToLower(strings.TrimSpace(name)) != "q" {
+				continue
+			}
+			parsed, err := strconv.ParseFloat(strings.TrimSpace(val), 64)
+			if err != nil || parsed < 0 || parsed > 1 {
+				q = 0
+				continue
+			}
+			q = parsed
+		}
+		accepted = append(accepted, acceptedEncoding{coding: coding, q: q})
+	}
+	return accepted
+}
+
+// negotiate picks the supported coding with the highest q-value from an
+// Accept-Encoding header, breaking ties by the order of supported. It
+// returns "" when the body should be sent uncompressed.
+func negotiate(acceptEncoding string, supported []string) string {
+	accepted := parseAcceptEncoding(acceptEncoding)
+	if len(accepted) == 0 {
+		return ""
+	}
+
+	wildcard := -1.0
+	qValues := make(map[string]float64, len(accepted))
+	for _, a := range accepted {
+		if a.coding == "*" {
+			wildcard = a.q
+			continue
+		}
+		if a.coding == "x-gzip" {
+			a.coding = "gzip"
+		}
+		qValues[a.coding] = a.q
+	}
+
+	best := ""
+	bestQ := 0.0
+	for _, coding := range supported {
+		q, listed := qValues[coding]
+		if !listed {
+			if wildcard < 0 {
+				continue
+			}
+			q = wildcard
+		}
+		if q > bestQ {
+			best = coding
+			bestQ = q
+		}
+	}
+	return best
+}
@@ -0,0 +1,165 @@
+package fileserver
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/PeterKWIlliams/http/internal/headers"
+	"github.com/PeterKWIlliams/http/internal/request"
+	"github.com/PeterKWIlliams/http/internal/response"
+)
+
+// ServeContent writes content as the response, answering Range requests
+// with 206 Partial Content (multipart/byteranges for several ranges) or
+// 416 when no range can be satisfied. name is only used to infer the
+// Content-Type. A non-zero modTime is used for Last-Modified and ETag and
+// enables conditional requests.
+func ServeContent(w *response.Writer, req *request.Request, name string, modTime time.Time, content io.ReadSeeker) {
+	size, err := content.Seek(0, io.SeekEnd)
+	if err != nil {
+		writeError(w, response.InternalServerError, "could not read content")
+		return
+	}
+	if _, err := content.Seek(0, io.SeekStart); err != nil {
+		writeError(w, response.InternalServerError, "could not read content")
+		return
+	}
+	contentType, err := detectContentType(name, content)
+	if err != nil {
+		writeError(w, response.InternalServerError, "could not read content")
+		return
+	}
+
+	validators := response.Validators{Exists: true, LastModified: modTime}
+	if !modTime.IsZero() {
+		validators.ETag = response.ModTimeETag(modTime, size)
+	}
+	if done, err := w.CheckPreconditions(req.RequestLine.Method, req.Headers, validators); done {
+		if err != nil {
+			log.Printf("could not write precondition response: %v", err)
+		}
+		return
+	}
+
+	h := response.GetDefaultHeaders(int(size))
+	h.Set("content-type", contentType)
+	h.Set("accept-ranges", "bytes")
+	if !modTime.IsZero() {
+		h.Set("last-modified", modTime.UTC().Format(response.TimeFormat))
+		h.Set("etag", validators.ETag)
+	}
+
+	ranges, err := requestedRanges(req, h, modTime, size)
+	if errors.Is(err, errUnsatisfiableRange) {
+		body := []byte("range not satisfiable")
+		h := response.GetDefaultHeaders(len(body))
+		h.Set("content-range", fmt.Sprintf("bytes */%d", size))
+		if err := w.Write(response.RangeNotSatisfiable, h, body); err != nil {
+			log.Printf("could not write range error: %v", err)
+		}
+		return
+	}
+
+	statusCode := response.OK
+	var boundary string
+	switch len(ranges) {
+	case 0:
+	case 1:
+		statusCode = response.PartialContent
+		h.Set("content-range", ranges[0].contentRange(size))
+		h.Set("content-length", strconv.FormatInt(ranges[0].length, 10))
+	default:
+		statusCode = response.PartialContent
+		boundary = multipartBoundary()
+		h.Set("content-type", "multipart/byteranges; boundary="+boundary)
+		h.Set("content-length", strconv.FormatInt(multipartLength(boundary, contentType, ranges, size), 10))
+	}
+
+	if err := w.WriteStatusLine(statusCode); err != nil {
+		log.Printf("could not write status line: %v", err)
+		return
+	}
+	if err := w.WriteHeaders(h); err != nil {
+		log.Printf("could not write headers: %v", err)
+		return
+	}
+	if req.RequestLine.Method == "HEAD" {
+		return
+	}
+
+	body := w.BodyWriter()
+	switch len(ranges) {
+	case 0:
+		_, err = io.Copy(body, content)
+	case 1:
+		err = copyRange(body, content, ranges[0])
+	default:
+		for i, r := range ranges {
+			if _, err = io.WriteString(body, partHeader(boundary, contentType, r, size, i == 0)); err != nil {
+				break
+			}
+			if err = copyRange(body, content, r); err != nil {
+				break
+			}
+		}
+		if err == nil {
+			_, err = io.WriteString(body, multipartTrailer(boundary))
+		}
+	}
+	if err != nil {
+		log.Printf("error streaming %s: %v", name, err)
+	}
+}
+
+func copyRange(dst io.Writer, content io.ReadSeeker, r byteRange) error {
+	if _, err := content.Seek(r.start, io.SeekStart); err != nil {
+		return err
+	}
+	_, err := io.CopyN(dst, content, r.length)
+	return err
+}
+
+// requestedRanges returns the ranges to serve, or none when the full
+// representation should be sent.
+func requestedRanges(req *request.Request, h headers.Headers, modTime time.Time, size int64) ([]byteRange, error) {
+	if req.RequestLine.Method != "GET" && req.RequestLine.Method != "HEAD" {
+		return nil, nil
+	}
+	rangeHeader, err := req.Headers.Get("range")
+	if err != nil {
+		return nil, nil
+	}
+	if ifRange, err := req.Headers.Get("if-range"); err == nil {
+		etag, _ := h.Get("etag")
+		if !ifRangeMatches(ifRange, etag, modTime) {
+			return nil, nil
+		}
+	}
+	ranges, err := parseRange(rangeHeader, size)
+	if errors.Is(err, errInvalidRange) {
+		return nil, nil
+	}
+	return ranges, err
+}
+
+// ifRangeMatches reports whether the validator in an If-Range header still
+// matches the representation. Only strong entity tags and exact dates count.
+func ifRangeMatches(ifRange string, etag string, modTime time.Time) bool {
+	ifRange = strings.TrimSpace(ifRange)
+	if strings.HasPrefix(ifRange, `"`) || strings.HasPrefix(ifRange, "W/") {
+		return etag != "" && !strings.HasPrefix(ifRange, "W/") && !strings.HasPrefix(etag, "W/") && ifRange == etag
+	}
+	if modTime.IsZero() {
+		return false
+	}
+	t, err := time.Parse(response.TimeFormat, ifRange)
+	if err != nil {
+		return false
+	}
+	return modTime.UTC().Truncate(time.Second).Equal(t)
+}
@@ -0,0 +1,248 @@
+package fileserver
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/PeterKWIlliams/http/internal/headers"
+	"github.com/PeterKWIlliams/http/internal/request"
+	"github.com/PeterKWIlliams/http/internal/response"
+	"github.com/PeterKWIlliams/http/internal/server"
+)
+
+const sniffLen = 512
+
+type SymlinkPolicy int
+
+const (
+	// SymlinksDeny refuses any path that goes through a symbolic link.
+	SymlinksDeny SymlinkPolicy = iota
+	// SymlinksWithinRoot follows links as long as the target stays inside
+	// the root directory.
+	SymlinksWithinRoot
+	// SymlinksFollow follows links wherever they point.
+	SymlinksFollow
+)
+
+type FileServer struct {
+	Root     string
+	Prefix   string
+	Listing  bool
+	Symlinks SymlinkPolicy
+}
+
+var (
+	errNotFound  = errors.New("not found")
+	errForbidden = errors.New("forbidden")
+)
+
+func New(root string) *FileServer {
+	return &FileServer{Root: root}
+}
+
+// Serve is a server.Handler serving files below Root. Prefix is stripped
+// from the request path before it is mapped onto the file system.
+func (f *FileServer) Serve(w *response.Writer, req *request.Request) {
+	method := req.RequestLine.Method
+	if method != "GET" && method != "HEAD" {
+		w.OnWriteHeaders(func(_ response.StatusCode, h headers.Headers) {
+			h.Set("allow", "GET, HEAD")
+		})
+		writeError(w, response.MethodNotAllowed, "method not allowed")
+		return
+	}
+
+	urlPath, err := requestPath(req.RequestLine.RequestTarget)
+	if err != nil {
+		writeError(w, response.BadRequest, "invalid path")
+		return
+	}
+	rest, found := strings.CutPrefix(urlPath, strings.TrimSuffix(f.Prefix, "/"))
+	if !found || (rest != "" && !strings.HasPrefix(rest, "/")) {
+		writeError(w, response.NotFound, "not found")
+		return
+	}
+	name := path.Clean("/" + rest)
+
+	fullPath, err := f.resolve(name)
+	if err != nil {
+		writeFSError(w, err)
+		return
+	}
+	info, err := os.Stat(fullPath)
+	if err != nil {
+		writeFSError(w, err)
+		return
+	}
+
+	if info.IsDir() {
+		if !strings.HasSuffix(urlPath, "/") {
+			_, rawQuery, _ := strings.Cut(req.RequestLine.RequestTarget, "?")
+			redirect(w, urlPath+"/", rawQuery)
+			return
+		}
+		indexPath := filepath.Join(fullPath, "index.html")
+		if indexInfo, err := os.Stat(indexPath); err == nil && !indexInfo.IsDir() {
+			if _, err := f.resolve(path.Join(name, "index.html")); err == nil {
+				serveFile(w, req, indexPath, indexInfo)
+				return
+			}
+		}
+		if !f.Listing {
+			writeError(w, response.Forbidden, "directory listing is disabled")
+			return
+		}
+		f.serveListing(w, req, fullPath, urlPath)
+		return
+	}
+
+	serveFile(w, req, fullPath, info)
+}
+
+// ServeFile writes the named file as the response, inferring its
+// Content-Type from the extension or, failing that, its contents.
+func ServeFile(w *response.Writer, req *request.Request, name string) {
+	info, err := os.Stat(name)
+	if err != nil {
+		writeFSError(w, err)
+		return
+	}
+	if info.IsDir() {
+		writeError(w, response.Forbidden, "is a directory")
+		return
+	}
+	serveFile(w, req, name, info)
+}
+
+func serveFile(w *response.Writer, req *request.Request, name string, info fs.FileInfo) {
+	file, err := os.Open(name)
+	if err != nil {
+		writeFSError(w, err)
+		return
+	}
+	defer file.Close()
+
+	ServeContent(w, req, name, info.ModTime(), file)
+}
+
+func detectContentType(name string, file io.ReadSeeker) (string, error) {
+	if ct := mime.TypeByExtension(filepath.Ext(name)); ct != "" {
+		return ct, nil
+	}
+	buf := make([]byte, sniffLen)
+	n, err := io.ReadFull(file, buf)
+	if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) {
+		return "", err
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	return http.DetectContentType(buf[:n]), nil
+}
+
+// resolve maps a cleaned, slash-rooted name onto the file system and
+// applies the symlink policy.
+func (f *FileServer) resolve(name string) (string, error) {
+	if strings.Contains(name, "\x00") || strings.Contains(name, "\\") {
+		return "", errNotFound
+	}
+	root, err := filepath.Abs(f.Root)
+	if err != nil {
+		return "", err
+	}
+	fullPath := filepath.Join(root, filepath.FromSlash(name))
+	if !within(root, fullPath) {
+		return "", errForbidden
+	}
+
+	switch f.Symlinks {
+	case SymlinksFollow:
+		return fullPath, nil
+	case SymlinksWithinRoot:
+		realRoot, err := filepath.EvalSymlinks(root)
+		if err != nil {
+			return "", err
+		}
+		realPath, err := filepath.EvalSymlinks(fullPath)
+		if err != nil {
+			return "", err
+		}
+		if !within(realRoot, realPath) {
+			return "", errForbidden
+		}
+		return realPath, nil
+	default:
+		current := root
+		for _, part := range strings.Split(strings.Trim(name, "/"), "/") {
+			if part == "" {
+				continue
+			}
+			current = filepath.Join(current, part)
+			info, err := os.Lstat(current)
+			if err != nil {
+				return "", err
+			}
+			if info.Mode()&fs.ModeSymlink != 0 {
+				return "", errForbidden
+			}
+		}
+		return fullPath, nil
+	}
+}
+
+func within(root, name string) bool {
+	rel, err := filepath.Rel(root, name)
+	if err != nil {
+		return false
+	}
+	return rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+func requestPath(target string) (string, error) {
+	rawPath, _, _ := strings.Cut(target, "?")
+	if !strings.HasPrefix(rawPath, "/") {
+		return "", fmt.Errorf("request target is not an absolute path: %s", target)
+	}
+	return url.PathUnescape(rawPath)
+}
+
+func redirect(w *response.Writer, location string, rawQuery string) {
+	h := response.GetDefaultHeaders(0)
+	location = (&url.URL{Path: location}).EscapedPath()
+	if rawQuery != "" {
+		location += "?" + rawQuery
+	}
+	h.Set("location", location)
+	if err := w.Write(response.MovedPermanently, h, nil); err != nil {
+		log.Printf("could not write redirect: %v", err)
+	}
+}
+
+func writeFSError(w *response.Writer, err error) {
+	switch {
+	case errors.Is(err, errForbidden), errors.Is(err, fs.ErrPermission):
+		writeError(w, response.Forbidden, "forbidden")
+	case errors.Is(err, errNotFound), errors.Is(err, fs.ErrNotExist), errors.Is(err, syscall.ENOTDIR):
+		writeError(w, response.NotFound, "not found")
+	default:
+		log.Printf("file server error: %v", err)
+		writeError(w, response.InternalServerError, "could not retrieve file")
+	}
+}
+
+func writeError(w *response.Writer, statusCode response.StatusCode, message string) {
+	if err := server.WriteError(w, statusCode, message); err != nil {
+		log.Printf("could not write error: %v", err)
+	}
+}
@@ -0,0 +1,144 @@
+package fileserver
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/PeterKWIlliams/http/internal/request"
+	"github.com/PeterKWIlliams/http/internal/response"
+)
+
+func get(t *testing.T, handler func(*response.Writer, *request.Request), method string, target string) (*http.Response, string) {
+	t.Helper()
+	req, err := request.RequestFromReader(strings.NewReader(method + " " + target + " HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	require.NoError(t, err)
+
+	var out bytes.Buffer
+	w := &response.Writer{Writer: &out}
+	handler(w, req)
+	require.NoError(t, w.Finish())
+
+	resp, err := http.ReadResponse(bufio.NewReader(&out), &http.Request{Method: method})
+	require.NoError(t, err)
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	return resp, string(body)
+}
+
+func setupRoot(t *testing.T) (string, string) {
+	t.Helper()
+	base := t.TempDir()
+	root := filepath.Join(base, "public")
+	require.NoError(t, os.MkdirAll(filepath.Join(root, "docs", "empty"), 0o755))
+	require.NoError(t, os.WriteFile(filepath.Join(root, "index.html"), []byte("<h1>home</h1>"), 0o644))
+	require.NoError(t, os.WriteFile(filepath.Join(root, "docs", "notes.txt"), []byte("some notes"), 0o644))
+	require.NoError(t, os.WriteFile(filepath.Join(root, "docs", "README"), []byte("<html><body>readme</body></html>"), 0o644))
+	require.NoError(t, os.WriteFile(filepath.Join(base, "secret.txt"), []byte("secret"), 0o644))
+	return base, root
+}
+
+func TestServe(t *testing.T) {
+	_, root := setupRoot(t)
+	fs := New(root)
+
+	// Test: Index file
+	resp, body := get(t, fs.Serve, "GET", "/")
+	assert.Equal(t, 200, resp.StatusCode)
+	assert.Equal(t, "text/html; charset=utf-8", resp.Header.Get("Content-Type"))
+	assert.Equal(t, "<h1>home</h1>", body)
+
+	// Test: Content type from extension
+	resp, body = get(t, fs.Serve, "GET", "/docs/notes.txt?download=1")
+	assert.Equal(t, 200, resp.StatusCode)
+	assert.Equal(t, "text/plain; charset=utf-8", resp.Header.Get("Content-Type"))
+	assert.Equal(t, "10", resp.Header.Get("Content-Length"))
+	assert.Equal(t, "some notes", body)
+
+	// Test: Content type from sniffing
+	resp, _ = get(t, fs.Serve, "GET", "/docs/README")
+	assert.Equal(t, "text/html; charset=utf-8", resp.Header.Get("Content-Type"))
+
+	// Test: HEAD sends no body
+	resp, body = get(t, fs.Serve, "HEAD", "/docs/notes.txt")
+	assert.Equal(t, 200, resp.StatusCode)
+	assert.Equal(t, "", body)
+
+	// Test: Directory without trailing slash
+	resp, _ = get(t, fs.Serve, "GET", "/docs")
+	assert.Equal(t, 301, resp.StatusCode)
+	assert.Equal(t, "/docs/", resp.Header.Get("Location"))
+	resp, _ = get(t, fs.Serve, "GET", "/docs?sort=name&order=desc")
+	assert.Equal(t, 301, resp.StatusCode)
+	assert.Equal(t, "/docs/?sort=name&order=desc", resp.Header.Get("Location"))
+
+	// Test: Listing disabled
+	resp, _ = get(t, fs.Serve, "GET", "/docs/")
+	assert.Equal(t, 403, resp.StatusCode)
+
+	// Test: Missing file
+	resp, _ = get(t, fs.Serve, "GET", "/nope.txt")
+	assert.Equal(t, 404, resp.StatusCode)
+
+	// Test: Unsupported method
+	resp, _ = get(t, fs.Serve, "POST", "/docs/notes.txt")
+	assert.Equal(t, 405, resp.StatusCode)
+	assert.Equal(t, "GET, HEAD", resp.Header.Get("Allow"))
+}
+
+func TestServe_Listing(t *testing.T) {
+	_, root := setupRoot(t)
+	require.NoError(t, os.WriteFile(filepath.Join(root, "docs", "<b>.txt"), []byte("x"), 0o644))
+	fs := &FileServer{Root: root, Prefix: "/static", Listing: true}
+
+	resp, body := get(t, fs.Serve, "GET", "/static/docs/")
+	assert.Equal(t, 200, resp.StatusCode)
+	assert.Contains(t, body, `<a href="empty/">empty/</a>`)
+	assert.Contains(t, body, `<a href="notes.txt">notes.txt</a>`)
+	assert.Contains(t, body, `&lt;b&gt;.txt`)
+	assert.NotContains(t, body, "<b>")
+	assert.Less(t, strings.Index(body, "empty/"), strings.Index(body, "notes.txt"))
+
+	resp, _ = get(t, fs.Serve, "GET", "/staticdocs/")
+	assert.Equal(t, 404, resp.StatusCode)
+}
+
+func TestServe_Traversal(t *testing.T) {
+	base, root := setupRoot(t)
+	fs := New(root)
+
+	for _, target := range []string{"/../secret.txt", "/docs/../../secret.txt", "/%2e%2e/secret.txt", "/..%2fsecret.txt"} {
+		resp, body := get(t, fs.Serve, "GET", target)
+		assert.NotEqual(t, 200, resp.StatusCode, target)
+		assert.NotEqual(t, "secret", body, target)
+	}
+
+	require.NoError(t, os.Symlink(filepath.Join(base, "secret.txt"), filepath.Join(root, "outside.txt")))
+	require.NoError(t, os.Symlink(filepath.Join(root, "docs", "notes.txt"), filepath.Join(root, "inside.txt")))
+
+	// Test: Default policy denies every symlink
+	resp, _ := get(t, fs.Serve, "GET", "/inside.txt")
+	assert.Equal(t, 403, resp.StatusCode)
+
+	// Test: Links that stay within the root
+	fs.Symlinks = SymlinksWithinRoot
+	resp, body := get(t, fs.Serve, "GET", "/inside.txt")
+	assert.Equal(t, 200, resp.StatusCode)
+	assert.Equal(t, "some notes", body)
+	resp, _ = get(t, fs.Serve, "GET", "/outside.txt")
+	assert.Equal(t, 403, resp.StatusCode)
+
+	// Test: Following every link
+	fs.Symlinks = SymlinksFollow
+	resp, body = get(t, fs.Serve, "GET", "/outside.txt")
+	assert.Equal(t, 200, resp.StatusCode)
+	assert.Equal(t, "secret", body)
+}
@@ -0,0 +1,57 @@
+package fileserver
+
+import (
+	"html"
+	"log"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/PeterKWIlliams/http/internal/request"
+	"github.com/PeterKWIlliams/http/internal/response"
+)
+
+func (f *FileServer) serveListing(w *response.Writer, req *request.Request, dir string, urlPath string) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		writeFSError(w, err)
+		return
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].IsDir() != entries[j].IsDir() {
+			return entries[i].IsDir()
+		}
+		return entries[i].Name() < entries[j].Name()
+	})
+
+	var b strings.Builder
+	title := html.EscapeString(urlPath)
+	b.WriteString("<!DOCTYPE html>\n<html>\n<head><title>Index of " + title + "</title></head>\n<body>\n")
+	b.WriteString("<h1>Index of " + title + "</h1>\n<ul>\n")
+	if urlPath != "/" && urlPath != f.Prefix && urlPath != f.Prefix+"/" {
+		b.WriteString("<li><a href=\"../\">../</a></li>\n")
+	}
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() {
+			name += "/"
+		}
+		href := (&url.URL{Path: name}).EscapedPath()
+		if strings.Contains(name, ":") {
+			href = "./" + href
+		}
+		b.WriteString("<li><a href=\"" + html.EscapeString(href) + "\">" + html.EscapeString(name) + "</a></li>\n")
+	}
+	b.WriteString("</ul>\n</body>\n</html>\n")
+
+	body := []byte(b.String())
+	h := response.GetDefaultHeaders(len(body))
+	h.Set("content-type", "text/html; charset=utf-8")
+	if req.RequestLine.Method == "HEAD" {
+		body = nil
+	}
+	if err := w.Write(response.OK, h, body); err != nil {
+		log.Printf("could not write directory listing: %v", err)
+	}
+}
@@ -0,0 +1,129 @@
+package fileserver
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Clients asking for more ranges than this get the whole representation.
+const maxRanges = 64
+
+var (
+	errInvalidRange       = errors.New("invalid range")
+	errUnsatisfiableRange = errors.New("range not satisfiable")
+)
+
+type byteRange struct {
+	start  int64
+	length int64
+}
+
+func (r byteRange) contentRange(size int64) string {
+	return fmt.Sprintf("bytes %d-%d/%d", r.start, r.start+r.length-1, size)
+}
+
+// parseRange parses a Range header against a representation of the given
+// size. errInvalidRange means the header should be ignored and the full
+// representation served; errUnsatisfiableRange calls for a 416.
+func parseRange(header string, size int64) ([]byteRange, error) {
+	unit, spec, found := strings.Cut(header, "=")
+	if !found || strings.TrimSpace(strings.ToLower(unit)) != "bytes" {
+		return nil, errInvalidRange
+	}
+
+	var ranges []byteRange
+	specs := strings.Split(spec, ",")
+	if len(specs) > maxRanges {
+		return nil, errInvalidRange
+	}
+	for _, s := range specs {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		first, last, found := strings.Cut(s, "-")
+		if !found {
+			return nil, errInvalidRange
+		}
+		first, last = strings.TrimSpace(first), strings.TrimSpace(last)
+
+		var r byteRange
+		if first == "" {
+			n, err := strconv.ParseInt(last, 10, 64)
+			if err != nil || n < 0 {
+				return nil, errInvalidRange
+			}
+			if n == 0 || size == 0 {
+				continue
+			}
+			if n > size {
+				n = size
+			}
+			r = byteRange{start: size - n, length: n}
+		} else {
+			start, err := strconv.ParseInt(first, 10, 64)
+			if err != nil || start < 0 {
+				return nil, errInvalidRange
+			}
+			end := size - 1
+			if last != "" {
+				end, err = strconv.ParseInt(last, 10, 64)
+				if err != nil || end < start {
+					return nil, errInvalidRange
+				}
+			}
+			if start >= size {
+				continue
+			}
+			if end >= size {
+				end = size - 1
+			}
+			r = byteRange{start: start, length: end - start + 1}
+		}
+		ranges = append(ranges, r)
+	}
+	if len(ranges) == 0 {
+		return nil, errUnsatisfiableRange
+	}
+
+	var total int64
+	for _, r := range ranges {
+		total += r.length
+	}
+	if total > size {
+		return nil, errInvalidRange
+	}
+	return ranges, nil
+}
+
+func multipartBoundary() string {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return "3d6b6a416f9b5"
+	}
+	return hex.EncodeToString(buf)
+}
+
+func partHeader(boundary string, contentType string, r byteRange, size int64, first bool) string {
+	prefix := "\r\n"
+	if first {
+		prefix = ""
+	}
+	return fmt.Sprintf("%s--%s\r\nContent-Type: %s\r\nContent-Range: %s\r\n\r\n", prefix, boundary, contentType, r.contentRange(size))
+}
+
+func multipartTrailer(boundary string) string {
+	return "\r\n--" + boundary + "--\r\n"
+}
+
+func multipartLength(boundary string, contentType string, ranges []byteRange, size int64) int64 {
+	var n int64
+	for i, r := range ranges {
+		n += int64(len(partHeader(boundary, contentType, r, size, i == 0))) + r.length
+	}
+	return n + int64(len(multipartTrailer(boundary)))
+}
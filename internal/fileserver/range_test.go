@@ -0,0 +1,156 @@
+package fileserver
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/PeterKWIlliams/http/internal/request"
+	"github.com/PeterKWIlliams/http/internal/response"
+)
+
+func TestParseRange(t *testing.T) {
+	ranges, err := parseRange("bytes=0-4", 10)
+	require.NoError(t, err)
+	assert.Equal(t, []byteRange{{start: 0, length: 5}}, ranges)
+
+	ranges, err = parseRange("bytes=7-", 10)
+	require.NoError(t, err)
+	assert.Equal(t, []byteRange{{start: 7, length: 3}}, ranges)
+
+	ranges, err = parseRange("bytes=-3", 10)
+	require.NoError(t, err)
+	assert.Equal(t, []byteRange{{start: 7, length: 3}}, ranges)
+
+	ranges, err = parseRange("bytes=-30", 10)
+	require.NoError(t, err)
+	assert.Equal(t, []byteRange{{start: 0, length: 10}}, ranges)
+
+	ranges, err = parseRange("bytes=0-1, 5-100", 10)
+	require.NoError(t, err)
+	assert.Equal(t, []byteRange{{start: 0, length: 2}, {start: 5, length: 5}}, ranges)
+
+	// Test: Unsatisfiable ranges are dropped when others remain
+	ranges, err = parseRange("bytes=20-30, 1-1", 10)
+	require.NoError(t, err)
+	assert.Equal(t, []byteRange{{start: 1, length: 1}}, ranges)
+
+	_, err = parseRange("bytes=10-", 10)
+	assert.ErrorIs(t, err, errUnsatisfiableRange)
+	_, err = parseRange("bytes=-0", 10)
+	assert.ErrorIs(t, err, errUnsatisfiableRange)
+
+	for _, header := range []string{"items=0-1", "bytes=5-1", "bytes=a-b", "bytes=1", "bytes=0-9, 0-9"} {
+		_, err = parseRange(header, 10)
+		assert.ErrorIs(t, err, errInvalidRange, header)
+	}
+}
+
+func serveContent(t *testing.T, extraHeaders string, modTime time.Time) (*http.Response, []byte) {
+	t.Helper()
+	raw := "GET /file.txt HTTP/1.1\r\nHost: localhost\r\n" + extraHeaders + "\r\n"
+	req, err := request.RequestFromReader(strings.NewReader(raw))
+	require.NoError(t, err)
+
+	var out bytes.Buffer
+	w := &response.Writer{Writer: &out}
+	ServeContent(w, req, "file.txt", modTime, strings.NewReader("0123456789abcdef"))
+	require.NoError(t, w.Finish())
+
+	resp, err := http.ReadResponse(bufio.NewReader(&out), nil)
+	require.NoError(t, err)
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	return resp, body
+}
+
+func TestServeContent_Ranges(t *testing.T) {
+	modTime := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+
+	// Test: No range
+	resp, body := serveContent(t, "", modTime)
+	assert.Equal(t, 200, resp.StatusCode)
+	assert.Equal(t, "bytes", resp.Header.Get("Accept-Ranges"))
+	assert.Equal(t, "Wed, 01 May 2024 12:00:00 GMT", resp.Header.Get("Last-Modified"))
+	assert.Equal(t, "0123456789abcdef", string(body))
+
+	// Test: Single range
+	resp, body = serveContent(t, "Range: bytes=2-5\r\n", modTime)
+	assert.Equal(t, 206, resp.StatusCode)
+	assert.Equal(t, "bytes 2-5/16", resp.Header.Get("Content-Range"))
+	assert.Equal(t, "4", resp.Header.Get("Content-Length"))
+	assert.Equal(t, "2345", string(body))
+
+	// Test: Unsatisfiable range
+	resp, _ = serveContent(t, "Range: bytes=100-\r\n", modTime)
+	assert.Equal(t, 416, resp.StatusCode)
+	assert.Equal(t, "bytes */16", resp.Header.Get("Content-Range"))
+
+	// Test: If-Range with a matching date
+	resp, body = serveContent(t, "Range: bytes=-2\r\nIf-Range: Wed, 01 May 2024 12:00:00 GMT\r\n", modTime)
+	assert.Equal(t, 206, resp.StatusCode)
+	assert.Equal(t, "ef", string(body))
+
+	// Test: If-Range with a stale date
+	resp, body = serveContent(t, "Range: bytes=-2\r\nIf-Range: Tue, 30 Apr 2024 12:00:00 GMT\r\n", modTime)
+	assert.Equal(t, 200, resp.StatusCode)
+	assert.Equal(t, "0123456789abcdef", string(body))
+
+	// Test: Multiple ranges
+	resp, body = serveContent(t, "Range: bytes=0-1,-3\r\n", modTime)
+	assert.Equal(t, 206, resp.StatusCode)
+	mediaType, params, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	require.NoError(t, err)
+	assert.Equal(t, "multipart/byteranges", mediaType)
+	assert.Equal(t, int64(len(body)), resp.ContentLength)
+
+	mr := multipart.NewReader(bytes.NewReader(body), params["boundary"])
+	var parts []string
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		data, err := io.ReadAll(part)
+		require.NoError(t, err)
+		assert.Equal(t, "text/plain; charset=utf-8", part.Header.Get("Content-Type"))
+		parts = append(parts, part.Header.Get("Content-Range")+" "+string(data))
+	}
+	assert.Equal(t, []string{"bytes 0-1/16 01", "bytes 13-15/16 def"}, parts)
+}
+
+func TestServeContent_Conditional(t *testing.T) {
+	modTime := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	resp, _ := serveContent(t, "", modTime)
+	etag := resp.Header.Get("ETag")
+	require.NotEmpty(t, etag)
+
+	// Test: Revalidation with a matching ETag
+	resp, body := serveContent(t, "If-None-Match: "+etag+"\r\n", modTime)
+	assert.Equal(t, 304, resp.StatusCode)
+	assert.Empty(t, body)
+	assert.Equal(t, etag, resp.Header.Get("ETag"))
+
+	// Test: Revalidation by date
+	resp, _ = serveContent(t, "If-Modified-Since: Wed, 01 May 2024 12:00:00 GMT\r\n", modTime)
+	assert.Equal(t, 304, resp.StatusCode)
+
+	// Test: If-Range with the current ETag
+	resp, body = serveContent(t, "Range: bytes=0-0\r\nIf-Range: "+etag+"\r\n", modTime)
+	assert.Equal(t, 206, resp.StatusCode)
+	assert.Equal(t, "0", string(body))
+
+	// Test: If-Range with a stale ETag
+	resp, _ = serveContent(t, "Range: bytes=0-0\r\nIf-Range: \"stale\"\r\n", modTime)
+	assert.Equal(t, 200, resp.StatusCode)
+}
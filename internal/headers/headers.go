@@ -79,6 +79,47 @@ func (h Headers) Set(fieldName string, fieldValue string) {
 	h[canonicalFieldName] = fieldValue
 }
 
+// Add appends fieldValue to fieldName. Repeated values are combined into
+// one comma-separated value, except for Set-Cookie, which cannot be: its
+// values are kept apart and written as separate field lines.
+func (h Headers) Add(fieldName string, fieldValue string) {
+	canonicalFieldName := strings.ToLower(fieldName)
+	existing, exists := h[canonicalFieldName]
+	switch {
+	case !exists:
+		h[canonicalFieldName] = fieldValue
+	case canonicalFieldName == "set-cookie":
+		h[canonicalFieldName] = existing + "\n" + fieldValue
+	default:
+		h[canonicalFieldName] = existing + ", " + fieldValue
+	}
+}
+
+// Values returns the field lines fieldName is written as: one for most
+// fields, and one per value for Set-Cookie.
+func (h Headers) Values(fieldName string) []string {
+	val, exists := h[fieldName]
+	if !exists {
+		val, exists = h[strings.ToLower(fieldName)]
+	}
+	if !exists {
+		return nil
+	}
+	return strings.Split(val, "\n")
+}
+
+func (h Headers) Delete(fieldName string) {
+	delete(h, strings.ToLower(fieldName))
+}
+
+func (h Headers) Clone() Headers {
+	clone := make(Headers, len(h))
+	for fieldName, fieldValue := range h {
+		clone[fieldName] = fieldValue
+	}
+	return clone
+}
+
 func validFieldName(fieldName string) error {
 	for _, char := range fieldName {
 		if _, exists := allowedCharSet[char]; !exists {
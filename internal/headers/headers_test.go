@@ -122,3 +122,17 @@ func TestHeaderParse(t *testing.T) {
 	assert.Equal(t, 18, n2)
 	assert.False(t, done)
 }
+
+func TestHeaderAdd(t *testing.T) {
+	h := NewHeaders()
+	h.Add("Vary", "Accept")
+	h.Add("vary", "Accept-Encoding")
+	assert.Equal(t, "Accept, Accept-Encoding", h["vary"])
+	assert.Equal(t, []string{"Accept, Accept-Encoding"}, h.Values("Vary"))
+
+	// Test: Set-Cookie values stay separate field lines
+	h.Add("Set-Cookie", "a=1; Expires=Wed, 21 Oct 2026 07:28:00 GMT")
+	h.Add("Set-Cookie", "b=2")
+	assert.Equal(t, []string{"a=1; Expires=Wed, 21 Oct 2026 07:28:00 GMT", "b=2"}, h.Values("set-cookie"))
+	assert.Nil(t, h.Values("missing"))
+}
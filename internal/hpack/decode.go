@@ -0,0 +1,158 @@
+package hpack
+
+import (
+	"errors"
+	"fmt"
+)
+
+// DefaultMaxStringLength bounds a single decoded name or value.
+const DefaultMaxStringLength = 64 << 10
+
+type Decoder struct {
+	table dynamicTable
+	// maxTableSize is the limit we advertised; size updates from the
+	// encoder may not exceed it.
+	maxTableSize    uint32
+	MaxStringLength int
+	// MaxHeaderListSize bounds the decoded size of a header block, counted
+	// as in SETTINGS_MAX_HEADER_LIST_SIZE. Zero means no limit.
+	MaxHeaderListSize int
+}
+
+// ErrHeaderListTooLarge is wrapped by the DecodingError returned when a
+// block decodes to more than MaxHeaderListSize.
+var ErrHeaderListTooLarge = errors.New("header list too large")
+
+func NewDecoder(maxTableSize uint32) *Decoder {
+	return &Decoder{
+		table:           dynamicTable{maxSize: maxTableSize},
+		maxTableSize:    maxTableSize,
+		MaxStringLength: DefaultMaxStringLength,
+	}
+}
+
+// SetMaxTableSize changes the limit advertised to the peer, which takes
+// effect once the peer acknowledges it.
+func (d *Decoder) SetMaxTableSize(size uint32) {
+	d.maxTableSize = size
+	if d.table.maxSize > size {
+		d.table.setMaxSize(size)
+	}
+}
+
+// Decode decodes a complete header block. Any error leaves the decoder
+// out of sync with the peer and must be treated as a connection error.
+func (d *Decoder) Decode(block []byte) ([]HeaderField, error) {
+	var fields []HeaderField
+	sawField := false
+	listSize := 0
+	for len(block) > 0 {
+		b := block[0]
+		var err error
+		var f HeaderField
+		switch {
+		case b&0x80 != 0:
+			// Indexed header field.
+			var index uint64
+			index, block, err = readInt(block, 7)
+			if err != nil {
+				return nil, DecodingError{err}
+			}
+			var ok bool
+			if f, ok = d.table.field(index); !ok {
+				return nil, DecodingError{fmt.Errorf("invalid index %d", index)}
+			}
+		case b&0xC0 == 0x40:
+			// Literal with incremental indexing.
+			f, block, err = d.readLiteral(block, 6)
+			if err != nil {
+				return nil, err
+			}
+			d.table.add(f)
+		case b&0xE0 == 0x20:
+			// Dynamic table size update.
+			if sawField {
+				return nil, DecodingError{errors.New("table size update after header field")}
+			}
+			var size uint64
+			size, block, err = readInt(block, 5)
+			if err != nil {
+				return nil, DecodingError{err}
+			}
+			if size > uint64(d.maxTableSize) {
+				return nil, DecodingError{fmt.Errorf("table size %d exceeds limit %d", size, d.maxTableSize)}
+			}
+			d.table.setMaxSize(uint32(size))
+			continue
+		default:
+			// Literal without indexing (0000) or never indexed (0001).
+			f, block, err = d.readLiteral(block, 4)
+			if err != nil {
+				return nil, err
+			}
+			f.Sensitive = b&0x10 != 0
+		}
+		sawField = true
+		// Indexed fields cost one byte each on the wire, so the decoded
+		// size has to be checked as it grows rather than after the block.
+		listSize += int(f.size())
+		if d.MaxHeaderListSize > 0 && listSize > d.MaxHeaderListSize {
+			return nil, DecodingError{ErrHeaderListTooLarge}
+		}
+		fields = append(fields, f)
+	}
+	return fields, nil
+}
+
+func (d *Decoder) readLiteral(block []byte, n uint8) (HeaderField, []byte, error) {
+	var f HeaderField
+	index, block, err := readInt(block, n)
+	if err != nil {
+		return f, nil, DecodingError{err}
+	}
+	if index > 0 {
+		named, ok := d.table.field(index)
+		if !ok {
+			return f, nil, DecodingError{fmt.Errorf("invalid index %d", index)}
+		}
+		f.Name = named.Name
+	} else {
+		if f.Name, block, err = d.readString(block); err != nil {
+			return f, nil, err
+		}
+	}
+	if f.Value, block, err = d.readString(block); err != nil {
+		return f, nil, err
+	}
+	return f, block, nil
+}
+
+func (d *Decoder) readString(block []byte) (string, []byte, error) {
+	if len(block) == 0 {
+		return "", nil, DecodingError{errNeedMore}
+	}
+	huffman := block[0]&0x80 != 0
+	length, block, err := readInt(block, 7)
+	if err != nil {
+		return "", nil, DecodingError{err}
+	}
+	if length > uint64(len(block)) {
+		return "", nil, DecodingError{errNeedMore}
+	}
+	if d.MaxStringLength > 0 && length > uint64(d.MaxStringLength) {
+		return "", nil, DecodingError{errors.New("string too long")}
+	}
+	raw := block[:length]
+	block = block[length:]
+	if !huffman {
+		return string(raw), block, nil
+	}
+	decoded, err := huffmanDecode(nil, raw)
+	if err != nil {
+		return "", nil, DecodingError{err}
+	}
+	if d.MaxStringLength > 0 && len(decoded) > d.MaxStringLength {
+		return "", nil, DecodingError{errors.New("string too long")}
+	}
+	return string(decoded), block, nil
+}
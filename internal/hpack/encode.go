@@ -0,0 +1,105 @@
+package hpack
+
+// Encoder compresses header lists. It adds every field that is not
+// marked sensitive to its dynamic table, so blocks must reach the peer in
+// the order they were encoded.
+type Encoder struct {
+	table dynamicTable
+	// DisableHuffman sends all strings as raw octets.
+	DisableHuffman bool
+
+	// Table size changes not yet signalled to the peer. minSize is the
+	// smallest size set since the last header block.
+	sizeUpdate bool
+	minSize    uint32
+}
+
+// NewEncoder returns an encoder whose dynamic table starts at
+// tableSize, which must match the peer's SETTINGS_HEADER_TABLE_SIZE.
+func NewEncoder(tableSize uint32) *Encoder {
+	return &Encoder{table: dynamicTable{maxSize: tableSize}}
+}
+
+// SetMaxDynamicTableSize changes the dynamic table size. The change is
+// signalled at the start of the next header block.
+func (e *Encoder) SetMaxDynamicTableSize(size uint32) {
+	if !e.sizeUpdate || size < e.minSize {
+		e.minSize = size
+	}
+	e.sizeUpdate = true
+	e.table.setMaxSize(size)
+}
+
+// AppendFields appends the header block for fields to dst.
+func (e *Encoder) AppendFields(dst []byte, fields []HeaderField) []byte {
+	if e.sizeUpdate {
+		if e.minSize < e.table.maxSize {
+			dst = appendInt(dst, 5, 0x20, uint64(e.minSize))
+		}
+		dst = appendInt(dst, 5, 0x20, uint64(e.table.maxSize))
+		e.sizeUpdate = false
+	}
+	for _, f := range fields {
+		index, exact := e.search(f)
+		switch {
+		case exact && !f.Sensitive:
+			dst = appendInt(dst, 7, 0x80, index)
+			continue
+		case f.Sensitive:
+			dst = appendInt(dst, 4, 0x10, index)
+		case f.size() > e.table.maxSize:
+			// Indexing would only empty the table.
+			dst = appendInt(dst, 4, 0x00, index)
+		default:
+			dst = appendInt(dst, 6, 0x40, index)
+			e.table.add(f)
+		}
+		if index == 0 {
+			dst = e.appendString(dst, f.Name)
+		}
+		dst = e.appendString(dst, f.Value)
+	}
+	return dst
+}
+
+// search returns the index of f, or of an entry with its name when exact
+// is false. Name matches prefer the static table. Zero means no match.
+func (e *Encoder) search(f HeaderField) (index uint64, exact bool) {
+	for i, sf := range staticTable {
+		if sf.Name != f.Name {
+			continue
+		}
+		if sf.Value == f.Value {
+			return uint64(i + 1), true
+		}
+		if index == 0 {
+			index = uint64(i + 1)
+		}
+	}
+	for i := len(e.table.entries) - 1; i >= 0; i-- {
+		df := e.table.entries[i]
+		if df.Name != f.Name {
+			continue
+		}
+		dynamicIndex := uint64(len(staticTable) + len(e.table.entries) - i)
+		if df.Value == f.Value {
+			return dynamicIndex, true
+		}
+		if index == 0 {
+			index = dynamicIndex
+		}
+	}
+	return index, false
+}
+
+// appendString uses Huffman coding unless it would be longer.
+func (e *Encoder) appendString(dst []byte, s string) []byte {
+	if !e.DisableHuffman {
+		if n := huffmanEncodedLen(s); n <= len(s) {
+			dst = appendInt(dst, 7, 0x80, uint64(n))
+			return appendHuffman(dst, s)
+		}
+	}
+	dst = appendInt(dst, 7, 0x00, uint64(len(s)))
+	return append(dst, s...)
+}
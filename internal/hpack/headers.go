@@ -0,0 +1,54 @@
+package hpack
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/PeterKWIlliams/http/internal/headers"
+)
+
+// sensitiveHeaders are sent as never-indexed literals so credentials do
+// not end up in any compression context.
+var sensitiveHeaders = map[string]struct{}{
+	"authorization":       {},
+	"proxy-authorization": {},
+}
+
+// FromHeaders converts h to header fields with lowercase names, sorted by
+// name so the encoding is deterministic. A field holding several values,
+// such as Set-Cookie, becomes one header field per value.
+func FromHeaders(h headers.Headers) []HeaderField {
+	fields := make([]HeaderField, 0, len(h))
+	for name := range h {
+		_, sensitive := sensitiveHeaders[strings.ToLower(name)]
+		for _, value := range h.Values(name) {
+			fields = append(fields, HeaderField{Name: strings.ToLower(name), Value: value, Sensitive: sensitive})
+		}
+	}
+	sort.SliceStable(fields, func(i, j int) bool {
+		return fields[i].Name < fields[j].Name
+	})
+	return fields
+}
+
+// ToHeaders folds fields into a Headers map. Repeated fields are joined
+// with ", ", or "; " for cookies. Pseudo-header fields are skipped.
+func ToHeaders(fields []HeaderField) headers.Headers {
+	values := map[string][]string{}
+	for _, f := range fields {
+		if strings.HasPrefix(f.Name, ":") {
+			continue
+		}
+		name := strings.ToLower(f.Name)
+		values[name] = append(values[name], f.Value)
+	}
+	h := headers.NewHeaders()
+	for name, v := range values {
+		sep := ", "
+		if name == "cookie" {
+			sep = "; "
+		}
+		h[name] = strings.Join(v, sep)
+	}
+	return h
+}
@@ -0,0 +1,193 @@
+// Package hpack implements the HTTP/2 header compression format from
+// RFC 7541.
+package hpack
+
+import (
+	"errors"
+	"fmt"
+)
+
+type HeaderField struct {
+	Name  string
+	Value string
+	// Sensitive fields are never added to a dynamic table, here or by
+	// intermediaries.
+	Sensitive bool
+}
+
+func (f HeaderField) size() uint32 {
+	return uint32(len(f.Name) + len(f.Value) + 32)
+}
+
+// DefaultTableSize is the initial SETTINGS_HEADER_TABLE_SIZE.
+const DefaultTableSize = 4096
+
+var staticTable = [...]HeaderField{
+	{Name: ":authority"},
+	{Name: ":method", Value: "GET"},
+	{Name: ":method", Value: "POST"},
+	{Name: ":path", Value: "/"},
+	{Name: ":path", Value: "/index.html"},
+	{Name: ":scheme", Value: "http"},
+	{Name: ":scheme", Value: "https"},
+	{Name: ":status", Value: "200"},
+	{Name: ":status", Value: "204"},
+	{Name: ":status", Value: "206"},
+	{Name: ":status", Value: "304"},
+	{Name: ":status", Value: "400"},
+	{Name: ":status", Value: "404"},
+	{Name: ":status", Value: "500"},
+	{Name: "accept-charset"},
+	{Name: "accept-encoding", Value: "gzip, deflate"},
+	{Name: "accept-language"},
+	{Name: "accept-ranges"},
+	{Name: "accept"},
+	{Name: "access-control-allow-origin"},
+	{Name: "age"},
+	{Name: "allow"},
+	{Name: "authorization"},
+	{Name: "cache-control"},
+	{Name: "content-disposition"},
+	{Name: "content-encoding"},
+	{Name: "content-language"},
+	{Name: "content-length"},
+	{Name: "content-location"},
+	{Name: "content-range"},
+	{Name: "content-type"},
+	{Name: "cookie"},
+	{Name: "date"},
+	{Name: "etag"},
+	{Name: "expect"},
+	{Name: "expires"},
+	{Name: "from"},
+	{Name: "host"},
+	{Name: "if-match"},
+	{Name: "if-modified-since"},
+	{Name: "if-none-match"},
+	{Name: "if-range"},
+	{Name: "if-unmodified-since"},
+	{Name: "last-modified"},
+	{Name: "link"},
+	{Name: "location"},
+	{Name: "max-forwards"},
+	{Name: "proxy-authenticate"},
+	{Name: "proxy-authorization"},
+	{Name: "range"},
+	{Name: "referer"},
+	{Name: "refresh"},
+	{Name: "retry-after"},
+	{Name: "server"},
+	{Name: "set-cookie"},
+	{Name: "strict-transport-security"},
+	{Name: "transfer-encoding"},
+	{Name: "user-agent"},
+	{Name: "vary"},
+	{Name: "via"},
+	{Name: "www-authenticate"},
+}
+
+// dynamicTable holds the most recently added entry last.
+type dynamicTable struct {
+	entries []HeaderField
+	size    uint32
+	maxSize uint32
+}
+
+func (t *dynamicTable) add(f HeaderField) {
+	t.entries = append(t.entries, f)
+	t.size += f.size()
+	t.evict()
+}
+
+func (t *dynamicTable) setMaxSize(maxSize uint32) {
+	t.maxSize = maxSize
+	t.evict()
+}
+
+func (t *dynamicTable) evict() {
+	n := 0
+	for t.size > t.maxSize && n < len(t.entries) {
+		t.size -= t.entries[n].size()
+		n++
+	}
+	if n > 0 {
+		t.entries = append(t.entries[:0], t.entries[n:]...)
+	}
+}
+
+// field returns the entry at a combined static and dynamic table index,
+// starting at 1.
+func (t *dynamicTable) field(index uint64) (HeaderField, bool) {
+	if index == 0 {
+		return HeaderField{}, false
+	}
+	if index <= uint64(len(staticTable)) {
+		return staticTable[index-1], true
+	}
+	i := index - uint64(len(staticTable))
+	if i > uint64(len(t.entries)) {
+		return HeaderField{}, false
+	}
+	return t.entries[uint64(len(t.entries))-i], true
+}
+
+var (
+	errNeedMore        = errors.New("hpack: truncated header block")
+	errIntegerOverflow = errors.New("hpack: integer overflow")
+)
+
+type DecodingError struct {
+	Err error
+}
+
+func (e DecodingError) Error() string {
+	return fmt.Sprintf("hpack: decoding error: %v", e.Err)
+}
+
+func (e DecodingError) Unwrap() error {
+	return e.Err
+}
+
+// appendInt appends v using an n-bit prefix as described in RFC 7541
+// section 5.1. first holds the bits above the prefix.
+func appendInt(dst []byte, n uint8, first byte, v uint64) []byte {
+	limit := uint64(1)<<n - 1
+	if v < limit {
+		return append(dst, first|byte(v))
+	}
+	dst = append(dst, first|byte(limit))
+	v -= limit
+	for v >= 128 {
+		dst = append(dst, byte(v%128)|0x80)
+		v /= 128
+	}
+	return append(dst, byte(v))
+}
+
+// readInt reads an integer with an n-bit prefix and returns the rest of
+// the buffer.
+func readInt(buf []byte, n uint8) (uint64, []byte, error) {
+	if len(buf) == 0 {
+		return 0, nil, errNeedMore
+	}
+	limit := uint64(1)<<n - 1
+	v := uint64(buf[0]) & limit
+	buf = buf[1:]
+	if v < limit {
+		return v, buf, nil
+	}
+	var shift uint
+	for len(buf) > 0 {
+		b := buf[0]
+		buf = buf[1:]
+		if shift > 56 {
+			return 0, nil, errIntegerOverflow
+		}
+		v += uint64(b&0x7F) << shift
+		if b&0x80 == 0 {
+			return v, buf, nil
+		}
+		shift += 7
+	}
+	return 0, nil, errNeedMore
+}
@@ -0,0 +1,265 @@
+package hpack
+
+import (
+	"bytes"
+	"encoding/hex"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/PeterKWIlliams/http/internal/headers"
+)
+
+func unhex(t *testing.T, s string) []byte {
+	t.Helper()
+	b, err := hex.DecodeString(strings.ReplaceAll(s, " ", ""))
+	require.NoError(t, err)
+	return b
+}
+
+func fields(pairs ...string) []HeaderField {
+	var f []HeaderField
+	for i := 0; i < len(pairs); i += 2 {
+		f = append(f, HeaderField{Name: pairs[i], Value: pairs[i+1]})
+	}
+	return f
+}
+
+// RFC 7541 C.1
+func TestIntegers(t *testing.T) {
+	tests := []struct {
+		value   uint64
+		prefix  uint8
+		encoded string
+	}{
+		{10, 5, "0a"},
+		{1337, 5, "1f9a0a"},
+		{42, 8, "2a"},
+	}
+	for _, tc := range tests {
+		encoded := appendInt(nil, tc.prefix, 0, tc.value)
+		assert.Equal(t, tc.encoded, hex.EncodeToString(encoded))
+		value, rest, err := readInt(encoded, tc.prefix)
+		require.NoError(t, err)
+		assert.Equal(t, tc.value, value)
+		assert.Empty(t, rest)
+	}
+
+	_, _, err := readInt(unhex(t, "1f9a"), 5)
+	assert.ErrorIs(t, err, errNeedMore)
+	_, _, err = readInt(unhex(t, "1fffffffffffffffffffff01"), 5)
+	assert.ErrorIs(t, err, errIntegerOverflow)
+}
+
+// RFC 7541 C.2
+func TestHeaderFieldRepresentations(t *testing.T) {
+	tests := []struct {
+		name      string
+		field     HeaderField
+		encoded   string
+		tableSize uint32
+		encode    bool
+	}{
+		{"literal with indexing", HeaderField{Name: "custom-key", Value: "custom-header"},
+			"400a 6375 7374 6f6d 2d6b 6579 0d63 7573 746f 6d2d 6865 6164 6572", 55, true},
+		{"literal without indexing", HeaderField{Name: ":path", Value: "/sample/path"},
+			"040c 2f73 616d 706c 652f 7061 7468", 0, false},
+		{"literal never indexed", HeaderField{Name: "password", Value: "secret", Sensitive: true},
+			"1008 7061 7373 776f 7264 0673 6563 7265 74", 0, true},
+		{"indexed", HeaderField{Name: ":method", Value: "GET"}, "82", 0, true},
+	}
+	for _, tc := range tests {
+		d := NewDecoder(DefaultTableSize)
+		got, err := d.Decode(unhex(t, tc.encoded))
+		require.NoError(t, err, tc.name)
+		assert.Equal(t, []HeaderField{tc.field}, got, tc.name)
+		assert.Equal(t, tc.tableSize, d.table.size, tc.name)
+
+		if tc.encode {
+			e := NewEncoder(DefaultTableSize)
+			e.DisableHuffman = true
+			assert.Equal(t, unhex(t, tc.encoded), e.AppendFields(nil, []HeaderField{tc.field}), tc.name)
+		}
+	}
+}
+
+type exampleBlock struct {
+	fields    []HeaderField
+	encoded   string
+	tableSize uint32
+}
+
+var requestExamples = [][]HeaderField{
+	fields(":method", "GET", ":scheme", "http", ":path", "/", ":authority", "www.example.com"),
+	fields(":method", "GET", ":scheme", "http", ":path", "/", ":authority", "www.example.com", "cache-control", "no-cache"),
+	fields(":method", "GET", ":scheme", "https", ":path", "/index.html", ":authority", "www.example.com", "custom-key", "custom-value"),
+}
+
+var responseExamples = [][]HeaderField{
+	fields(":status", "302", "cache-control", "private", "date", "Mon, 21 Oct 2013 20:13:21 GMT", "location", "https://www.example.com"),
+	fields(":status", "307", "cache-control", "private", "date", "Mon, 21 Oct 2013 20:13:21 GMT", "location", "https://www.example.com"),
+	fields(":status", "200", "cache-control", "private", "date", "Mon, 21 Oct 2013 20:13:22 GMT", "location", "https://www.example.com",
+		"content-encoding", "gzip", "set-cookie", "foo=ASDJKHQKBZXOQWEOPIUAXQWEOIU; max-age=3600; version=1"),
+}
+
+func TestExamples(t *testing.T) {
+	tests := []struct {
+		name      string
+		tableSize uint32
+		huffman   bool
+		blocks    []exampleBlock
+	}{
+		{"C.3 requests without Huffman", DefaultTableSize, false, []exampleBlock{
+			{requestExamples[0], "8286 8441 0f77 7777 2e65 7861 6d70 6c65 2e63 6f6d", 57},
+			{requestExamples[1], "8286 84be 5808 6e6f 2d63 6163 6865", 110},
+			{requestExamples[2], "8287 85bf 400a 6375 7374 6f6d 2d6b 6579 0c63 7573 746f 6d2d 7661 6c75 65", 164},
+		}},
+		{"C.4 requests with Huffman", DefaultTableSize, true, []exampleBlock{
+			{requestExamples[0], "8286 8441 8cf1 e3c2 e5f2 3a6b a0ab 90f4 ff", 57},
+			{requestExamples[1], "8286 84be 5886 a8eb 1064 9cbf", 110},
+			{requestExamples[2], "8287 85bf 4088 25a8 49e9 5ba9 7d7f 8925 a849 e95b b8e8 b4bf", 164},
+		}},
+		{"C.5 responses without Huffman", 256, false, []exampleBlock{
+			{responseExamples[0], "4803 3330 3258 0770 7269 7661 7465 611d 4d6f 6e2c 2032 3120 4f63 7420 3230 3133 2032 303a 3133 3a32 3120 474d 546e 1768 7474 7073 3a2f 2f77 7777 2e65 7861 6d70 6c65 2e63 6f6d", 222},
+			{responseExamples[1], "4803 3330 37c1 c0bf", 222},
+			{responseExamples[2], "88c1 611d 4d6f 6e2c 2032 3120 4f63 7420 3230 3133 2032 303a 3133 3a32 3220 474d 54c0 5a04 677a 6970 7738 666f 6f3d 4153 444a 4b48 514b 425a 584f 5157 454f 5049 5541 5851 5745 4f49 553b 206d 6178 2d61 6765 3d33 3630 303b 2076 6572 7369 6f6e 3d31", 215},
+		}},
+		{"C.6 responses with Huffman", 256, true, []exampleBlock{
+			{responseExamples[0], "4882 6402 5885 aec3 771a 4b61 96d0 7abe 9410 54d4 44a8 2005 9504 0b81 66e0 82a6 2d1b ff6e 919d 29ad 1718 63c7 8f0b 97c8 e9ae 82ae 43d3", 222},
+			{responseExamples[1], "4883 640e ffc1 c0bf", 222},
+			{responseExamples[2], "88c1 6196 d07a be94 1054 d444 a820 0595 040b 8166 e084 a62d 1bff c05a 839b d9ab 77ad 94e7 821d d7f2 e6c7 b335 dfdf cd5b 3960 d5af 2708 7f36 72c1 ab27 0fb5 291f 9587 3160 65c0 03ed 4ee5 b106 3d50 07", 215},
+		}},
+	}
+	for _, tc := range tests {
+		e := NewEncoder(tc.tableSize)
+		e.DisableHuffman = !tc.huffman
+		d := NewDecoder(tc.tableSize)
+		for i, block := range tc.blocks {
+			encoded := e.AppendFields(nil, block.fields)
+			assert.Equal(t, hex.EncodeToString(unhex(t, block.encoded)), hex.EncodeToString(encoded), "%s block %d", tc.name, i+1)
+			assert.Equal(t, block.tableSize, e.table.size, "%s block %d", tc.name, i+1)
+
+			decoded, err := d.Decode(unhex(t, block.encoded))
+			require.NoError(t, err, "%s block %d", tc.name, i+1)
+			assert.Equal(t, block.fields, decoded, "%s block %d", tc.name, i+1)
+			assert.Equal(t, block.tableSize, d.table.size, "%s block %d", tc.name, i+1)
+		}
+	}
+}
+
+func TestDynamicTableSizeUpdate(t *testing.T) {
+	e := NewEncoder(DefaultTableSize)
+	d := NewDecoder(DefaultTableSize)
+	block := e.AppendFields(nil, fields("custom-key", "custom-header"))
+	_, err := d.Decode(block)
+	require.NoError(t, err)
+	require.Len(t, d.table.entries, 1)
+
+	// Test: Shrinking to zero and back signals both sizes and evicts
+	e.SetMaxDynamicTableSize(0)
+	e.SetMaxDynamicTableSize(100)
+	block = e.AppendFields(nil, fields("custom-key", "custom-header"))
+	assert.Equal(t, "203f45", hex.EncodeToString(block[:3]))
+	got, err := d.Decode(block)
+	require.NoError(t, err)
+	assert.Equal(t, fields("custom-key", "custom-header"), got)
+	assert.Equal(t, uint32(100), d.table.maxSize)
+	assert.Len(t, d.table.entries, 1)
+
+	// Test: Updates beyond the advertised limit are rejected
+	_, err = NewDecoder(100).Decode(unhex(t, "3f46"))
+	assert.Error(t, err)
+
+	// Test: Updates after a field are rejected
+	_, err = NewDecoder(DefaultTableSize).Decode(unhex(t, "82 20"))
+	assert.Error(t, err)
+}
+
+func TestDecoder_Errors(t *testing.T) {
+	tests := []struct {
+		name  string
+		block string
+	}{
+		{"index zero", "80"},
+		{"index past table", "be"},
+		{"truncated string", "400a 6375"},
+		{"huffman padding not EOS", "4188 f1e3 c2e5 f23a 6ba0 ab90 f4fe"},
+		{"huffman padding too long", "8286 8441 82f1 ff ff"},
+	}
+	for _, tc := range tests {
+		_, err := NewDecoder(DefaultTableSize).Decode(unhex(t, tc.block))
+		var de DecodingError
+		assert.ErrorAs(t, err, &de, tc.name)
+	}
+
+	d := NewDecoder(DefaultTableSize)
+	d.MaxStringLength = 4
+	_, err := d.Decode(unhex(t, "400a 6375 7374 6f6d 2d6b 6579 0d63 7573 746f 6d2d 6865 6164 6572"))
+	assert.Error(t, err)
+}
+
+func TestHuffmanRoundTrip(t *testing.T) {
+	var all strings.Builder
+	for i := 0; i < 256; i++ {
+		all.WriteByte(byte(i))
+	}
+	for _, s := range []string{"", "a", "www.example.com", "no-cache", all.String()} {
+		encoded := appendHuffman(nil, s)
+		assert.Len(t, encoded, huffmanEncodedLen(s))
+		decoded, err := huffmanDecode(nil, encoded)
+		require.NoError(t, err)
+		assert.Equal(t, s, string(decoded))
+	}
+}
+
+func TestHeadersConversion(t *testing.T) {
+	h := headers.Headers{"content-type": "text/plain", "authorization": "Bearer x", "date": "today"}
+	assert.Equal(t, []HeaderField{
+		{Name: "authorization", Value: "Bearer x", Sensitive: true},
+		{Name: "content-type", Value: "text/plain"},
+		{Name: "date", Value: "today"},
+	}, FromHeaders(h))
+
+	// Test: Each Set-Cookie value becomes its own field
+	cookies := headers.NewHeaders()
+	cookies.Add("set-cookie", "a=1")
+	cookies.Add("set-cookie", "b=2")
+	assert.Equal(t, []HeaderField{
+		{Name: "set-cookie", Value: "a=1"},
+		{Name: "set-cookie", Value: "b=2"},
+	}, FromHeaders(cookies))
+
+	converted := ToHeaders(fields(":method", "GET", "accept", "text/html", "Accept", "*/*", "cookie", "a=1", "cookie", "b=2"))
+	assert.Equal(t, headers.Headers{"accept": "text/html, */*", "cookie": "a=1; b=2"}, converted)
+
+	// Test: Sensitive fields survive a round trip without being indexed
+	e := NewEncoder(DefaultTableSize)
+	d := NewDecoder(DefaultTableSize)
+	got, err := d.Decode(e.AppendFields(nil, FromHeaders(h)))
+	require.NoError(t, err)
+	assert.Equal(t, h, ToHeaders(got))
+	assert.Len(t, d.table.entries, 2)
+}
+
+// amplifyingBlock adds one large entry to the dynamic table and then
+// references it n times with single-byte indexed fields.
+func amplifyingBlock(n int) []byte {
+	block := NewEncoder(DefaultTableSize).AppendFields(nil, []HeaderField{{Name: "x-big", Value: strings.Repeat("a", 4000)}})
+	return append(block, bytes.Repeat([]byte{0x80 | byte(len(staticTable)+1)}, n)...)
+}
+
+func TestDecoder_MaxHeaderListSize(t *testing.T) {
+	d := NewDecoder(DefaultTableSize)
+	d.MaxHeaderListSize = 1 << 20
+	got, err := d.Decode(amplifyingBlock(10))
+	require.NoError(t, err)
+	assert.Len(t, got, 11)
+
+	// Test: A small block that decodes past the limit is rejected
+	_, err = d.Decode(amplifyingBlock(300))
+	assert.ErrorIs(t, err, ErrHeaderListTooLarge)
+	var de DecodingError
+	assert.ErrorAs(t, err, &de)
+}
@@ -0,0 +1,88 @@
+package hpack
+
+import "errors"
+
+var ErrInvalidHuffman = errors.New("hpack: invalid Huffman-encoded data")
+
+type huffmanNode struct {
+	children [2]*huffmanNode
+	sym      byte
+	leaf     bool
+}
+
+var huffmanRoot = buildHuffmanTree()
+
+func buildHuffmanTree() *huffmanNode {
+	root := &huffmanNode{}
+	for sym, code := range huffmanCodes {
+		n := root
+		for i := int(huffmanCodeLens[sym]) - 1; i >= 0; i-- {
+			bit := (code >> uint(i)) & 1
+			if n.children[bit] == nil {
+				n.children[bit] = &huffmanNode{}
+			}
+			n = n.children[bit]
+		}
+		n.sym = byte(sym)
+		n.leaf = true
+	}
+	return root
+}
+
+// huffmanDecode appends the decoding of src to dst. Padding must be the
+// most significant bits of EOS and shorter than a byte.
+func huffmanDecode(dst []byte, src []byte) ([]byte, error) {
+	n := huffmanRoot
+	pending := 0
+	allOnes := true
+	for _, b := range src {
+		for i := 7; i >= 0; i-- {
+			bit := (b >> uint(i)) & 1
+			n = n.children[bit]
+			if n == nil {
+				return nil, ErrInvalidHuffman
+			}
+			pending++
+			allOnes = allOnes && bit == 1
+			if n.leaf {
+				dst = append(dst, n.sym)
+				n = huffmanRoot
+				pending = 0
+				allOnes = true
+			}
+		}
+	}
+	if pending > 7 || !allOnes {
+		return nil, ErrInvalidHuffman
+	}
+	return dst, nil
+}
+
+func huffmanEncodedLen(s string) int {
+	bits := 0
+	for i := 0; i < len(s); i++ {
+		bits += int(huffmanCodeLens[s[i]])
+	}
+	return (bits + 7) / 8
+}
+
+// appendHuffman appends the Huffman coding of s, padded with the most
+// significant bits of EOS.
+func appendHuffman(dst []byte, s string) []byte {
+	var acc uint64
+	var n uint
+	for i := 0; i < len(s); i++ {
+		length := uint(huffmanCodeLens[s[i]])
+		acc = acc<<length | uint64(huffmanCodes[s[i]])
+		n += length
+		for n >= 8 {
+			n -= 8
+			dst = append(dst, byte(acc>>n))
+		}
+	}
+	if n > 0 {
+		pad := 8 - n
+		dst = append(dst, byte(acc<<pad|(1<<pad-1)))
+	}
+	return dst
+}
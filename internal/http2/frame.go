@@ -0,0 +1,173 @@
+package http2
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+type frameType uint8
+
+const (
+	frameData         frameType = 0x0
+	frameHeaders      frameType = 0x1
+	framePriority     frameType = 0x2
+	frameRSTStream    frameType = 0x3
+	frameSettings     frameType = 0x4
+	framePushPromise  frameType = 0x5
+	framePing         frameType = 0x6
+	frameGoAway       frameType = 0x7
+	frameWindowUpdate frameType = 0x8
+	frameContinuation frameType = 0x9
+)
+
+const (
+	flagEndStream  = 0x1
+	flagAck        = 0x1
+	flagEndHeaders = 0x4
+	flagPadded     = 0x8
+	flagPriority   = 0x20
+)
+
+type ErrCode uint32
+
+const (
+	ErrCodeNo                 ErrCode = 0x0
+	ErrCodeProtocol           ErrCode = 0x1
+	ErrCodeInternal           ErrCode = 0x2
+	ErrCodeFlowControl        ErrCode = 0x3
+	ErrCodeSettingsTimeout    ErrCode = 0x4
+	ErrCodeStreamClosed       ErrCode = 0x5
+	ErrCodeFrameSize          ErrCode = 0x6
+	ErrCodeRefusedStream      ErrCode = 0x7
+	ErrCodeCancel             ErrCode = 0x8
+	ErrCodeCompression        ErrCode = 0x9
+	ErrCodeConnect            ErrCode = 0xa
+	ErrCodeEnhanceYourCalm    ErrCode = 0xb
+	ErrCodeInadequateSecurity ErrCode = 0xc
+	ErrCodeHTTP11Required     ErrCode = 0xd
+)
+
+type settingID uint16
+
+const (
+	settingHeaderTableSize      settingID = 0x1
+	settingEnablePush           settingID = 0x2
+	settingMaxConcurrentStreams settingID = 0x3
+	settingInitialWindowSize    settingID = 0x4
+	settingMaxFrameSize         settingID = 0x5
+	settingMaxHeaderListSize    settingID = 0x6
+)
+
+type setting struct {
+	id    settingID
+	value uint32
+}
+
+const (
+	frameHeaderLen     = 9
+	defaultMaxFrameLen = 16384
+	maxFrameLenLimit   = 1<<24 - 1
+	defaultWindowSize  = 65535
+	maxWindowSize      = 1<<31 - 1
+)
+
+// connError ends the whole connection with a GOAWAY.
+type connError struct {
+	code   ErrCode
+	reason string
+}
+
+func (e connError) Error() string {
+	return fmt.Sprintf("http2: connection error %d: %s", e.code, e.reason)
+}
+
+// streamError resets a single stream.
+type streamError struct {
+	streamID uint32
+	code     ErrCode
+	reason   string
+}
+
+func (e streamError) Error() string {
+	return fmt.Sprintf("http2: stream %d error %d: %s", e.streamID, e.code, e.reason)
+}
+
+type frame struct {
+	typ      frameType
+	flags    uint8
+	streamID uint32
+	payload  []byte
+}
+
+func (f *frame) has(flag uint8) bool {
+	return f.flags&flag != 0
+}
+
+func readFrame(r io.Reader, maxLen uint32) (*frame, error) {
+	var header [frameHeaderLen]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, err
+	}
+	length := uint32(header[0])<<16 | uint32(header[1])<<8 | uint32(header[2])
+	f := &frame{
+		typ:      frameType(header[3]),
+		flags:    header[4],
+		streamID: binary.BigEndian.Uint32(header[5:]) & 0x7FFFFFFF,
+	}
+	if length > maxLen {
+		return nil, connError{ErrCodeFrameSize, fmt.Sprintf("frame of %d bytes exceeds limit", length)}
+	}
+	f.payload = make([]byte, length)
+	if _, err := io.ReadFull(r, f.payload); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func appendFrame(dst []byte, typ frameType, flags uint8, streamID uint32, payload []byte) []byte {
+	length := len(payload)
+	dst = append(dst, byte(length>>16), byte(length>>8), byte(length), byte(typ), flags)
+	dst = binary.BigEndian.AppendUint32(dst, streamID&0x7FFFFFFF)
+	return append(dst, payload...)
+}
+
+// removePadding strips the pad length octet and trailing padding from a
+// DATA or HEADERS payload.
+func removePadding(f *frame) ([]byte, error) {
+	payload := f.payload
+	if !f.has(flagPadded) {
+		return payload, nil
+	}
+	if len(payload) == 0 {
+		return nil, connError{ErrCodeProtocol, "missing pad length"}
+	}
+	padLen := int(payload[0])
+	payload = payload[1:]
+	if padLen > len(payload) {
+		return nil, connError{ErrCodeProtocol, "padding exceeds payload"}
+	}
+	return payload[:len(payload)-padLen], nil
+}
+
+func parseSettings(payload []byte) ([]setting, error) {
+	if len(payload)%6 != 0 {
+		return nil, connError{ErrCodeFrameSize, "SETTINGS length not a multiple of 6"}
+	}
+	settings := make([]setting, 0, len(payload)/6)
+	for i := 0; i < len(payload); i += 6 {
+		settings = append(settings, setting{
+			id:    settingID(binary.BigEndian.Uint16(payload[i:])),
+			value: binary.BigEndian.Uint32(payload[i+2:]),
+		})
+	}
+	return settings, nil
+}
+
+func appendSettings(dst []byte, settings ...setting) []byte {
+	for _, s := range settings {
+		dst = binary.BigEndian.AppendUint16(dst, uint16(s.id))
+		dst = binary.BigEndian.AppendUint32(dst, s.value)
+	}
+	return dst
+}
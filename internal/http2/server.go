@@ -0,0 +1,839 @@
+// Package http2 serves HTTP/2 on connections negotiated through TLS ALPN
+// or in cleartext (h2c), either with prior knowledge or after an HTTP/1.1
+// Upgrade, dispatching each stream to an ordinary handler.
+package http2
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/PeterKWIlliams/http/internal/hpack"
+	"github.com/PeterKWIlliams/http/internal/request"
+	"github.com/PeterKWIlliams/http/internal/response"
+)
+
+// Preface is the client connection preface from RFC 9113 section 3.4.
+const Preface = "PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n"
+
+const (
+	DefaultMaxConcurrentStreams = 100
+	DefaultMaxRequestBodySize   = 10 << 20
+
+	// Receive windows advertised to the client. Data is acknowledged as
+	// soon as it arrives; request bodies are bounded by
+	// MaxRequestBodySize instead.
+	initialStreamWindow = 1 << 20
+	initialConnWindow   = 1 << 20
+	maxHeaderBlockSize  = 1 << 20
+
+	// goAwayTimeout bounds how long a drained connection waits for the
+	// client to close its side.
+	goAwayTimeout = time.Second
+)
+
+type Handler func(w *response.Writer, req *request.Request)
+
+type Options struct {
+	Handler Handler
+	// ConfigureWriter is called with each stream's response writer before
+	// the handler runs, for example to install header hooks.
+	ConfigureWriter      func(w *response.Writer)
+	MaxConcurrentStreams uint32
+	MaxRequestBodySize   int64
+	// Shutdown, when closed, makes the connection send GOAWAY, refuse new
+	// streams and close once the streams already accepted have finished.
+	Shutdown <-chan struct{}
+	// BaseContext is the parent of every request's context. Each is
+	// cancelled when its stream is reset or the connection closes.
+	BaseContext context.Context
+	// ConnID is copied to every request's ConnID.
+	ConnID uint64
+	// OnActivity is called with true when the connection gains its first
+	// open stream and with false when its last one closes. It must not
+	// block.
+	OnActivity func(active bool)
+	// OnParseError is called with the reason when a HEADERS block does
+	// not form a valid request and the stream is reset.
+	OnParseError func(err error)
+}
+
+var (
+	errConnClosed  = errors.New("http2: connection closed")
+	errStreamReset = errors.New("http2: stream reset")
+)
+
+type serverConn struct {
+	conn    net.Conn
+	br      *bufio.Reader
+	opts    Options
+	decoder *hpack.Decoder
+	// maxStreamID is the highest stream opened by the client. Only the
+	// read loop changes it, holding mu.
+	maxStreamID uint32
+	done        chan struct{}
+	ctx         context.Context
+	cancel      context.CancelFunc
+	tlsState    *tls.ConnectionState
+	// requests counts dispatched streams; only the read loop touches it.
+	requests int
+
+	// writeMu serialises frames on the connection. It is always taken
+	// before mu, never while holding it.
+	writeMu sync.Mutex
+	encoder *hpack.Encoder
+
+	mu                sync.Mutex
+	cond              *sync.Cond
+	streams           map[uint32]*stream
+	sendWindow        int64
+	initialSendWindow int64
+	peerMaxFrameLen   uint32
+	closed            bool
+	goingAway         bool
+
+	handlers sync.WaitGroup
+
+	// activityMu serialises OnActivity calls, which are made without
+	// sc.mu held, and guards reportedActive.
+	activityMu     sync.Mutex
+	reportedActive bool
+}
+
+type stream struct {
+	sc *serverConn
+	id uint32
+
+	// Guarded by sc.mu.
+	sendWindow   int64
+	remoteClosed bool
+	done         bool
+
+	cancel context.CancelFunc
+
+	// Used by the read loop until the request is dispatched.
+	req           *request.Request
+	contentLength int64
+}
+
+func newServerConn(conn net.Conn, buffered []byte, opts Options) *serverConn {
+	if opts.MaxConcurrentStreams == 0 {
+		opts.MaxConcurrentStreams = DefaultMaxConcurrentStreams
+	}
+	if opts.MaxRequestBodySize <= 0 {
+		opts.MaxRequestBodySize = DefaultMaxRequestBodySize
+	}
+	sc := &serverConn{
+		conn:              conn,
+		br:                bufio.NewReader(io.MultiReader(bytes.NewReader(buffered), conn)),
+		opts:              opts,
+		decoder:           hpack.NewDecoder(hpack.DefaultTableSize),
+		encoder:           hpack.NewEncoder(hpack.DefaultTableSize),
+		streams:           map[uint32]*stream{},
+		sendWindow:        defaultWindowSize,
+		initialSendWindow: defaultWindowSize,
+		peerMaxFrameLen:   defaultMaxFrameLen,
+		done:              make(chan struct{}),
+	}
+	sc.cond = sync.NewCond(&sc.mu)
+	sc.decoder.MaxHeaderListSize = maxHeaderBlockSize
+	parent := opts.BaseContext
+	if parent == nil {
+		parent = context.Background()
+	}
+	sc.ctx, sc.cancel = context.WithCancel(parent)
+	if tc, ok := conn.(*tls.Conn); ok {
+		state := tc.ConnectionState()
+		sc.tlsState = &state
+	}
+	return sc
+}
+
+// ServeConn speaks HTTP/2 on conn until the client goes away. buffered
+// holds any bytes already read from conn; the client preface is expected
+// at its start or otherwise on conn.
+func ServeConn(conn net.Conn, buffered []byte, opts Options) {
+	newServerConn(conn, buffered, opts).serve(nil)
+}
+
+// IsUpgrade reports whether req asks to switch to h2c with a well-formed
+// HTTP2-Settings header.
+func IsUpgrade(req *request.Request) bool {
+	upgrade, _ := req.Headers.Get("upgrade")
+	connection, _ := req.Headers.Get("connection")
+	if !containsToken(upgrade, "h2c") || !containsToken(connection, "upgrade") || !containsToken(connection, "http2-settings") {
+		return false
+	}
+	_, err := upgradeSettings(req)
+	return err == nil
+}
+
+// ServeUpgrade answers an h2c upgrade request with 101 Switching Protocols
+// and then serves the connection, with req itself becoming stream 1.
+func ServeUpgrade(conn net.Conn, buffered []byte, req *request.Request, opts Options) {
+	settings, err := upgradeSettings(req)
+	if err != nil {
+		return
+	}
+	sc := newServerConn(conn, buffered, opts)
+	if err := sc.applySettings(settings); err != nil {
+		return
+	}
+	if _, err := io.WriteString(conn, "HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: h2c\r\n\r\n"); err != nil {
+		return
+	}
+	for _, name := range []string{"connection", "upgrade", "http2-settings"} {
+		req.Headers.Delete(name)
+	}
+	req.RequestLine.HttpVersion = "2.0"
+	sc.serve(req)
+}
+
+func upgradeSettings(req *request.Request) ([]setting, error) {
+	value, err := req.Headers.Get("http2-settings")
+	if err != nil {
+		return nil, err
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(strings.TrimSpace(value), "="))
+	if err != nil {
+		return nil, err
+	}
+	return parseSettings(payload)
+}
+
+func (sc *serverConn) serve(upgradeReq *request.Request) {
+	defer sc.shutdown()
+
+	var out []byte
+	out = appendFrame(out, frameSettings, 0, 0, appendSettings(nil,
+		setting{settingMaxConcurrentStreams, sc.opts.MaxConcurrentStreams},
+		setting{settingInitialWindowSize, initialStreamWindow},
+		setting{settingMaxHeaderListSize, maxHeaderBlockSize},
+	))
+	out = appendFrame(out, frameWindowUpdate, 0, 0, binary.BigEndian.AppendUint32(nil, initialConnWindow-defaultWindowSize))
+	if err := sc.write(out); err != nil {
+		return
+	}
+
+	if upgradeReq != nil {
+		st := sc.newStream(1)
+		sc.maxStreamID = 1
+		st.remoteClosed = true
+		sc.dispatch(st, upgradeReq)
+	}
+	if sc.opts.Shutdown != nil {
+		go sc.drain()
+	}
+
+	preface := make([]byte, len(Preface))
+	if _, err := io.ReadFull(sc.br, preface); err != nil || string(preface) != Preface {
+		return
+	}
+	first := true
+	for {
+		f, err := readFrame(sc.br, defaultMaxFrameLen)
+		if err == nil && first && f.typ != frameSettings {
+			err = connError{ErrCodeProtocol, "connection must start with SETTINGS"}
+		}
+		first = false
+		if err == nil {
+			err = sc.processFrame(f)
+		}
+
+		var se streamError
+		var ce connError
+		switch {
+		case err == nil:
+		case errors.As(err, &se):
+			sc.resetStream(se.streamID, se.code)
+		case errors.As(err, &ce):
+			log.Printf("http2: closing connection from %s: %v", sc.conn.RemoteAddr(), ce)
+			sc.goAway(ce.code)
+			return
+		default:
+			return
+		}
+	}
+}
+
+func (sc *serverConn) shutdown() {
+	sc.mu.Lock()
+	sc.closed = true
+	for _, st := range sc.streams {
+		st.done = true
+	}
+	sc.cond.Broadcast()
+	sc.mu.Unlock()
+	close(sc.done)
+	sc.cancel()
+	sc.conn.Close()
+	sc.handlers.Wait()
+}
+
+type closeWriter interface {
+	CloseWrite() error
+}
+
+// drain waits for opts.Shutdown and then winds the connection down
+// gracefully: streams up to the last one accepted still complete, and
+// the write side is closed so the client reads everything before EOF.
+func (sc *serverConn) drain() {
+	select {
+	case <-sc.opts.Shutdown:
+	case <-sc.done:
+		return
+	}
+	sc.mu.Lock()
+	sc.goingAway = true
+	sc.mu.Unlock()
+	sc.goAway(ErrCodeNo)
+
+	sc.mu.Lock()
+	for len(sc.streams) > 0 && !sc.closed {
+		sc.cond.Wait()
+	}
+	sc.mu.Unlock()
+	if cw, ok := sc.conn.(closeWriter); ok {
+		sc.writeMu.Lock()
+		cw.CloseWrite()
+		sc.writeMu.Unlock()
+		sc.conn.SetReadDeadline(time.Now().Add(goAwayTimeout))
+		return
+	}
+	sc.conn.Close()
+}
+
+func (sc *serverConn) processFrame(f *frame) error {
+	switch f.typ {
+	case frameData:
+		return sc.processData(f)
+	case frameHeaders:
+		return sc.processHeaders(f)
+	case framePriority:
+		if f.streamID == 0 {
+			return connError{ErrCodeProtocol, "PRIORITY on stream 0"}
+		}
+		if len(f.payload) != 5 {
+			return streamError{f.streamID, ErrCodeFrameSize, "PRIORITY must be 5 bytes"}
+		}
+		return nil
+	case frameRSTStream:
+		return sc.processRSTStream(f)
+	case frameSettings:
+		return sc.processSettings(f)
+	case framePushPromise:
+		return connError{ErrCodeProtocol, "clients cannot push"}
+	case framePing:
+		if f.streamID != 0 {
+			return connError{ErrCodeProtocol, "PING on a stream"}
+		}
+		if len(f.payload) != 8 {
+			return connError{ErrCodeFrameSize, "PING must be 8 bytes"}
+		}
+		if f.has(flagAck) {
+			return nil
+		}
+		return sc.writeFrame(framePing, flagAck, 0, f.payload)
+	case frameGoAway:
+		if f.streamID != 0 {
+			return connError{ErrCodeProtocol, "GOAWAY on a stream"}
+		}
+		return nil
+	case frameWindowUpdate:
+		return sc.processWindowUpdate(f)
+	case frameContinuation:
+		return connError{ErrCodeProtocol, "unexpected CONTINUATION"}
+	}
+	// Unknown frame types are ignored.
+	return nil
+}
+
+func (sc *serverConn) processSettings(f *frame) error {
+	if f.streamID != 0 {
+		return connError{ErrCodeProtocol, "SETTINGS on a stream"}
+	}
+	if f.has(flagAck) {
+		if len(f.payload) != 0 {
+			return connError{ErrCodeFrameSize, "SETTINGS ack with payload"}
+		}
+		return nil
+	}
+	settings, err := parseSettings(f.payload)
+	if err != nil {
+		return err
+	}
+	if err := sc.applySettings(settings); err != nil {
+		return err
+	}
+	return sc.writeFrame(frameSettings, flagAck, 0, nil)
+}
+
+func (sc *serverConn) applySettings(settings []setting) error {
+	for _, s := range settings {
+		if s.id == settingHeaderTableSize {
+			// Our table never grows beyond the default, whatever the peer
+			// allows.
+			sc.writeMu.Lock()
+			sc.encoder.SetMaxDynamicTableSize(min(s.value, hpack.DefaultTableSize))
+			sc.writeMu.Unlock()
+		}
+	}
+
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	for _, s := range settings {
+		switch s.id {
+		case settingEnablePush:
+			if s.value > 1 {
+				return connError{ErrCodeProtocol, "invalid SETTINGS_ENABLE_PUSH"}
+			}
+		case settingInitialWindowSize:
+			if s.value > maxWindowSize {
+				return connError{ErrCodeFlowControl, "SETTINGS_INITIAL_WINDOW_SIZE too large"}
+			}
+			delta := int64(s.value) - sc.initialSendWindow
+			for _, st := range sc.streams {
+				st.sendWindow += delta
+				if st.sendWindow > maxWindowSize {
+					return connError{ErrCodeFlowControl, "stream window overflow"}
+				}
+			}
+			sc.initialSendWindow = int64(s.value)
+		case settingMaxFrameSize:
+			if s.value < defaultMaxFrameLen || s.value > maxFrameLenLimit {
+				return connError{ErrCodeProtocol, "invalid SETTINGS_MAX_FRAME_SIZE"}
+			}
+			sc.peerMaxFrameLen = s.value
+		}
+	}
+	sc.cond.Broadcast()
+	return nil
+}
+
+func (sc *serverConn) processWindowUpdate(f *frame) error {
+	if len(f.payload) != 4 {
+		return connError{ErrCodeFrameSize, "WINDOW_UPDATE must be 4 bytes"}
+	}
+	increment := int64(binary.BigEndian.Uint32(f.payload) & 0x7FFFFFFF)
+
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	if f.streamID == 0 {
+		if increment == 0 {
+			return connError{ErrCodeProtocol, "zero window increment"}
+		}
+		sc.sendWindow += increment
+		if sc.sendWindow > maxWindowSize {
+			return connError{ErrCodeFlowControl, "connection window overflow"}
+		}
+		sc.cond.Broadcast()
+		return nil
+	}
+	st := sc.streams[f.streamID]
+	if st == nil {
+		if f.streamID > sc.maxStreamID {
+			return connError{ErrCodeProtocol, "WINDOW_UPDATE on idle stream"}
+		}
+		return nil
+	}
+	if increment == 0 {
+		return streamError{f.streamID, ErrCodeProtocol, "zero window increment"}
+	}
+	st.sendWindow += increment
+	if st.sendWindow > maxWindowSize {
+		return streamError{f.streamID, ErrCodeFlowControl, "stream window overflow"}
+	}
+	sc.cond.Broadcast()
+	return nil
+}
+
+func (sc *serverConn) processRSTStream(f *frame) error {
+	if f.streamID == 0 {
+		return connError{ErrCodeProtocol, "RST_STREAM on stream 0"}
+	}
+	if len(f.payload) != 4 {
+		return connError{ErrCodeFrameSize, "RST_STREAM must be 4 bytes"}
+	}
+	if f.streamID > sc.maxStreamID {
+		return connError{ErrCodeProtocol, "RST_STREAM on idle stream"}
+	}
+	sc.mu.Lock()
+	if st := sc.streams[f.streamID]; st != nil {
+		sc.closeStreamLocked(st)
+	}
+	sc.mu.Unlock()
+	sc.reportActivity()
+	return nil
+}
+
+func (sc *serverConn) processHeaders(f *frame) error {
+	if f.streamID == 0 || f.streamID%2 == 0 {
+		return connError{ErrCodeProtocol, "invalid stream id for HEADERS"}
+	}
+	payload, err := removePadding(f)
+	if err != nil {
+		return err
+	}
+	if f.has(flagPriority) {
+		if len(payload) < 5 {
+			return connError{ErrCodeFrameSize, "HEADERS priority block truncated"}
+		}
+		if binary.BigEndian.Uint32(payload)&0x7FFFFFFF == f.streamID {
+			return streamError{f.streamID, ErrCodeProtocol, "stream depends on itself"}
+		}
+		payload = payload[5:]
+	}
+	block, err := sc.readHeaderBlock(f, payload)
+	if err != nil {
+		return err
+	}
+	// The block is decoded even for streams we refuse, to keep the
+	// decoder in sync with the client.
+	fields, err := sc.decoder.Decode(block)
+	if errors.Is(err, hpack.ErrHeaderListTooLarge) {
+		return connError{ErrCodeEnhanceYourCalm, err.Error()}
+	}
+	if err != nil {
+		return connError{ErrCodeCompression, err.Error()}
+	}
+	endStream := f.has(flagEndStream)
+
+	sc.mu.Lock()
+	st := sc.streams[f.streamID]
+	active := uint32(len(sc.streams))
+	sc.mu.Unlock()
+	if st != nil {
+		// Trailers. Their fields are not passed on to the handler.
+		if st.remoteClosed {
+			return streamError{f.streamID, ErrCodeStreamClosed, "HEADERS after end of stream"}
+		}
+		if !endStream {
+			return streamError{f.streamID, ErrCodeProtocol, "trailers must end the stream"}
+		}
+		return sc.endRequest(st)
+	}
+	if f.streamID <= sc.maxStreamID {
+		return connError{ErrCodeStreamClosed, "HEADERS on closed stream"}
+	}
+	sc.mu.Lock()
+	sc.maxStreamID = f.streamID
+	sc.mu.Unlock()
+
+	req, contentLength, err := buildRequest(fields)
+	if err != nil {
+		if sc.opts.OnParseError != nil {
+			sc.opts.OnParseError(err)
+		}
+		return streamError{f.streamID, ErrCodeProtocol, err.Error()}
+	}
+	if active >= sc.opts.MaxConcurrentStreams {
+		return streamError{f.streamID, ErrCodeRefusedStream, "too many concurrent streams"}
+	}
+	st = sc.newStream(f.streamID)
+	if st == nil {
+		return streamError{f.streamID, ErrCodeRefusedStream, "connection is going away"}
+	}
+	st.req = req
+	st.contentLength = contentLength
+	if endStream {
+		return sc.endRequest(st)
+	}
+	return nil
+}
+
+// readHeaderBlock gathers the CONTINUATION frames that must directly
+// follow a HEADERS frame without END_HEADERS.
+func (sc *serverConn) readHeaderBlock(f *frame, fragment []byte) ([]byte, error) {
+	block := append([]byte(nil), fragment...)
+	for !f.has(flagEndHeaders) {
+		next, err := readFrame(sc.br, defaultMaxFrameLen)
+		if err != nil {
+			return nil, err
+		}
+		if next.typ != frameContinuation || next.streamID != f.streamID {
+			return nil, connError{ErrCodeProtocol, "expected CONTINUATION"}
+		}
+		block = append(block, next.payload...)
+		if len(block) > maxHeaderBlockSize {
+			return nil, connError{ErrCodeEnhanceYourCalm, "header block too large"}
+		}
+		f = next
+	}
+	return block, nil
+}
+
+var connectionSpecificHeaders = map[string]struct{}{
+	"connection":        {},
+	"keep-alive":        {},
+	"proxy-connection":  {},
+	"transfer-encoding": {},
+	"upgrade":           {},
+}
+
+// buildRequest validates the decoded fields of a request header block
+// and returns the request along with its declared content length, or -1.
+func buildRequest(fields []hpack.HeaderField) (*request.Request, int64, error) {
+	pseudo := map[string]string{}
+	sawRegular := false
+	for _, f := range fields {
+		if strings.HasPrefix(f.Name, ":") {
+			if sawRegular {
+				return nil, 0, errors.New("pseudo-header after regular header")
+			}
+			switch f.Name {
+			case ":method", ":scheme", ":path", ":authority":
+			default:
+				return nil, 0, errors.New("unknown pseudo-header " + f.Name)
+			}
+			if _, dup := pseudo[f.Name]; dup {
+				return nil, 0, errors.New("duplicate pseudo-header " + f.Name)
+			}
+			pseudo[f.Name] = f.Value
+			continue
+		}
+		sawRegular = true
+		if f.Name != strings.ToLower(f.Name) {
+			return nil, 0, errors.New("uppercase header name")
+		}
+		if _, bad := connectionSpecificHeaders[f.Name]; bad {
+			return nil, 0, errors.New("connection-specific header " + f.Name)
+		}
+		if f.Name == "te" && f.Value != "trailers" {
+			return nil, 0, errors.New("invalid te header")
+		}
+	}
+	h := hpack.ToHeaders(fields)
+
+	method := pseudo[":method"]
+	authority := pseudo[":authority"]
+	target := pseudo[":path"]
+	switch {
+	case method == "":
+		return nil, 0, errors.New("missing :method")
+	case method == "CONNECT":
+		if authority == "" || pseudo[":path"] != "" || pseudo[":scheme"] != "" {
+			return nil, 0, errors.New("malformed CONNECT request")
+		}
+		target = authority
+	case pseudo[":scheme"] == "" || target == "":
+		return nil, 0, errors.New("missing :scheme or :path")
+	}
+	if _, err := h.Get("host"); err != nil && authority != "" {
+		h.Set("host", authority)
+	}
+
+	contentLength := int64(-1)
+	if cl, err := h.Get("content-length"); err == nil {
+		n, err := strconv.ParseInt(cl, 10, 64)
+		if err != nil || n < 0 {
+			return nil, 0, errors.New("invalid content-length")
+		}
+		contentLength = n
+	}
+	return &request.Request{
+		RequestLine: request.RequestLine{
+			Method:        method,
+			RequestTarget: target,
+			HttpVersion:   "2.0",
+		},
+		Headers: h,
+	}, contentLength, nil
+}
+
+func (sc *serverConn) processData(f *frame) error {
+	if f.streamID == 0 {
+		return connError{ErrCodeProtocol, "DATA on stream 0"}
+	}
+	// Every DATA frame is acknowledged on arrival, so the client can never
+	// hold more than one frame beyond our windows.
+	length := int64(len(f.payload))
+	sc.mu.Lock()
+	st := sc.streams[f.streamID]
+	sc.mu.Unlock()
+	if length > 0 {
+		if err := sc.writeWindowUpdate(0, length); err != nil {
+			return err
+		}
+	}
+
+	if st == nil || st.remoteClosed {
+		if f.streamID > sc.maxStreamID {
+			return connError{ErrCodeProtocol, "DATA on idle stream"}
+		}
+		return streamError{f.streamID, ErrCodeStreamClosed, "DATA on closed stream"}
+	}
+	data, err := removePadding(f)
+	if err != nil {
+		return err
+	}
+	if int64(len(st.req.Body)+len(data)) > sc.opts.MaxRequestBodySize {
+		return streamError{f.streamID, ErrCodeCancel, "request body too large"}
+	}
+	st.req.Body = append(st.req.Body, data...)
+	if f.has(flagEndStream) {
+		return sc.endRequest(st)
+	}
+	if length > 0 {
+		return sc.writeWindowUpdate(f.streamID, length)
+	}
+	return nil
+}
+
+func (sc *serverConn) endRequest(st *stream) error {
+	st.remoteClosed = true
+	if st.contentLength >= 0 && st.contentLength != int64(len(st.req.Body)) {
+		return streamError{st.id, ErrCodeProtocol, "body does not match content-length"}
+	}
+	st.req.Contentlength = len(st.req.Body)
+	sc.dispatch(st, st.req)
+	st.req = nil
+	return nil
+}
+
+// newStream returns nil once the connection is going away.
+func (sc *serverConn) newStream(id uint32) *stream {
+	sc.mu.Lock()
+	if sc.goingAway {
+		sc.mu.Unlock()
+		return nil
+	}
+	st := &stream{
+		sc:         sc,
+		id:         id,
+		sendWindow: sc.initialSendWindow,
+	}
+	sc.streams[id] = st
+	sc.mu.Unlock()
+	sc.reportActivity()
+	return st
+}
+
+func (sc *serverConn) dispatch(st *stream, req *request.Request) {
+	sc.requests++
+	req.RemoteAddr = sc.conn.RemoteAddr().String()
+	req.LocalAddr = sc.conn.LocalAddr().String()
+	req.TLS = sc.tlsState
+	req.Scheme = "http"
+	if sc.tlsState != nil {
+		req.Scheme = "https"
+	}
+	req.ConnID = sc.opts.ConnID
+	req.Sequence = sc.requests
+	ctx, cancel := context.WithCancel(sc.ctx)
+	sc.mu.Lock()
+	st.cancel = cancel
+	sc.mu.Unlock()
+	req = req.WithContext(ctx)
+	sc.handlers.Add(1)
+	go func() {
+		defer sc.handlers.Done()
+		defer cancel()
+		w := &response.Writer{}
+		w.SetTransport(st)
+		if sc.opts.ConfigureWriter != nil {
+			sc.opts.ConfigureWriter(w)
+		}
+		sc.opts.Handler(w, req)
+		if err := w.Finish(); err != nil && !errors.Is(err, errStreamReset) && !errors.Is(err, errConnClosed) {
+			log.Printf("http2: error finishing response on stream %d: %v", st.id, err)
+		}
+		// A handler that never completed its response gets the stream
+		// reset, as an HTTP/1.1 connection would be closed.
+		sc.mu.Lock()
+		done := st.done
+		sc.mu.Unlock()
+		if !done {
+			sc.resetStream(st.id, ErrCodeInternal)
+		}
+	}()
+}
+
+func (sc *serverConn) closeStreamLocked(st *stream) {
+	if st.cancel != nil {
+		st.cancel()
+	}
+	st.done = true
+	delete(sc.streams, st.id)
+	sc.cond.Broadcast()
+}
+
+// reportActivity tells OnActivity whether the connection has open streams,
+// if that changed since it was last told. It must be called without sc.mu
+// held, after any change to sc.streams.
+func (sc *serverConn) reportActivity() {
+	if sc.opts.OnActivity == nil {
+		return
+	}
+	sc.activityMu.Lock()
+	defer sc.activityMu.Unlock()
+	sc.mu.Lock()
+	active := len(sc.streams) > 0
+	sc.mu.Unlock()
+	if active != sc.reportedActive {
+		sc.reportedActive = active
+		sc.opts.OnActivity(active)
+	}
+}
+
+func (sc *serverConn) resetStream(id uint32, code ErrCode) {
+	sc.mu.Lock()
+	if st := sc.streams[id]; st != nil {
+		sc.closeStreamLocked(st)
+	}
+	sc.mu.Unlock()
+	sc.reportActivity()
+	sc.writeFrame(frameRSTStream, 0, id, binary.BigEndian.AppendUint32(nil, uint32(code)))
+}
+
+func (sc *serverConn) goAway(code ErrCode) {
+	sc.mu.Lock()
+	lastStreamID := sc.maxStreamID
+	sc.mu.Unlock()
+	payload := binary.BigEndian.AppendUint32(nil, lastStreamID)
+	payload = binary.BigEndian.AppendUint32(payload, uint32(code))
+	sc.writeFrame(frameGoAway, 0, 0, payload)
+}
+
+func (sc *serverConn) writeWindowUpdate(streamID uint32, increment int64) error {
+	return sc.writeFrame(frameWindowUpdate, 0, streamID, binary.BigEndian.AppendUint32(nil, uint32(increment)))
+}
+
+func (sc *serverConn) writeFrame(typ frameType, flags uint8, streamID uint32, payload []byte) error {
+	sc.writeMu.Lock()
+	defer sc.writeMu.Unlock()
+	return sc.writeLocked(appendFrame(nil, typ, flags, streamID, payload))
+}
+
+func (sc *serverConn) write(b []byte) error {
+	sc.writeMu.Lock()
+	defer sc.writeMu.Unlock()
+	return sc.writeLocked(b)
+}
+
+func (sc *serverConn) writeLocked(b []byte) error {
+	if _, err := sc.conn.Write(b); err != nil {
+		sc.conn.Close()
+		return err
+	}
+	return nil
+}
+
+func containsToken(value string, token string) bool {
+	for _, v := range strings.Split(value, ",") {
+		if strings.EqualFold(strings.TrimSpace(v), token) {
+			return true
+		}
+	}
+	return false
+}
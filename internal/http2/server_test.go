@@ -0,0 +1,410 @@
+package http2
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/PeterKWIlliams/http/internal/headers"
+	"github.com/PeterKWIlliams/http/internal/hpack"
+	"github.com/PeterKWIlliams/http/internal/request"
+	"github.com/PeterKWIlliams/http/internal/response"
+)
+
+type testClient struct {
+	t       *testing.T
+	conn    net.Conn
+	br      *bufio.Reader
+	encoder *hpack.Encoder
+	decoder *hpack.Decoder
+}
+
+// serve runs serveFn on the server side of a loopback connection.
+func serve(t *testing.T, serveFn func(conn net.Conn, buffered []byte)) *testClient {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		serveFn(conn, nil)
+	}()
+	conn, err := net.Dial("tcp", l.Addr().String())
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		conn.Close()
+		<-done
+	})
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	return &testClient{
+		t:       t,
+		conn:    conn,
+		br:      bufio.NewReader(conn),
+		encoder: hpack.NewEncoder(hpack.DefaultTableSize),
+		decoder: hpack.NewDecoder(hpack.DefaultTableSize),
+	}
+}
+
+func dial(t *testing.T, handler Handler, settings ...setting) *testClient {
+	t.Helper()
+	c := serve(t, func(conn net.Conn, buffered []byte) {
+		ServeConn(conn, buffered, Options{Handler: handler})
+	})
+	c.write([]byte(Preface))
+	c.writeFrame(frameSettings, 0, 0, appendSettings(nil, settings...))
+	return c
+}
+
+func (c *testClient) write(b []byte) {
+	c.t.Helper()
+	_, err := c.conn.Write(b)
+	require.NoError(c.t, err)
+}
+
+func (c *testClient) writeFrame(typ frameType, flags uint8, streamID uint32, payload []byte) {
+	c.t.Helper()
+	c.write(appendFrame(nil, typ, flags, streamID, payload))
+}
+
+func (c *testClient) writeHeaders(streamID uint32, endStream bool, fields ...string) {
+	c.t.Helper()
+	var hf []hpack.HeaderField
+	for i := 0; i < len(fields); i += 2 {
+		hf = append(hf, hpack.HeaderField{Name: fields[i], Value: fields[i+1]})
+	}
+	flags := uint8(flagEndHeaders)
+	if endStream {
+		flags |= flagEndStream
+	}
+	c.writeFrame(frameHeaders, flags, streamID, c.encoder.AppendFields(nil, hf))
+}
+
+func (c *testClient) get(streamID uint32, path string) {
+	c.t.Helper()
+	c.writeHeaders(streamID, true, ":method", "GET", ":scheme", "http", ":path", path, ":authority", "example.com")
+}
+
+// readFrame returns the next frame that is not connection housekeeping.
+func (c *testClient) readFrame() *frame {
+	c.t.Helper()
+	for {
+		f, err := readFrame(c.br, maxFrameLenLimit)
+		require.NoError(c.t, err)
+		if f.typ != frameSettings && f.typ != frameWindowUpdate {
+			return f
+		}
+	}
+}
+
+type testResponse struct {
+	status  string
+	headers map[string]string
+	body    string
+}
+
+func (c *testClient) readResponse(streamID uint32) testResponse {
+	c.t.Helper()
+	resp := testResponse{headers: map[string]string{}}
+	for {
+		f := c.readFrame()
+		require.Equal(c.t, streamID, f.streamID, "unexpected frame type %d", f.typ)
+		switch f.typ {
+		case frameHeaders:
+			block := f.payload
+			for !f.has(flagEndHeaders) {
+				f = c.readFrame()
+				require.Equal(c.t, frameContinuation, f.typ)
+				block = append(block, f.payload...)
+			}
+			fields, err := c.decoder.Decode(block)
+			require.NoError(c.t, err)
+			for _, hf := range fields {
+				if hf.Name == ":status" {
+					resp.status = hf.Value
+				} else {
+					resp.headers[hf.Name] = hf.Value
+				}
+			}
+		case frameData:
+			resp.body += string(f.payload)
+		default:
+			c.t.Fatalf("unexpected frame type %d on stream %d", f.typ, f.streamID)
+		}
+		if f.has(flagEndStream) {
+			return resp
+		}
+	}
+}
+
+func (c *testClient) expectRSTStream(streamID uint32, code ErrCode) {
+	c.t.Helper()
+	f := c.readFrame()
+	require.Equal(c.t, frameRSTStream, f.typ)
+	assert.Equal(c.t, streamID, f.streamID)
+	assert.Equal(c.t, code, ErrCode(binary.BigEndian.Uint32(f.payload)))
+}
+
+func (c *testClient) expectGoAway(code ErrCode) {
+	c.t.Helper()
+	f := c.readFrame()
+	require.Equal(c.t, frameGoAway, f.typ)
+	assert.Equal(c.t, code, ErrCode(binary.BigEndian.Uint32(f.payload[4:])))
+}
+
+func echoHandler(w *response.Writer, req *request.Request) {
+	h := response.GetDefaultHeaders(len(req.Body))
+	h.Set("x-method", req.RequestLine.Method)
+	h.Set("x-target", req.RequestLine.RequestTarget)
+	if host, err := req.Headers.Get("host"); err == nil {
+		h.Set("x-host", host)
+	}
+	if cookie, err := req.Headers.Get("cookie"); err == nil {
+		h.Set("x-cookie", cookie)
+	}
+	w.Write(response.OK, h, req.Body)
+}
+
+func TestServeConn_Requests(t *testing.T) {
+	c := dial(t, echoHandler)
+
+	// Test: GET with the request line rebuilt from pseudo-headers
+	c.get(1, "/hello?x=1")
+	resp := c.readResponse(1)
+	assert.Equal(t, "200", resp.status)
+	assert.Equal(t, "GET", resp.headers["x-method"])
+	assert.Equal(t, "/hello?x=1", resp.headers["x-target"])
+	assert.Equal(t, "example.com", resp.headers["x-host"])
+	assert.NotContains(t, resp.headers, "connection")
+	assert.Equal(t, "0", resp.headers["content-length"])
+
+	// Test: POST body split over DATA frames, one of them padded
+	c.writeHeaders(3, false, ":method", "POST", ":scheme", "http", ":path", "/upload", ":authority", "example.com",
+		"cookie", "a=1", "cookie", "b=2", "content-length", "11")
+	c.writeFrame(frameData, 0, 3, []byte("hello "))
+	c.writeFrame(frameData, flagPadded|flagEndStream, 3, append([]byte{3}, "world\x00\x00\x00"...))
+	resp = c.readResponse(3)
+	assert.Equal(t, "hello world", resp.body)
+	assert.Equal(t, "a=1; b=2", resp.headers["x-cookie"])
+
+	// Test: Header block split across CONTINUATION
+	block := c.encoder.AppendFields(nil, []hpack.HeaderField{
+		{Name: ":method", Value: "GET"}, {Name: ":scheme", Value: "http"},
+		{Name: ":path", Value: "/continued"}, {Name: ":authority", Value: "example.com"},
+	})
+	c.writeFrame(frameHeaders, flagEndStream, 5, block[:4])
+	c.writeFrame(frameContinuation, flagEndHeaders, 5, block[4:])
+	assert.Equal(t, "/continued", c.readResponse(5).headers["x-target"])
+
+	// Test: PING is acknowledged
+	c.writeFrame(framePing, 0, 0, []byte("12345678"))
+	f := c.readFrame()
+	assert.Equal(t, framePing, f.typ)
+	assert.True(t, f.has(flagAck))
+	assert.Equal(t, "12345678", string(f.payload))
+}
+
+func TestServeConn_FlowControl(t *testing.T) {
+	body := strings.Repeat("x", 25)
+	c := dial(t, func(w *response.Writer, req *request.Request) {
+		w.Write(response.OK, response.GetDefaultHeaders(len(body)), []byte(body))
+	}, setting{settingInitialWindowSize, 10})
+
+	c.get(1, "/")
+	f := c.readFrame()
+	require.Equal(t, frameHeaders, f.typ)
+	f = c.readFrame()
+	require.Equal(t, frameData, f.typ)
+	assert.Len(t, f.payload, 10)
+
+	c.writeFrame(frameWindowUpdate, 0, 1, binary.BigEndian.AppendUint32(nil, 20))
+	received := 10
+	for received < len(body) {
+		f = c.readFrame()
+		require.Equal(t, frameData, f.typ)
+		received += len(f.payload)
+	}
+	assert.Equal(t, len(body), received)
+	f = c.readFrame()
+	assert.True(t, f.has(flagEndStream))
+}
+
+func TestServeConn_Errors(t *testing.T) {
+	var parseErrors atomic.Int32
+	c := serve(t, func(conn net.Conn, buffered []byte) {
+		ServeConn(conn, buffered, Options{
+			Handler:      func(w *response.Writer, req *request.Request) {},
+			OnParseError: func(error) { parseErrors.Add(1) },
+		})
+	})
+	c.write([]byte(Preface))
+	c.writeFrame(frameSettings, 0, 0, nil)
+
+	// Test: Handler that never responds resets its stream
+	c.get(1, "/")
+	c.expectRSTStream(1, ErrCodeInternal)
+
+	// Test: Malformed requests reset only their stream
+	c.writeHeaders(3, true, ":method", "GET", ":scheme", "http", ":path", "/", "Upper", "x")
+	c.expectRSTStream(3, ErrCodeProtocol)
+	c.writeHeaders(5, true, ":method", "GET", ":scheme", "http", ":path", "/", "connection", "close")
+	c.expectRSTStream(5, ErrCodeProtocol)
+	c.writeHeaders(7, true, ":method", "GET", ":path", "/")
+	c.expectRSTStream(7, ErrCodeProtocol)
+	c.writeHeaders(9, false, ":method", "POST", ":scheme", "http", ":path", "/", "content-length", "5")
+	c.writeFrame(frameData, flagEndStream, 9, []byte("abc"))
+	c.expectRSTStream(9, ErrCodeProtocol)
+	// Test: Only requests that fail to parse are reported as such
+	assert.Equal(t, int32(3), parseErrors.Load())
+
+	// Test: DATA on stream 0 is a connection error
+	c.writeFrame(frameData, 0, 0, []byte("x"))
+	c.expectGoAway(ErrCodeProtocol)
+}
+
+func TestServeConn_HeaderListSize(t *testing.T) {
+	c := dial(t, echoHandler)
+
+	// Test: A block that decodes past SETTINGS_MAX_HEADER_LIST_SIZE ends the connection
+	block := c.encoder.AppendFields(nil, []hpack.HeaderField{
+		{Name: ":method", Value: "GET"},
+		{Name: ":scheme", Value: "http"},
+		{Name: ":path", Value: "/"},
+		{Name: "x-big", Value: strings.Repeat("a", 4000)},
+	})
+	block = append(block, bytes.Repeat([]byte{0x80 | 62}, 300)...)
+	c.writeFrame(frameHeaders, flagEndHeaders|flagEndStream, 1, block)
+	c.expectGoAway(ErrCodeEnhanceYourCalm)
+}
+
+func TestServeConn_Shutdown(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	shutdown := make(chan struct{})
+	handler := func(w *response.Writer, req *request.Request) {
+		close(started)
+		<-release
+		echoHandler(w, req)
+	}
+	c := serve(t, func(conn net.Conn, buffered []byte) {
+		ServeConn(conn, buffered, Options{Handler: handler, Shutdown: shutdown})
+	})
+	c.write([]byte(Preface))
+	c.writeFrame(frameSettings, 0, 0, nil)
+	c.get(1, "/inflight")
+	<-started
+
+	// Test: GOAWAY names the last stream that will still be served
+	close(shutdown)
+	f := c.readFrame()
+	require.Equal(t, frameGoAway, f.typ)
+	assert.Equal(t, uint32(1), binary.BigEndian.Uint32(f.payload))
+	assert.Equal(t, ErrCodeNo, ErrCode(binary.BigEndian.Uint32(f.payload[4:])))
+
+	// Test: New streams are refused
+	c.get(3, "/late")
+	c.expectRSTStream(3, ErrCodeRefusedStream)
+
+	// Test: The in-flight stream completes before the connection closes
+	close(release)
+	resp := c.readResponse(1)
+	assert.Equal(t, "200", resp.status)
+	assert.Equal(t, "/inflight", resp.headers["x-target"])
+	_, err := readFrame(c.br, maxFrameLenLimit)
+	assert.ErrorIs(t, err, io.EOF)
+}
+
+func TestServeConn_RequestContext(t *testing.T) {
+	cancelled := make(chan error, 1)
+	c := dial(t, func(w *response.Writer, req *request.Request) {
+		select {
+		case <-req.Context().Done():
+			cancelled <- req.Context().Err()
+		case <-time.After(5 * time.Second):
+			cancelled <- nil
+		}
+	})
+
+	// Test: Resetting a stream cancels its request
+	c.get(1, "/")
+	c.writeFrame(frameRSTStream, 0, 1, binary.BigEndian.AppendUint32(nil, uint32(ErrCodeCancel)))
+	assert.ErrorIs(t, <-cancelled, context.Canceled)
+
+	// Test: Closing the connection cancels its requests
+	c.get(3, "/")
+	c.conn.Close()
+	assert.ErrorIs(t, <-cancelled, context.Canceled)
+}
+
+func TestServeConn_FirstFrameMustBeSettings(t *testing.T) {
+	c := serve(t, func(conn net.Conn, buffered []byte) {
+		ServeConn(conn, buffered, Options{Handler: echoHandler})
+	})
+	c.write([]byte(Preface))
+	c.writeFrame(framePing, 0, 0, make([]byte, 8))
+	c.expectGoAway(ErrCodeProtocol)
+}
+
+func TestServeUpgrade(t *testing.T) {
+	settings := base64.RawURLEncoding.EncodeToString(appendSettings(nil, setting{settingMaxFrameSize, 1 << 15}))
+	req, err := request.RequestFromReader(strings.NewReader("GET /upgraded HTTP/1.1\r\nHost: example.com\r\n" +
+		"Connection: Upgrade, HTTP2-Settings\r\nUpgrade: h2c\r\nHTTP2-Settings: " + settings + "\r\n\r\n"))
+	require.NoError(t, err)
+	require.True(t, IsUpgrade(req))
+
+	var seen headers.Headers
+	c := serve(t, func(conn net.Conn, buffered []byte) {
+		ServeUpgrade(conn, buffered, req, Options{Handler: func(w *response.Writer, req *request.Request) {
+			seen = req.Headers
+			echoHandler(w, req)
+		}})
+	})
+
+	resp, err := http.ReadResponse(c.br, nil)
+	require.NoError(t, err)
+	assert.Equal(t, 101, resp.StatusCode)
+	assert.Equal(t, "h2c", resp.Header.Get("Upgrade"))
+
+	c.write([]byte(Preface))
+	c.writeFrame(frameSettings, 0, 0, nil)
+	r := c.readResponse(1)
+	assert.Equal(t, "200", r.status)
+	assert.Equal(t, "/upgraded", r.headers["x-target"])
+	assert.NotContains(t, seen, "http2-settings")
+	assert.NotContains(t, seen, "upgrade")
+}
+
+func TestIsUpgrade(t *testing.T) {
+	tests := []struct {
+		name    string
+		headers string
+		want    bool
+	}{
+		{"valid", "Connection: Upgrade, HTTP2-Settings\r\nUpgrade: h2c\r\nHTTP2-Settings: AAMAAABkAAQCAAAAAAIAAAAA\r\n", true},
+		{"websocket", "Connection: Upgrade\r\nUpgrade: websocket\r\n", false},
+		{"missing settings", "Connection: Upgrade, HTTP2-Settings\r\nUpgrade: h2c\r\n", false},
+		{"bad settings", "Connection: Upgrade, HTTP2-Settings\r\nUpgrade: h2c\r\nHTTP2-Settings: AAMA\r\n", false},
+	}
+	for _, tc := range tests {
+		req, err := request.RequestFromReader(strings.NewReader("GET / HTTP/1.1\r\nHost: x\r\n" + tc.headers + "\r\n"))
+		require.NoError(t, err)
+		assert.Equal(t, tc.want, IsUpgrade(req), tc.name)
+	}
+}
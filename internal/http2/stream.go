@@ -0,0 +1,122 @@
+package http2
+
+import (
+	"strconv"
+
+	"github.com/PeterKWIlliams/http/internal/headers"
+	"github.com/PeterKWIlliams/http/internal/hpack"
+	"github.com/PeterKWIlliams/http/internal/response"
+)
+
+// A stream is the response.Transport for its handler's writer.
+var _ response.Transport = (*stream)(nil)
+
+func (st *stream) WriteHeader(statusCode response.StatusCode, h headers.Headers) error {
+	fields := []hpack.HeaderField{{Name: ":status", Value: strconv.Itoa(int(statusCode))}}
+	for _, f := range hpack.FromHeaders(h) {
+		if _, skip := connectionSpecificHeaders[f.Name]; !skip {
+			fields = append(fields, f)
+		}
+	}
+
+	sc := st.sc
+	sc.writeMu.Lock()
+	defer sc.writeMu.Unlock()
+	maxLen, err := st.writable()
+	if err != nil {
+		return err
+	}
+	block := sc.encoder.AppendFields(nil, fields)
+	var out []byte
+	typ := frameHeaders
+	for {
+		n := min(len(block), int(maxLen))
+		var flags uint8
+		if n == len(block) {
+			flags = flagEndHeaders
+		}
+		out = appendFrame(out, typ, flags, st.id, block[:n])
+		block = block[n:]
+		if len(block) == 0 {
+			break
+		}
+		typ = frameContinuation
+	}
+	return sc.writeLocked(out)
+}
+
+// Write sends p as DATA frames, waiting for flow-control window as needed.
+func (st *stream) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		n, err := st.reserve(len(p))
+		if err != nil {
+			return written, err
+		}
+		if err := st.writeData(p[:n], 0); err != nil {
+			return written, err
+		}
+		written += n
+		p = p[n:]
+	}
+	return written, nil
+}
+
+// Close ends the stream with an empty DATA frame.
+func (st *stream) Close() error {
+	if err := st.writeData(nil, flagEndStream); err != nil {
+		return err
+	}
+	st.sc.mu.Lock()
+	st.sc.closeStreamLocked(st)
+	st.sc.mu.Unlock()
+	st.sc.reportActivity()
+	return nil
+}
+
+// reserve blocks until some send window is available and takes up to
+// want bytes of it.
+func (st *stream) reserve(want int) (int, error) {
+	sc := st.sc
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	for {
+		if sc.closed {
+			return 0, errConnClosed
+		}
+		if st.done {
+			return 0, errStreamReset
+		}
+		n := min(int64(want), st.sendWindow, sc.sendWindow, int64(sc.peerMaxFrameLen))
+		if n > 0 {
+			st.sendWindow -= n
+			sc.sendWindow -= n
+			return int(n), nil
+		}
+		sc.cond.Wait()
+	}
+}
+
+func (st *stream) writeData(p []byte, flags uint8) error {
+	sc := st.sc
+	sc.writeMu.Lock()
+	defer sc.writeMu.Unlock()
+	if _, err := st.writable(); err != nil {
+		return err
+	}
+	return sc.writeLocked(appendFrame(nil, frameData, flags, st.id, p))
+}
+
+// writable reports whether frames may still be sent on the stream and
+// the peer's current frame size limit.
+func (st *stream) writable() (uint32, error) {
+	st.sc.mu.Lock()
+	defer st.sc.mu.Unlock()
+	if st.sc.closed {
+		return 0, errConnClosed
+	}
+	if st.done {
+		return 0, errStreamReset
+	}
+	return st.sc.peerMaxFrameLen, nil
+}
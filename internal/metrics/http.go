@@ -0,0 +1,149 @@
+package metrics
+
+import (
+	"bytes"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/PeterKWIlliams/http/internal/headers"
+	"github.com/PeterKWIlliams/http/internal/request"
+	"github.com/PeterKWIlliams/http/internal/response"
+	"github.com/PeterKWIlliams/http/internal/server"
+)
+
+// knownMethods bounds the method label; anything else is counted as
+// OTHER so clients cannot create series at will.
+var knownMethods = map[string]bool{
+	"GET": true, "HEAD": true, "POST": true, "PUT": true, "DELETE": true,
+	"CONNECT": true, "OPTIONS": true, "TRACE": true, "PATCH": true,
+}
+
+// ServerMetrics records the standard metrics of an HTTP server. Install
+// Middleware in the handler chain, and ConnState and ParseError with
+// server.WithConnState and server.WithParseErrorHook.
+type ServerMetrics struct {
+	route func(*request.Request) string
+
+	requests    *Counter
+	duration    *Histogram
+	inFlight    *Gauge
+	connections *Gauge
+	bytesIn     *Counter
+	bytesOut    *Counter
+	parseErrors *Counter
+}
+
+// NewServerMetrics registers the server metrics in r. route maps a
+// request to its route label and must return a small, fixed set of
+// values, such as the path prefixes the server routes on; without it the
+// label is empty.
+func NewServerMetrics(r *Registry, route func(*request.Request) string) *ServerMetrics {
+	if route == nil {
+		route = func(*request.Request) string { return "" }
+	}
+	return &ServerMetrics{
+		route:       route,
+		requests:    r.NewCounter("http_requests_total", "Requests served, by method, route and status.", "method", "route", "status"),
+		duration:    r.NewHistogram("http_request_duration_seconds", "Time from the handler being called to the response being finished.", nil, "method", "route"),
+		inFlight:    r.NewGauge("http_requests_in_flight", "Requests being handled."),
+		connections: r.NewGauge("http_open_connections", "Connections open and managed by the server."),
+		bytesIn:     r.NewCounter("http_request_body_bytes_total", "Request body bytes received.", "method", "route"),
+		bytesOut:    r.NewCounter("http_response_body_bytes_total", "Response body bytes sent, after content encoding.", "method", "route"),
+		parseErrors: r.NewCounter("http_request_parse_errors_total", "Requests that could not be parsed."),
+	}
+}
+
+// Middleware counts and times requests. Like the access log it finishes
+// the response before recording it, so encoded bytes are counted; place
+// it outside compression.
+func (m *ServerMetrics) Middleware() server.Middleware {
+	return func(next server.Handler) server.Handler {
+		return func(w *response.Writer, req *request.Request) {
+			m.inFlight.Inc()
+			defer m.inFlight.Dec()
+			start := time.Now()
+			next(w, req)
+			if err := w.Finish(); err != nil {
+				log.Printf("Error finishing response: %v", err)
+			}
+
+			method := req.RequestLine.Method
+			if !knownMethods[method] {
+				method = "OTHER"
+			}
+			route := m.route(req)
+			status := w.StatusCode()
+			if status == 0 && w.Hijacked() {
+				status = response.SwitchingProtocols
+			} else if status == 0 {
+				status = response.OK
+			}
+			m.requests.Inc(method, route, strconv.Itoa(int(status)))
+			m.duration.Observe(time.Since(start).Seconds(), method, route)
+			m.bytesIn.Add(float64(len(req.Body)), method, route)
+			m.bytesOut.Add(float64(w.BodyBytes()), method, route)
+		}
+	}
+}
+
+// ConnState keeps the open connection count. Hijacked connections stop
+// counting as the server no longer manages them.
+func (m *ServerMetrics) ConnState(_ net.Conn, state server.ConnState) {
+	switch state {
+	case server.StateNew:
+		m.connections.Inc()
+	case server.StateHijacked, server.StateClosed:
+		m.connections.Dec()
+	}
+}
+
+func (m *ServerMetrics) ParseError(error) {
+	m.parseErrors.Inc()
+}
+
+// Endpoint serves the metrics in r to GET and HEAD requests for path and
+// passes other requests on.
+func Endpoint(path string, r *Registry) server.Middleware {
+	return func(next server.Handler) server.Handler {
+		return func(w *response.Writer, req *request.Request) {
+			target, _, _ := strings.Cut(req.RequestLine.RequestTarget, "?")
+			if target != path {
+				next(w, req)
+				return
+			}
+			method := req.RequestLine.Method
+			if method != "GET" && method != "HEAD" {
+				w.OnWriteHeaders(func(_ response.StatusCode, h headers.Headers) {
+					h.Set("allow", "GET, HEAD")
+				})
+				if err := server.WriteError(w, response.MethodNotAllowed, "method not allowed"); err != nil {
+					log.Printf("could not write error %v", err)
+				}
+				return
+			}
+
+			var body bytes.Buffer
+			r.WriteTo(&body)
+			h := response.GetDefaultHeaders(body.Len())
+			h.Set("content-type", ContentType)
+			h.Set("cache-control", "no-store")
+			if err := w.WriteStatusLine(response.OK); err != nil {
+				log.Printf("could not write metrics: %v", err)
+				return
+			}
+			if err := w.WriteHeaders(h); err != nil {
+				log.Printf("could not write metrics: %v", err)
+				return
+			}
+			if method == "HEAD" {
+				return
+			}
+			if _, err := w.WriteBody(body.Bytes()); err != nil {
+				log.Printf("could not write metrics: %v", err)
+			}
+		}
+	}
+}
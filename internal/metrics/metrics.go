@@ -0,0 +1,284 @@
+// Package metrics keeps counters, gauges and histograms and writes them
+// in the Prometheus text exposition format.
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// ContentType is the media type of the text exposition format.
+const ContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// DefaultBuckets are histogram upper bounds suited to request latencies
+// in seconds.
+var DefaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// A Registry holds metrics in the order they were created.
+type Registry struct {
+	mu      sync.Mutex
+	metrics []*metric
+}
+
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+type kind string
+
+const (
+	kindCounter   kind = "counter"
+	kindGauge     kind = "gauge"
+	kindHistogram kind = "histogram"
+)
+
+type metric struct {
+	name    string
+	help    string
+	kind    kind
+	labels  []string
+	buckets []float64
+
+	mu     sync.Mutex
+	series map[string]*series
+}
+
+// A series is one combination of label values.
+type series struct {
+	labelValues []string
+	value       float64
+	// counts holds per-bucket histogram counts, not cumulative ones.
+	counts []uint64
+	count  uint64
+}
+
+func (r *Registry) add(name, help string, k kind, buckets []float64, labels []string) *metric {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, m := range r.metrics {
+		if m.name == name {
+			panic(fmt.Sprintf("metrics: %s registered twice", name))
+		}
+	}
+	m := &metric{name: name, help: help, kind: k, labels: labels, buckets: buckets, series: map[string]*series{}}
+	if len(labels) == 0 {
+		// Unlabelled metrics are reported from the start, as zero.
+		m.with(nil)
+	}
+	r.metrics = append(r.metrics, m)
+	return m
+}
+
+// with returns the series for labelValues, creating it if needed. The
+// caller holds m.mu.
+func (m *metric) with(labelValues []string) *series {
+	if len(labelValues) != len(m.labels) {
+		panic(fmt.Sprintf("metrics: %s takes %d label values, got %d", m.name, len(m.labels), len(labelValues)))
+	}
+	key := strings.Join(labelValues, "\xff")
+	s, ok := m.series[key]
+	if !ok {
+		s = &series{labelValues: slices.Clone(labelValues)}
+		if m.kind == kindHistogram {
+			s.counts = make([]uint64, len(m.buckets))
+		}
+		m.series[key] = s
+	}
+	return s
+}
+
+type Counter struct {
+	m *metric
+}
+
+// NewCounter creates a counter partitioned by the named labels.
+func (r *Registry) NewCounter(name, help string, labels ...string) *Counter {
+	return &Counter{r.add(name, help, kindCounter, nil, labels)}
+}
+
+func (c *Counter) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+// Add increases the counter. Counters only go up, so negative values
+// panic.
+func (c *Counter) Add(v float64, labelValues ...string) {
+	if v < 0 {
+		panic(fmt.Sprintf("metrics: %s decreased", c.m.name))
+	}
+	c.m.mu.Lock()
+	defer c.m.mu.Unlock()
+	c.m.with(labelValues).value += v
+}
+
+type Gauge struct {
+	m *metric
+}
+
+func (r *Registry) NewGauge(name, help string, labels ...string) *Gauge {
+	return &Gauge{r.add(name, help, kindGauge, nil, labels)}
+}
+
+func (g *Gauge) Set(v float64, labelValues ...string) {
+	g.m.mu.Lock()
+	defer g.m.mu.Unlock()
+	g.m.with(labelValues).value = v
+}
+
+func (g *Gauge) Add(v float64, labelValues ...string) {
+	g.m.mu.Lock()
+	defer g.m.mu.Unlock()
+	g.m.with(labelValues).value += v
+}
+
+func (g *Gauge) Inc(labelValues ...string) {
+	g.Add(1, labelValues...)
+}
+
+func (g *Gauge) Dec(labelValues ...string) {
+	g.Add(-1, labelValues...)
+}
+
+type Histogram struct {
+	m *metric
+}
+
+// NewHistogram creates a histogram with the given bucket upper bounds,
+// or DefaultBuckets when there are none. A +Inf bucket is always added.
+func (r *Registry) NewHistogram(name, help string, buckets []float64, labels ...string) *Histogram {
+	if len(buckets) == 0 {
+		buckets = DefaultBuckets
+	}
+	buckets = slices.Clone(buckets)
+	sort.Float64s(buckets)
+	if math.IsInf(buckets[len(buckets)-1], 1) {
+		buckets = buckets[:len(buckets)-1]
+	}
+	return &Histogram{r.add(name, help, kindHistogram, buckets, labels)}
+}
+
+func (h *Histogram) Observe(v float64, labelValues ...string) {
+	h.m.mu.Lock()
+	defer h.m.mu.Unlock()
+	s := h.m.with(labelValues)
+	if i, _ := slices.BinarySearch(h.m.buckets, v); i < len(s.counts) {
+		s.counts[i]++
+	}
+	s.count++
+	s.value += v
+}
+
+// WriteTo writes every metric in the text exposition format.
+func (r *Registry) WriteTo(w io.Writer) (int64, error) {
+	r.mu.Lock()
+	metrics := slices.Clone(r.metrics)
+	r.mu.Unlock()
+
+	bw := bufio.NewWriter(w)
+	cw := &countingWriter{w: bw}
+	for _, m := range metrics {
+		m.write(cw)
+	}
+	if cw.err == nil {
+		cw.err = bw.Flush()
+	}
+	return cw.n, cw.err
+}
+
+func (m *metric) write(w *countingWriter) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n", m.name, helpEscaper.Replace(m.help))
+	fmt.Fprintf(w, "# TYPE %s %s\n", m.name, m.kind)
+
+	keys := make([]string, 0, len(m.series))
+	for key := range m.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		s := m.series[key]
+		if m.kind != kindHistogram {
+			fmt.Fprintf(w, "%s%s %s\n", m.name, m.labelPairs(s.labelValues, ""), formatFloat(s.value))
+			continue
+		}
+		var cumulative uint64
+		for i, upper := range m.buckets {
+			cumulative += s.counts[i]
+			fmt.Fprintf(w, "%s_bucket%s %d\n", m.name, m.labelPairs(s.labelValues, formatFloat(upper)), cumulative)
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", m.name, m.labelPairs(s.labelValues, "+Inf"), s.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", m.name, m.labelPairs(s.labelValues, ""), formatFloat(s.value))
+		fmt.Fprintf(w, "%s_count%s %d\n", m.name, m.labelPairs(s.labelValues, ""), s.count)
+	}
+}
+
+// labelPairs formats {name="value",...}, adding le for histogram buckets.
+func (m *metric) labelPairs(values []string, le string) string {
+	if len(values) == 0 && le == "" {
+		return ""
+	}
+	var b strings.Builder
+	b.WriteByte('{')
+	for i, name := range m.labels {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(name)
+		b.WriteString(`="`)
+		b.WriteString(labelEscaper.Replace(values[i]))
+		b.WriteByte('"')
+	}
+	if le != "" {
+		if len(m.labels) > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(`le="`)
+		b.WriteString(le)
+		b.WriteByte('"')
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+var (
+	helpEscaper  = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+	labelEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+)
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// countingWriter remembers the first error so the exposition can be
+// written without checking every line.
+type countingWriter struct {
+	w   io.Writer
+	n   int64
+	err error
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	if c.err != nil {
+		return 0, c.err
+	}
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	c.err = err
+	return n, err
+}
@@ -0,0 +1,178 @@
+package metrics
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/PeterKWIlliams/http/internal/request"
+	"github.com/PeterKWIlliams/http/internal/response"
+	"github.com/PeterKWIlliams/http/internal/server"
+)
+
+func TestRegistry_WriteTo(t *testing.T) {
+	r := NewRegistry()
+	c := r.NewCounter("jobs_total", "Jobs run.\nBy result.", "result")
+	g := r.NewGauge("queue_length", "Jobs waiting.")
+	h := r.NewHistogram("job_seconds", "Job duration.", []float64{1, 0.5})
+
+	c.Inc("ok")
+	c.Add(2, "ok")
+	c.Inc(`bad "input"`)
+	g.Set(4)
+	g.Dec()
+	h.Observe(0.5)
+	h.Observe(0.75)
+	h.Observe(3)
+
+	var out strings.Builder
+	_, err := r.WriteTo(&out)
+	require.NoError(t, err)
+	assert.Equal(t, `# HELP jobs_total Jobs run.\nBy result.
+# TYPE jobs_total counter
+jobs_total{result="bad \"input\""} 1
+jobs_total{result="ok"} 3
+# HELP queue_length Jobs waiting.
+# TYPE queue_length gauge
+queue_length 3
+# HELP job_seconds Job duration.
+# TYPE job_seconds histogram
+job_seconds_bucket{le="0.5"} 1
+job_seconds_bucket{le="1"} 2
+job_seconds_bucket{le="+Inf"} 3
+job_seconds_sum 4.25
+job_seconds_count 3
+`, out.String())
+
+	// Test: Label values must match the label names
+	assert.Panics(t, func() { c.Inc() })
+	// Test: Counters cannot go down
+	assert.Panics(t, func() { c.Add(-1, "ok") })
+	// Test: Names are unique
+	assert.Panics(t, func() { r.NewGauge("jobs_total", "") })
+}
+
+func get(t *testing.T, addr, raw string) (*http.Response, string) {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	_, err = conn.Write([]byte(raw))
+	require.NoError(t, err)
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	require.NoError(t, err)
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	return resp, string(body)
+}
+
+func TestServerMetrics(t *testing.T) {
+	r := NewRegistry()
+	m := NewServerMetrics(r, func(req *request.Request) string {
+		if strings.HasPrefix(req.RequestLine.RequestTarget, "/api/") {
+			return "/api"
+		}
+		return "other"
+	})
+	handler := server.Chain(func(w *response.Writer, req *request.Request) {
+		body := []byte("hello")
+		w.Write(response.OK, response.GetDefaultHeaders(len(body)), body)
+	}, Endpoint("/metrics", r), m.Middleware())
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	s := server.New(handler, server.WithConnState(m.ConnState), server.WithParseErrorHook(m.ParseError))
+	go s.Serve(l)
+	defer s.Close()
+	addr := l.Addr().String()
+
+	get(t, addr, "GET /api/users HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	get(t, addr, "POST /api/users HTTP/1.1\r\nHost: localhost\r\nContent-Length: 3\r\n\r\nabc")
+	get(t, addr, "GET /index.html HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	resp, _ := get(t, addr, "BREW /pot HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	assert.Equal(t, 400, resp.StatusCode)
+	resp, _ = get(t, addr, "GET / HTTP/1.1\r\nHost: localhost\r\nContent-Length: x\r\n\r\n")
+	assert.Equal(t, 400, resp.StatusCode)
+
+	// The server closes each connection after its handler returns; wait
+	// for that to be recorded before scraping.
+	assert.Eventually(t, func() bool {
+		var out strings.Builder
+		r.WriteTo(&out)
+		return strings.Contains(out.String(), "\nhttp_open_connections 0\n")
+	}, 5*time.Second, 10*time.Millisecond)
+
+	resp, body := get(t, addr, "GET /metrics HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	assert.Equal(t, 200, resp.StatusCode)
+	assert.Equal(t, ContentType, resp.Header.Get("Content-Type"))
+	for _, line := range []string{
+		`http_requests_total{method="GET",route="/api",status="200"} 1`,
+		`http_requests_total{method="POST",route="/api",status="200"} 1`,
+		`http_requests_total{method="GET",route="other",status="200"} 1`,
+		`http_request_duration_seconds_count{method="GET",route="/api"} 1`,
+		`http_request_body_bytes_total{method="POST",route="/api"} 3`,
+		`http_response_body_bytes_total{method="GET",route="/api"} 5`,
+		`http_request_parse_errors_total 2`,
+		// Test: The scrape is served outside the middleware, but its
+		// connection is open
+		`http_requests_in_flight 0`,
+		`http_open_connections 1`,
+	} {
+		assert.Contains(t, body, "\n"+line+"\n")
+	}
+
+	// Test: Only GET and HEAD are served
+	resp, _ = get(t, addr, "POST /metrics HTTP/1.1\r\nHost: localhost\r\nContent-Length: 0\r\n\r\n")
+	assert.Equal(t, 405, resp.StatusCode)
+	assert.Equal(t, "GET, HEAD", resp.Header.Get("Allow"))
+}
+
+func TestServerMetrics_Hijacked(t *testing.T) {
+	r := NewRegistry()
+	m := NewServerMetrics(r, func(req *request.Request) string { return req.RequestLine.RequestTarget })
+	serve := func(target string, answered response.StatusCode) {
+		handler := m.Middleware()(func(w *response.Writer, req *request.Request) {
+			_, _, err := w.Hijack()
+			require.NoError(t, err)
+			if answered != 0 {
+				w.SetHijackedStatus(answered)
+			}
+		})
+		serverConn, clientConn := net.Pipe()
+		defer serverConn.Close()
+		defer clientConn.Close()
+		handler(&response.Writer{Writer: serverConn}, &request.Request{RequestLine: request.RequestLine{Method: "GET", RequestTarget: target}})
+	}
+	serve("/tunnel", response.OK)
+	serve("/upgrade", 0)
+
+	var out strings.Builder
+	_, err := r.WriteTo(&out)
+	require.NoError(t, err)
+	// Test: The status the handler wrote itself is counted, and 101
+	// otherwise
+	assert.Contains(t, out.String(), "\n"+`http_requests_total{method="GET",route="/tunnel",status="200"} 1`+"\n")
+	assert.Contains(t, out.String(), "\n"+`http_requests_total{method="GET",route="/upgrade",status="101"} 1`+"\n")
+}
+
+func TestServerMetrics_NoResponse(t *testing.T) {
+	r := NewRegistry()
+	m := NewServerMetrics(r, func(req *request.Request) string { return req.RequestLine.RequestTarget })
+	handler := m.Middleware()(func(w *response.Writer, req *request.Request) {})
+	handler(&response.Writer{Writer: io.Discard}, &request.Request{RequestLine: request.RequestLine{Method: "GET", RequestTarget: "/empty"}})
+
+	var out strings.Builder
+	_, err := r.WriteTo(&out)
+	require.NoError(t, err)
+	// Test: A handler that writes nothing is counted as 200, never 0
+	assert.Contains(t, out.String(), "\n"+`http_requests_total{method="GET",route="/empty",status="200"} 1`+"\n")
+	assert.NotContains(t, out.String(), `status="0"`)
+}
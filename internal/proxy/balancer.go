@@ -0,0 +1,226 @@
+package proxy
+
+import (
+	"context"
+	"hash/crc32"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type Strategy int
+
+const (
+	RoundRobin Strategy = iota
+	LeastConnections
+	// ConsistentHash maps a key, the HashHeader value or the client IP, to
+	// the same backend for as long as that backend stays available.
+	ConsistentHash
+)
+
+const (
+	defaultMaxFails    = 3
+	defaultFailTimeout = 10 * time.Second
+	virtualNodes       = 100
+)
+
+type Backend struct {
+	URL *url.URL
+
+	unhealthy    atomic.Bool
+	active       atomic.Int64
+	failures     atomic.Int64
+	ejectedUntil atomic.Int64
+}
+
+func (b *Backend) Healthy() bool {
+	return !b.unhealthy.Load()
+}
+
+func (b *Backend) ActiveConnections() int64 {
+	return b.active.Load()
+}
+
+func (b *Backend) available(now time.Time) bool {
+	return b.Healthy() && now.UnixNano() >= b.ejectedUntil.Load()
+}
+
+type ringEntry struct {
+	hash    uint32
+	backend *Backend
+}
+
+type Pool struct {
+	Backends []*Backend
+	Strategy Strategy
+	// HashHeader names the request header used as the ConsistentHash key.
+	// The client IP is used when it is empty or missing from the request.
+	HashHeader string
+	// MaxFails consecutive failures eject a backend for FailTimeout.
+	MaxFails    int
+	FailTimeout time.Duration
+	// Retries is how many other backends are tried when an idempotent
+	// request fails.
+	Retries int
+
+	next     atomic.Uint64
+	ringOnce sync.Once
+	ring     []ringEntry
+}
+
+func NewPool(strategy Strategy, upstreams ...*url.URL) *Pool {
+	pool := &Pool{
+		Strategy:    strategy,
+		MaxFails:    defaultMaxFails,
+		FailTimeout: defaultFailTimeout,
+		Retries:     len(upstreams) - 1,
+	}
+	for _, upstream := range upstreams {
+		pool.Backends = append(pool.Backends, &Backend{URL: upstream})
+	}
+	return pool
+}
+
+func (p *Pool) buildRing() {
+	for _, b := range p.Backends {
+		for i := 0; i < virtualNodes; i++ {
+			hash := crc32.ChecksumIEEE([]byte(b.URL.String() + "#" + strconv.Itoa(i)))
+			p.ring = append(p.ring, ringEntry{hash: hash, backend: b})
+		}
+	}
+	sort.Slice(p.ring, func(i, j int) bool { return p.ring[i].hash < p.ring[j].hash })
+}
+
+// Pick chooses an available backend that is not in tried. It returns nil
+// when every backend is unavailable or already tried.
+func (p *Pool) Pick(key string, tried map[*Backend]bool) *Backend {
+	now := time.Now()
+	usable := func(b *Backend) bool {
+		return !tried[b] && b.available(now)
+	}
+
+	switch p.Strategy {
+	case LeastConnections:
+		var best *Backend
+		start := p.next.Add(1)
+		for i := range p.Backends {
+			b := p.Backends[(start+uint64(i))%uint64(len(p.Backends))]
+			if usable(b) && (best == nil || b.active.Load() < best.active.Load()) {
+				best = b
+			}
+		}
+		return best
+	case ConsistentHash:
+		p.ringOnce.Do(p.buildRing)
+		if len(p.ring) == 0 {
+			return nil
+		}
+		hash := crc32.ChecksumIEEE([]byte(key))
+		start := sort.Search(len(p.ring), func(i int) bool { return p.ring[i].hash >= hash })
+		for i := range p.ring {
+			b := p.ring[(start+i)%len(p.ring)].backend
+			if usable(b) {
+				return b
+			}
+		}
+		return nil
+	default:
+		for range p.Backends {
+			b := p.Backends[(p.next.Add(1)-1)%uint64(len(p.Backends))]
+			if usable(b) {
+				return b
+			}
+		}
+		return nil
+	}
+}
+
+// MarkSuccess resets the passive failure count of b.
+func (p *Pool) MarkSuccess(b *Backend) {
+	b.failures.Store(0)
+}
+
+// MarkFailure records a failed request to b and ejects it once MaxFails
+// consecutive failures have been seen.
+func (p *Pool) MarkFailure(b *Backend) {
+	maxFails := p.MaxFails
+	if maxFails <= 0 {
+		maxFails = defaultMaxFails
+	}
+	if b.failures.Add(1) < int64(maxFails) {
+		return
+	}
+	failTimeout := p.FailTimeout
+	if failTimeout <= 0 {
+		failTimeout = defaultFailTimeout
+	}
+	b.failures.Store(0)
+	b.ejectedUntil.Store(time.Now().Add(failTimeout).UnixNano())
+	log.Printf("ejecting backend %s for %s after %d failures", b.URL, failTimeout, maxFails)
+}
+
+type HealthCheck struct {
+	Path     string
+	Interval time.Duration
+	Timeout  time.Duration
+	Client   *http.Client
+}
+
+// RunHealthChecks probes every backend at hc.Interval until ctx is done. A
+// backend is taken out of rotation when its probe errors or answers with a
+// status outside 2xx and 3xx, and put back once a probe succeeds.
+func (p *Pool) RunHealthChecks(ctx context.Context, hc HealthCheck) {
+	if hc.Interval <= 0 {
+		hc.Interval = 10 * time.Second
+	}
+	if hc.Timeout <= 0 {
+		hc.Timeout = 2 * time.Second
+	}
+	if hc.Client == nil {
+		hc.Client = NewClient(hc.Timeout)
+	}
+
+	ticker := time.NewTicker(hc.Interval)
+	defer ticker.Stop()
+	for {
+		for _, b := range p.Backends {
+			p.probe(ctx, b, hc)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (p *Pool) probe(parent context.Context, b *Backend, hc HealthCheck) {
+	ctx, cancel := context.WithTimeout(parent, hc.Timeout)
+	defer cancel()
+
+	probeURL := *b.URL
+	probeURL.Path = singleJoiningSlash(b.URL.Path, hc.Path)
+	req, err := http.NewRequestWithContext(ctx, "GET", probeURL.String(), nil)
+	if err != nil {
+		log.Printf("could not build health check for %s: %v", b.URL, err)
+		return
+	}
+	healthy := false
+	resp, err := hc.Client.Do(req)
+	if err == nil {
+		resp.Body.Close()
+		healthy = resp.StatusCode >= 200 && resp.StatusCode < 400
+	}
+	if parent.Err() != nil {
+		return
+	}
+	if wasHealthy := b.Healthy(); wasHealthy != healthy {
+		log.Printf("backend %s healthy=%t", b.URL, healthy)
+	}
+	b.unhealthy.Store(!healthy)
+}
@@ -0,0 +1,153 @@
+package proxy
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func backendURLs(n int) []*url.URL {
+	var urls []*url.URL
+	for i := 0; i < n; i++ {
+		urls = append(urls, &url.URL{Scheme: "http", Host: "backend" + strconv.Itoa(i) + ":8080"})
+	}
+	return urls
+}
+
+func TestPool_RoundRobin(t *testing.T) {
+	pool := NewPool(RoundRobin, backendURLs(3)...)
+	var picked []string
+	for i := 0; i < 6; i++ {
+		picked = append(picked, pool.Pick("", nil).URL.Host)
+	}
+	assert.Equal(t, []string{"backend0:8080", "backend1:8080", "backend2:8080", "backend0:8080", "backend1:8080", "backend2:8080"}, picked)
+
+	// Test: Unhealthy and tried backends are skipped
+	pool.Backends[1].unhealthy.Store(true)
+	tried := map[*Backend]bool{pool.Backends[0]: true}
+	for i := 0; i < 3; i++ {
+		assert.Equal(t, pool.Backends[2], pool.Pick("", tried))
+	}
+	tried[pool.Backends[2]] = true
+	assert.Nil(t, pool.Pick("", tried))
+}
+
+func TestPool_LeastConnections(t *testing.T) {
+	pool := NewPool(LeastConnections, backendURLs(3)...)
+	pool.Backends[0].active.Store(5)
+	pool.Backends[1].active.Store(1)
+	pool.Backends[2].active.Store(3)
+	assert.Equal(t, pool.Backends[1], pool.Pick("", nil))
+
+	pool.Backends[1].ejectedUntil.Store(time.Now().Add(time.Minute).UnixNano())
+	assert.Equal(t, pool.Backends[2], pool.Pick("", nil))
+}
+
+func TestPool_ConsistentHash(t *testing.T) {
+	pool := NewPool(ConsistentHash, backendURLs(4)...)
+	first := pool.Pick("client-a", nil)
+	for i := 0; i < 10; i++ {
+		assert.Equal(t, first, pool.Pick("client-a", nil))
+	}
+
+	// Test: Only keys owned by an unavailable backend move
+	owners := make(map[string]*Backend)
+	for i := 0; i < 200; i++ {
+		key := "key" + strconv.Itoa(i)
+		owners[key] = pool.Pick(key, nil)
+	}
+	down := pool.Backends[2]
+	down.unhealthy.Store(true)
+	for key, owner := range owners {
+		b := pool.Pick(key, nil)
+		require.NotNil(t, b)
+		assert.NotEqual(t, down, b)
+		if owner != down {
+			assert.Equal(t, owner, b, key)
+		}
+	}
+}
+
+func TestPool_PassiveFailures(t *testing.T) {
+	pool := NewPool(RoundRobin, backendURLs(2)...)
+	pool.MaxFails = 2
+	b := pool.Backends[0]
+
+	pool.MarkFailure(b)
+	assert.True(t, b.available(time.Now()))
+	pool.MarkSuccess(b)
+	pool.MarkFailure(b)
+	assert.True(t, b.available(time.Now()))
+	pool.MarkFailure(b)
+	assert.False(t, b.available(time.Now()))
+	assert.True(t, b.available(time.Now().Add(pool.FailTimeout)))
+}
+
+func TestReverseProxy_PoolRetries(t *testing.T) {
+	var failingHits, healthyHits atomic.Int64
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		failingHits.Add(1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer failing.Close()
+	healthy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		healthyHits.Add(1)
+		_, _ = w.Write([]byte("ok"))
+	}))
+	defer healthy.Close()
+
+	failingURL, _ := url.Parse(failing.URL)
+	healthyURL, _ := url.Parse(healthy.URL)
+	p := &ReverseProxy{Pool: NewPool(RoundRobin, failingURL, healthyURL), Client: NewClient(time.Second)}
+
+	// Test: Idempotent requests are retried on another backend
+	resp, body := proxyRequest(t, p, "GET / HTTP/1.1\r\nHost: example.com\r\n\r\n")
+	assert.Equal(t, 200, resp.StatusCode)
+	assert.Equal(t, "ok", body)
+	assert.Equal(t, int64(1), failingHits.Load())
+
+	// Test: Non-idempotent requests are not retried
+	p.Pool.next.Store(0)
+	resp, _ = proxyRequest(t, p, "POST / HTTP/1.1\r\nHost: example.com\r\nContent-Length: 0\r\n\r\n")
+	assert.Equal(t, 503, resp.StatusCode)
+	assert.Equal(t, int64(2), failingHits.Load())
+
+	// Test: Every backend down
+	for _, b := range p.Pool.Backends {
+		b.unhealthy.Store(true)
+	}
+	resp, _ = proxyRequest(t, p, "GET / HTTP/1.1\r\nHost: example.com\r\n\r\n")
+	assert.Equal(t, 503, resp.StatusCode)
+}
+
+func TestPool_HealthChecks(t *testing.T) {
+	var up atomic.Bool
+	up.Store(true)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/healthz" || !up.Load() {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer backend.Close()
+	backendURL, _ := url.Parse(backend.URL)
+	pool := NewPool(RoundRobin, backendURL)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go pool.RunHealthChecks(ctx, HealthCheck{Path: "/healthz", Interval: 10 * time.Millisecond})
+
+	up.Store(false)
+	assert.Eventually(t, func() bool { return !pool.Backends[0].Healthy() }, time.Second, 5*time.Millisecond)
+	assert.Nil(t, pool.Pick("", nil))
+
+	up.Store(true)
+	assert.Eventually(t, func() bool { return pool.Backends[0].Healthy() }, time.Second, 5*time.Millisecond)
+}
@@ -0,0 +1,255 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/PeterKWIlliams/http/internal/request"
+	"github.com/PeterKWIlliams/http/internal/response"
+)
+
+const (
+	defaultDialTimeout   = 10 * time.Second
+	defaultTunnelTimeout = 5 * time.Minute
+)
+
+// Allowlist restricts the destinations a ForwardProxy will connect to.
+// Entries have the form host:port, where host may be "*" or start with
+// "*." to match subdomains, and port may be "*".
+type Allowlist struct {
+	rules []allowRule
+}
+
+type allowRule struct {
+	host string
+	port string
+}
+
+func ParseAllowlist(entries ...string) (*Allowlist, error) {
+	allowlist := &Allowlist{}
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		host, port, err := net.SplitHostPort(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid allowlist entry %q: %w", entry, err)
+		}
+		if port != "*" {
+			if n, err := strconv.Atoi(port); err != nil || n <= 0 || n > 65535 {
+				return nil, fmt.Errorf("invalid port in allowlist entry %q", entry)
+			}
+		}
+		allowlist.rules = append(allowlist.rules, allowRule{host: strings.ToLower(host), port: port})
+	}
+	return allowlist, nil
+}
+
+func (a *Allowlist) Allowed(host string, port string) bool {
+	if a == nil {
+		return false
+	}
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	for _, rule := range a.rules {
+		if rule.port != "*" && rule.port != port {
+			continue
+		}
+		switch {
+		case rule.host == "*":
+			return true
+		case strings.HasPrefix(rule.host, "*."):
+			if strings.HasSuffix(host, rule.host[1:]) {
+				return true
+			}
+		case rule.host == host:
+			return true
+		}
+	}
+	return false
+}
+
+// ForwardProxy is an egress proxy handler. CONNECT requests are tunnelled
+// to the destination and absolute-form requests are forwarded upstream.
+// Destinations not in Allow are refused; a nil Allow refuses everything.
+type ForwardProxy struct {
+	Allow       *Allowlist
+	DialTimeout time.Duration
+	// IdleTimeout closes a tunnel when neither side has sent anything for
+	// this long.
+	IdleTimeout time.Duration
+	Client      *http.Client
+}
+
+func (f *ForwardProxy) Serve(w *response.Writer, req *request.Request) {
+	if req.RequestLine.Method == "CONNECT" {
+		f.serveConnect(w, req)
+		return
+	}
+	if !req.RequestLine.IsAbsoluteForm() {
+		writeError(w, response.BadRequest, "forward proxy requires an absolute-form request target")
+		return
+	}
+
+	target, err := url.Parse(req.RequestLine.RequestTarget)
+	if err != nil {
+		writeError(w, response.BadRequest, "invalid request target")
+		return
+	}
+	port := target.Port()
+	if port == "" {
+		port = "80"
+		if target.Scheme == "https" {
+			port = "443"
+		}
+	}
+	if !f.Allow.Allowed(target.Hostname(), port) {
+		log.Printf("forward proxy refused %s from %s", target.Host, req.RemoteAddr)
+		writeError(w, response.Forbidden, "destination not allowed")
+		return
+	}
+
+	client := f.Client
+	if client == nil {
+		client = NewClient(30 * time.Second)
+	}
+	rp := &ReverseProxy{
+		Upstream: &url.URL{Scheme: target.Scheme, Host: target.Host},
+		Client:   client,
+	}
+	rp.Serve(w, req)
+}
+
+func (f *ForwardProxy) serveConnect(w *response.Writer, req *request.Request) {
+	host, port, err := net.SplitHostPort(req.RequestLine.RequestTarget)
+	if err != nil {
+		writeError(w, response.BadRequest, "invalid CONNECT target")
+		return
+	}
+	if !f.Allow.Allowed(host, port) {
+		log.Printf("forward proxy refused CONNECT %s from %s", req.RequestLine.RequestTarget, req.RemoteAddr)
+		writeError(w, response.Forbidden, "destination not allowed")
+		return
+	}
+
+	dialTimeout := f.DialTimeout
+	if dialTimeout <= 0 {
+		dialTimeout = defaultDialTimeout
+	}
+	dialer := &net.Dialer{Timeout: dialTimeout}
+	upstream, err := dialer.DialContext(req.Context(), "tcp", req.RequestLine.RequestTarget)
+	if err != nil {
+		log.Printf("CONNECT %s failed: %v", req.RequestLine.RequestTarget, err)
+		writeError(w, upstreamErrorStatus(err), "could not reach destination")
+		return
+	}
+
+	client, buffered, err := w.Hijack()
+	if err != nil {
+		upstream.Close()
+		log.Printf("could not hijack connection for CONNECT: %v", err)
+		writeError(w, response.InternalServerError, "tunnel unavailable")
+		return
+	}
+	if _, err := io.WriteString(client, "HTTP/1.1 200 Connection Established\r\n\r\n"); err != nil {
+		client.Close()
+		upstream.Close()
+		return
+	}
+	w.SetHijackedStatus(response.OK)
+	if len(buffered) > 0 {
+		if _, err := upstream.Write(buffered); err != nil {
+			client.Close()
+			upstream.Close()
+			return
+		}
+	}
+
+	idleTimeout := f.IdleTimeout
+	if idleTimeout <= 0 {
+		idleTimeout = defaultTunnelTimeout
+	}
+	Tunnel(client, upstream, idleTimeout)
+}
+
+// Tunnel copies bytes in both directions until both sides are done or
+// neither side has sent anything for idleTimeout, then closes both
+// connections.
+func Tunnel(a net.Conn, b net.Conn, idleTimeout time.Duration) {
+	defer a.Close()
+	defer b.Close()
+
+	t := &tunnel{idleTimeout: idleTimeout}
+	t.touch()
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		t.pipe(b, a)
+	}()
+	go func() {
+		defer wg.Done()
+		t.pipe(a, b)
+	}()
+	wg.Wait()
+}
+
+type tunnel struct {
+	idleTimeout  time.Duration
+	lastActivity atomic.Int64
+}
+
+func (t *tunnel) touch() {
+	t.lastActivity.Store(time.Now().UnixNano())
+}
+
+func (t *tunnel) idle() bool {
+	return time.Since(time.Unix(0, t.lastActivity.Load())) >= t.idleTimeout
+}
+
+type closeWriter interface {
+	CloseWrite() error
+}
+
+func (t *tunnel) pipe(dst net.Conn, src net.Conn) {
+	buffer := make([]byte, copyBufferSize)
+	for {
+		src.SetReadDeadline(time.Now().Add(t.idleTimeout))
+		n, err := src.Read(buffer)
+		if n > 0 {
+			t.touch()
+			dst.SetWriteDeadline(time.Now().Add(t.idleTimeout))
+			if _, writeErr := dst.Write(buffer[:n]); writeErr != nil {
+				src.Close()
+				return
+			}
+		}
+		if err != nil {
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				if !t.idle() {
+					continue
+				}
+				dst.Close()
+				src.Close()
+				return
+			}
+			if cw, ok := dst.(closeWriter); ok {
+				cw.CloseWrite()
+			} else {
+				dst.Close()
+			}
+			return
+		}
+	}
+}
@@ -0,0 +1,148 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/PeterKWIlliams/http/internal/request"
+	"github.com/PeterKWIlliams/http/internal/response"
+)
+
+func TestAllowlist(t *testing.T) {
+	allowlist, err := ParseAllowlist("github.com:443", "*.golang.org:443", "10.0.0.5:*")
+	require.NoError(t, err)
+
+	assert.True(t, allowlist.Allowed("github.com", "443"))
+	assert.True(t, allowlist.Allowed("GitHub.com.", "443"))
+	assert.False(t, allowlist.Allowed("github.com", "80"))
+	assert.True(t, allowlist.Allowed("proxy.golang.org", "443"))
+	assert.False(t, allowlist.Allowed("golang.org", "443"))
+	assert.False(t, allowlist.Allowed("evilgolang.org", "443"))
+	assert.True(t, allowlist.Allowed("10.0.0.5", "22"))
+
+	var nilAllowlist *Allowlist
+	assert.False(t, nilAllowlist.Allowed("github.com", "443"))
+
+	_, err = ParseAllowlist("github.com")
+	assert.Error(t, err)
+	_, err = ParseAllowlist("github.com:http")
+	assert.Error(t, err)
+}
+
+func echoServer(t *testing.T) net.Listener {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				_, _ = io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return l
+}
+
+func TestForwardProxy_Connect(t *testing.T) {
+	echo := echoServer(t)
+	defer echo.Close()
+
+	allowlist, err := ParseAllowlist("127.0.0.1:*")
+	require.NoError(t, err)
+	fp := &ForwardProxy{Allow: allowlist, IdleTimeout: time.Second}
+
+	req, err := request.RequestFromReader(strings.NewReader("CONNECT " + echo.Addr().String() + " HTTP/1.1\r\nHost: " + echo.Addr().String() + "\r\n\r\n"))
+	require.NoError(t, err)
+
+	clientConn, serverConn := net.Pipe()
+	w := &response.Writer{Writer: serverConn}
+	done := make(chan struct{})
+	go func() {
+		fp.Serve(w, req)
+		close(done)
+	}()
+
+	reader := bufio.NewReader(clientConn)
+	statusLine, err := reader.ReadString('\n')
+	require.NoError(t, err)
+	assert.Equal(t, "HTTP/1.1 200 Connection Established\r\n", statusLine)
+	blank, err := reader.ReadString('\n')
+	require.NoError(t, err)
+	assert.Equal(t, "\r\n", blank)
+	assert.True(t, w.Hijacked())
+
+	_, err = clientConn.Write([]byte("ping"))
+	require.NoError(t, err)
+	buf := make([]byte, 4)
+	_, err = io.ReadFull(reader, buf)
+	require.NoError(t, err)
+	assert.Equal(t, "ping", string(buf))
+
+	clientConn.Close()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("tunnel did not shut down after the client closed")
+	}
+	assert.Equal(t, response.OK, w.StatusCode())
+}
+
+func TestForwardProxy_Refused(t *testing.T) {
+	allowlist, err := ParseAllowlist("example.com:443")
+	require.NoError(t, err)
+	fp := &ForwardProxy{Allow: allowlist}
+
+	for _, raw := range []string{
+		"CONNECT 127.0.0.1:22 HTTP/1.1\r\nHost: 127.0.0.1:22\r\n\r\n",
+		"GET http://example.com/ HTTP/1.1\r\nHost: example.com\r\n\r\n",
+	} {
+		req, err := request.RequestFromReader(strings.NewReader(raw))
+		require.NoError(t, err)
+		var out bytes.Buffer
+		fp.Serve(&response.Writer{Writer: &out}, req)
+		assert.True(t, strings.HasPrefix(out.String(), "HTTP/1.1 403 "), raw)
+	}
+}
+
+func TestForwardProxy_AbsoluteForm(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("hello from " + r.URL.RequestURI()))
+	}))
+	defer upstream.Close()
+
+	allowlist, err := ParseAllowlist("127.0.0.1:*")
+	require.NoError(t, err)
+	fp := &ForwardProxy{Allow: allowlist}
+
+	// Test: The scheme is matched case-insensitively
+	for _, scheme := range []string{"http", "HTTP"} {
+		req, err := request.RequestFromReader(strings.NewReader("GET " + scheme + strings.TrimPrefix(upstream.URL, "http") + "/path?q=1 HTTP/1.1\r\nHost: " + strings.TrimPrefix(upstream.URL, "http://") + "\r\nProxy-Connection: keep-alive\r\n\r\n"))
+		require.NoError(t, err)
+		var out bytes.Buffer
+		w := &response.Writer{Writer: &out}
+		fp.Serve(w, req)
+		require.NoError(t, w.Finish())
+
+		httpResp, err := http.ReadResponse(bufio.NewReader(&out), nil)
+		require.NoError(t, err)
+		data, err := io.ReadAll(httpResp.Body)
+		require.NoError(t, err)
+		assert.Equal(t, 200, httpResp.StatusCode, scheme)
+		assert.Equal(t, "hello from /path?q=1", string(data), scheme)
+	}
+}
@@ -0,0 +1,381 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/PeterKWIlliams/http/internal/headers"
+	"github.com/PeterKWIlliams/http/internal/request"
+	"github.com/PeterKWIlliams/http/internal/response"
+	"github.com/PeterKWIlliams/http/internal/server"
+)
+
+const copyBufferSize = 32 * 1024
+
+// Hop-by-hop fields from RFC 9110 section 7.6.1 that describe a single
+// connection and must not be forwarded.
+var hopByHopHeaders = []string{
+	"connection",
+	"keep-alive",
+	"proxy-authenticate",
+	"proxy-authorization",
+	"proxy-connection",
+	"te",
+	"trailer",
+	"transfer-encoding",
+	"upgrade",
+}
+
+type ReverseProxy struct {
+	Upstream *url.URL
+	// Pool, when set, replaces Upstream with a set of load balanced
+	// backends.
+	Pool *Pool
+	// StripPrefix is removed from the request path before it is appended
+	// to the upstream path.
+	StripPrefix string
+	// PreserveHost forwards the client's Host header instead of the
+	// upstream's host.
+	PreserveHost bool
+	Client       *http.Client
+}
+
+func New(upstream *url.URL) *ReverseProxy {
+	return &ReverseProxy{
+		Upstream: upstream,
+		Client:   NewClient(30 * time.Second),
+	}
+}
+
+// NewClient returns a client suited to proxying: it never follows
+// redirects and never decodes bodies on the caller's behalf. The timeout
+// bounds the wait for response headers only, so long streams still work.
+func NewClient(timeout time.Duration) *http.Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DisableCompression = true
+	transport.ResponseHeaderTimeout = timeout
+	return &http.Client{
+		Transport: transport,
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
+
+func (p *ReverseProxy) Serve(w *response.Writer, req *request.Request) {
+	if p.Pool != nil {
+		p.serveFromPool(w, req)
+		return
+	}
+
+	outReq, err := p.outgoingRequest(req, p.Upstream)
+	if err != nil {
+		log.Printf("could not build upstream request for %s: %v", req.RequestLine.RequestTarget, err)
+		writeError(w, response.BadRequest, "invalid request target")
+		return
+	}
+	resp, err := p.client().Do(outReq)
+	if err != nil {
+		log.Printf("upstream request to %s failed: %v", outReq.URL, err)
+		writeError(w, upstreamErrorStatus(err), "upstream request failed")
+		return
+	}
+	defer resp.Body.Close()
+
+	if err := CopyResponse(w, req, resp); err != nil {
+		log.Printf("error proxying response from %s: %v", outReq.URL, err)
+	}
+}
+
+func (p *ReverseProxy) serveFromPool(w *response.Writer, req *request.Request) {
+	key := req.RemoteAddr
+	if host, _, err := net.SplitHostPort(req.RemoteAddr); err == nil {
+		key = host
+	}
+	if p.Pool.HashHeader != "" {
+		if value, err := req.Headers.Get(p.Pool.HashHeader); err == nil && value != "" {
+			key = value
+		}
+	}
+
+	attempts := 1
+	if idempotentMethods[req.RequestLine.Method] {
+		attempts += max(p.Pool.Retries, 0)
+	}
+	tried := make(map[*Backend]bool)
+	lastStatus := response.ServiceUnavailable
+	for attempt := 0; attempt < attempts; attempt++ {
+		backend := p.Pool.Pick(key, tried)
+		if backend == nil {
+			break
+		}
+		tried[backend] = true
+
+		outReq, err := p.outgoingRequest(req, backend.URL)
+		if err != nil {
+			log.Printf("could not build upstream request for %s: %v", req.RequestLine.RequestTarget, err)
+			writeError(w, response.BadRequest, "invalid request target")
+			return
+		}
+		backend.active.Add(1)
+		resp, err := p.client().Do(outReq)
+		if err != nil && req.Context().Err() != nil {
+			// The client went away or the server is closing; that says
+			// nothing about the backend.
+			backend.active.Add(-1)
+			return
+		}
+		if err != nil {
+			backend.active.Add(-1)
+			p.Pool.MarkFailure(backend)
+			lastStatus = upstreamErrorStatus(err)
+			log.Printf("upstream request to %s failed (attempt %d/%d): %v", outReq.URL, attempt+1, attempts, err)
+			continue
+		}
+		if retryableStatus(resp.StatusCode) && attempt+1 < attempts {
+			resp.Body.Close()
+			backend.active.Add(-1)
+			p.Pool.MarkFailure(backend)
+			lastStatus = response.StatusCode(resp.StatusCode)
+			log.Printf("upstream %s answered %d (attempt %d/%d)", outReq.URL, resp.StatusCode, attempt+1, attempts)
+			continue
+		}
+		if retryableStatus(resp.StatusCode) {
+			p.Pool.MarkFailure(backend)
+		} else {
+			p.Pool.MarkSuccess(backend)
+		}
+
+		err = CopyResponse(w, req, resp)
+		resp.Body.Close()
+		backend.active.Add(-1)
+		if err != nil {
+			log.Printf("error proxying response from %s: %v", outReq.URL, err)
+		}
+		return
+	}
+	writeError(w, lastStatus, "no upstream available")
+}
+
+var idempotentMethods = map[string]bool{
+	"GET":     true,
+	"HEAD":    true,
+	"OPTIONS": true,
+	"PUT":     true,
+	"DELETE":  true,
+	"TRACE":   true,
+}
+
+func retryableStatus(statusCode int) bool {
+	return statusCode == 502 || statusCode == 503 || statusCode == 504
+}
+
+func upstreamErrorStatus(err error) response.StatusCode {
+	var netErr net.Error
+	if errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &netErr) && netErr.Timeout()) {
+		return response.GatewayTimeout
+	}
+	return response.BadGateway
+}
+
+func (p *ReverseProxy) client() *http.Client {
+	if p.Client == nil {
+		return http.DefaultClient
+	}
+	return p.Client
+}
+
+func (p *ReverseProxy) outgoingRequest(req *request.Request, upstream *url.URL) (*http.Request, error) {
+	target, err := url.ParseRequestURI(req.RequestLine.RequestTarget)
+	if err != nil {
+		return nil, err
+	}
+	// The path is joined in its escaped form so that escapes such as %2F
+	// and %3F reach the upstream unchanged.
+	targetPath := target.EscapedPath()
+	if p.StripPrefix != "" {
+		targetPath = strings.TrimPrefix(targetPath, p.StripPrefix)
+	}
+
+	outURL := *upstream
+	outURL.RawPath = singleJoiningSlash(upstream.EscapedPath(), targetPath)
+	if outURL.Path, err = url.PathUnescape(outURL.RawPath); err != nil {
+		return nil, err
+	}
+	outURL.RawQuery = target.RawQuery
+	if upstream.RawQuery != "" {
+		if outURL.RawQuery == "" {
+			outURL.RawQuery = upstream.RawQuery
+		} else {
+			outURL.RawQuery = upstream.RawQuery + "&" + target.RawQuery
+		}
+	}
+
+	outReq, err := http.NewRequestWithContext(req.Context(), req.RequestLine.Method, outURL.String(), bytes.NewReader(req.Body))
+	if err != nil {
+		return nil, err
+	}
+	outReq.ContentLength = int64(len(req.Body))
+
+	outHeaders := req.Headers.Clone()
+	RemoveHopByHopHeaders(outHeaders)
+	host, _ := outHeaders.Get("host")
+	outHeaders.Delete("host")
+	outHeaders.Delete("content-length")
+	scheme := req.Scheme
+	if scheme == "" {
+		scheme = "http"
+	}
+	AddForwardedHeaders(outHeaders, req.RemoteAddr, host, scheme)
+	for fieldName, fieldValue := range outHeaders {
+		outReq.Header.Set(fieldName, fieldValue)
+	}
+	if p.PreserveHost && host != "" {
+		outReq.Host = host
+	}
+	return outReq, nil
+}
+
+// CopyResponse writes an upstream response back to the client, preserving
+// its status and end-to-end headers and streaming the body.
+func CopyResponse(w *response.Writer, req *request.Request, resp *http.Response) error {
+	resHeaders := headers.NewHeaders()
+	for fieldName, values := range resp.Header {
+		for _, value := range values {
+			resHeaders.Add(fieldName, value)
+		}
+	}
+	RemoveHopByHopHeaders(resHeaders)
+	resHeaders.Set("connection", "close")
+
+	bodyless := req.RequestLine.Method == "HEAD" || resp.StatusCode == 204 || resp.StatusCode == 304
+	if resp.ContentLength >= 0 {
+		resHeaders.Set("content-length", strconv.FormatInt(resp.ContentLength, 10))
+	} else if !bodyless {
+		resHeaders.Set("transfer-encoding", "chunked")
+	}
+
+	if err := w.WriteStatusLine(response.StatusCode(resp.StatusCode)); err != nil {
+		return fmt.Errorf("could not write status line: %w", err)
+	}
+	if err := w.WriteHeaders(resHeaders); err != nil {
+		return fmt.Errorf("could not write headers: %w", err)
+	}
+	if bodyless {
+		return nil
+	}
+
+	buffer := make([]byte, copyBufferSize)
+	for {
+		n, err := resp.Body.Read(buffer)
+		if n > 0 {
+			if _, writeErr := w.WriteBody(buffer[:n]); writeErr != nil {
+				return writeErr
+			}
+			if flushErr := w.Flush(); flushErr != nil {
+				return flushErr
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("error reading upstream body: %w", err)
+		}
+	}
+}
+
+// RemoveHopByHopHeaders deletes the standard hop-by-hop fields along with
+// any field named in the Connection header.
+func RemoveHopByHopHeaders(h headers.Headers) {
+	if connection, err := h.Get("connection"); err == nil {
+		for _, fieldName := range strings.Split(connection, ",") {
+			if fieldName = strings.TrimSpace(fieldName); fieldName != "" {
+				h.Delete(fieldName)
+			}
+		}
+	}
+	for _, fieldName := range hopByHopHeaders {
+		h.Delete(fieldName)
+	}
+}
+
+// AddForwardedHeaders appends the client to X-Forwarded-For and Forwarded
+// and records the original host and scheme. X-Forwarded-Host and
+// X-Forwarded-Proto are always replaced, as a client could otherwise
+// choose them; behind TrustProxies, host and proto already carry what a
+// trusted proxy reported.
+func AddForwardedHeaders(h headers.Headers, remoteAddr string, host string, proto string) {
+	clientIP, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		clientIP = remoteAddr
+	}
+	if clientIP == "" {
+		return
+	}
+
+	if xff, err := h.Get("x-forwarded-for"); err == nil && xff != "" {
+		h.Set("x-forwarded-for", xff+", "+clientIP)
+	} else {
+		h.Set("x-forwarded-for", clientIP)
+	}
+
+	forNode := clientIP
+	if strings.Contains(clientIP, ":") {
+		forNode = `"[` + clientIP + `]"`
+	}
+	element := "for=" + forNode
+	if host != "" {
+		element += ";host=" + quoteForwarded(host)
+	}
+	element += ";proto=" + proto
+	if forwarded, err := h.Get("forwarded"); err == nil && forwarded != "" {
+		h.Set("forwarded", forwarded+", "+element)
+	} else {
+		h.Set("forwarded", element)
+	}
+
+	if host != "" {
+		h.Set("x-forwarded-host", host)
+	} else {
+		h.Delete("x-forwarded-host")
+	}
+	h.Set("x-forwarded-proto", proto)
+}
+
+func quoteForwarded(value string) string {
+	for _, r := range value {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || strings.ContainsRune("!#$%&'*+-.^_`|~", r)) {
+			return strconv.Quote(value)
+		}
+	}
+	return value
+}
+
+func singleJoiningSlash(a, b string) string {
+	aslash := strings.HasSuffix(a, "/")
+	bslash := strings.HasPrefix(b, "/")
+	switch {
+	case aslash && bslash:
+		return a + b[1:]
+	case !aslash && !bslash:
+		return a + "/" + b
+	}
+	return a + b
+}
+
+func writeError(w *response.Writer, statusCode response.StatusCode, message string) {
+	if err := server.WriteError(w, statusCode, message); err != nil {
+		log.Printf("could not write proxy error response: %v", err)
+	}
+}
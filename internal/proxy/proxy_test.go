@@ -0,0 +1,201 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/PeterKWIlliams/http/internal/cidr"
+	"github.com/PeterKWIlliams/http/internal/request"
+	"github.com/PeterKWIlliams/http/internal/response"
+)
+
+func proxyRequest(t *testing.T, p *ReverseProxy, raw string) (*http.Response, string) {
+	t.Helper()
+	req, err := request.RequestFromReader(strings.NewReader(raw))
+	require.NoError(t, err)
+	req.RemoteAddr = "203.0.113.7:51234"
+
+	var out bytes.Buffer
+	w := &response.Writer{Writer: &out}
+	p.Serve(w, req)
+	require.NoError(t, w.Finish())
+
+	resp, err := http.ReadResponse(bufio.NewReader(&out), nil)
+	require.NoError(t, err)
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	return resp, string(body)
+}
+
+func TestReverseProxy(t *testing.T) {
+	var seen *http.Request
+	var seenBody []byte
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen = r
+		seenBody, _ = io.ReadAll(r.Body)
+		w.Header().Set("X-Upstream", "yes")
+		w.Header().Set("Keep-Alive", "timeout=5")
+		w.WriteHeader(http.StatusCreated)
+		_, _ = w.Write([]byte("created " + r.URL.RequestURI()))
+	}))
+	defer upstream.Close()
+
+	upstreamURL, err := url.Parse(upstream.URL + "/base")
+	require.NoError(t, err)
+	p := New(upstreamURL)
+	p.StripPrefix = "/api"
+
+	body := `{"name":"widget"}`
+	resp, respBody := proxyRequest(t, p, "POST /api/items?sort=asc HTTP/1.1\r\n"+
+		"Host: example.com\r\n"+
+		"Content-Length: "+strconv.Itoa(len(body))+"\r\n"+
+		"Connection: close, X-Secret\r\n"+
+		"X-Secret: hop\r\n"+
+		"X-Custom: kept\r\n"+
+		"X-Forwarded-For: 198.51.100.1\r\n"+
+		"\r\n"+body)
+
+	require.NotNil(t, seen)
+	assert.Equal(t, "POST", seen.Method)
+	assert.Equal(t, "/base/items?sort=asc", seen.URL.RequestURI())
+	assert.Equal(t, body, string(seenBody))
+	assert.Equal(t, "kept", seen.Header.Get("X-Custom"))
+	assert.Empty(t, seen.Header.Get("X-Secret"))
+	assert.Equal(t, "198.51.100.1, 203.0.113.7", seen.Header.Get("X-Forwarded-For"))
+	assert.Equal(t, "for=203.0.113.7;host=example.com;proto=http", seen.Header.Get("Forwarded"))
+	assert.Equal(t, "example.com", seen.Header.Get("X-Forwarded-Host"))
+	assert.Equal(t, strings.TrimPrefix(upstream.URL, "http://"), seen.Host)
+
+	assert.Equal(t, 201, resp.StatusCode)
+	assert.Equal(t, "yes", resp.Header.Get("X-Upstream"))
+	assert.Empty(t, resp.Header.Get("Keep-Alive"))
+	assert.Equal(t, "created /base/items?sort=asc", respBody)
+}
+
+func TestReverseProxy_SetCookie(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Set-Cookie", "session=abc; Expires=Wed, 21 Oct 2026 07:28:00 GMT")
+		w.Header().Add("Set-Cookie", "theme=dark")
+	}))
+	defer upstream.Close()
+
+	upstreamURL, err := url.Parse(upstream.URL)
+	require.NoError(t, err)
+	resp, _ := proxyRequest(t, New(upstreamURL), "GET / HTTP/1.1\r\nHost: example.com\r\n\r\n")
+	assert.Equal(t, []string{"session=abc; Expires=Wed, 21 Oct 2026 07:28:00 GMT", "theme=dark"}, resp.Header.Values("Set-Cookie"))
+}
+
+func TestReverseProxy_EscapedPath(t *testing.T) {
+	var seen string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen = r.RequestURI
+	}))
+	defer upstream.Close()
+
+	upstreamURL, err := url.Parse(upstream.URL + "/base")
+	require.NoError(t, err)
+	p := New(upstreamURL)
+	p.StripPrefix = "/api"
+	resp, _ := proxyRequest(t, p, "GET /api/a%2Fb%3Fc%20d?q=1 HTTP/1.1\r\nHost: example.com\r\n\r\n")
+	assert.Equal(t, 200, resp.StatusCode)
+	assert.Equal(t, "/base/a%2Fb%3Fc%20d?q=1", seen)
+}
+
+func TestReverseProxy_ForwardedHostAndProto(t *testing.T) {
+	var seen *http.Request
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen = r
+	}))
+	defer upstream.Close()
+
+	upstreamURL, err := url.Parse(upstream.URL)
+	require.NoError(t, err)
+	p := New(upstreamURL)
+	raw := "GET / HTTP/1.1\r\nHost: example.com\r\n" +
+		"X-Forwarded-For: 192.0.2.9\r\nX-Forwarded-Host: evil.example\r\nX-Forwarded-Proto: https\r\n\r\n"
+
+	// Test: Values from an untrusted client are replaced
+	proxyRequest(t, p, raw)
+	require.NotNil(t, seen)
+	assert.Equal(t, "example.com", seen.Header.Get("X-Forwarded-Host"))
+	assert.Equal(t, "http", seen.Header.Get("X-Forwarded-Proto"))
+
+	// Test: Behind TrustProxies, what a trusted proxy reported is kept
+	trusted, err := cidr.ParseList("203.0.113.0/24")
+	require.NoError(t, err)
+	req, err := request.RequestFromReader(strings.NewReader(raw))
+	require.NoError(t, err)
+	req.RemoteAddr = "203.0.113.7:51234"
+	w := &response.Writer{Writer: io.Discard}
+	TrustProxies(trusted)(p.Serve)(w, req)
+	require.NoError(t, w.Finish())
+	assert.Equal(t, "evil.example", seen.Header.Get("X-Forwarded-Host"))
+	assert.Equal(t, "https", seen.Header.Get("X-Forwarded-Proto"))
+}
+
+func TestReverseProxy_Methods(t *testing.T) {
+	var seen []string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen = append(seen, r.Method)
+	}))
+	defer upstream.Close()
+
+	upstreamURL, err := url.Parse(upstream.URL)
+	require.NoError(t, err)
+	p := New(upstreamURL)
+	for _, method := range []string{"PATCH", "OPTIONS"} {
+		resp, _ := proxyRequest(t, p, method+" /items/1 HTTP/1.1\r\nHost: example.com\r\nContent-Length: 0\r\n\r\n")
+		assert.Equal(t, 200, resp.StatusCode, method)
+	}
+	assert.Equal(t, []string{"PATCH", "OPTIONS"}, seen)
+}
+
+func TestReverseProxy_Streaming(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for i := 0; i < 3; i++ {
+			_, _ = w.Write([]byte("part" + strconv.Itoa(i) + ";"))
+			w.(http.Flusher).Flush()
+		}
+	}))
+	defer upstream.Close()
+
+	upstreamURL, err := url.Parse(upstream.URL)
+	require.NoError(t, err)
+	resp, body := proxyRequest(t, New(upstreamURL), "GET /stream HTTP/1.1\r\nHost: example.com\r\n\r\n")
+	assert.Equal(t, 200, resp.StatusCode)
+	assert.Equal(t, []string{"chunked"}, resp.TransferEncoding)
+	assert.Equal(t, "part0;part1;part2;", body)
+}
+
+func TestReverseProxy_UpstreamErrors(t *testing.T) {
+	// Test: Upstream refuses connections
+	upstream := httptest.NewServer(http.NotFoundHandler())
+	upstreamURL, err := url.Parse(upstream.URL)
+	require.NoError(t, err)
+	upstream.Close()
+	resp, _ := proxyRequest(t, New(upstreamURL), "GET / HTTP/1.1\r\nHost: example.com\r\n\r\n")
+	assert.Equal(t, 502, resp.StatusCode)
+
+	// Test: Upstream too slow to answer
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(200 * time.Millisecond)
+	}))
+	defer slow.Close()
+	slowURL, err := url.Parse(slow.URL)
+	require.NoError(t, err)
+	p := New(slowURL)
+	p.Client = NewClient(20 * time.Millisecond)
+	resp, _ = proxyRequest(t, p, "GET / HTTP/1.1\r\nHost: example.com\r\n\r\n")
+	assert.Equal(t, 504, resp.StatusCode)
+}
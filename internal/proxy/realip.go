@@ -0,0 +1,203 @@
+package proxy
+
+import (
+	"net"
+	"net/netip"
+	"strings"
+
+	"github.com/PeterKWIlliams/http/internal/cidr"
+	"github.com/PeterKWIlliams/http/internal/headers"
+	"github.com/PeterKWIlliams/http/internal/request"
+	"github.com/PeterKWIlliams/http/internal/response"
+	"github.com/PeterKWIlliams/http/internal/server"
+)
+
+// forwardingHeaders are the headers proxies use to describe the client.
+var forwardingHeaders = []string{"forwarded", "x-forwarded-for", "x-forwarded-proto", "x-forwarded-host"}
+
+// TrustProxies resolves the real client of requests that reach the server
+// through the proxies in trusted. The Forwarded header, or failing that
+// X-Forwarded-For, is walked right to left past trusted addresses, and the
+// first untrusted one becomes the request's RemoteAddr, with the scheme and
+// Host reported for it. Requests from untrusted peers have these headers
+// removed, so values a client made up are never acted on or passed on.
+//
+// Single X-Forwarded-Proto and X-Forwarded-Host values are taken to be set
+// by the nearest proxy; lists are matched to X-Forwarded-For by position.
+func TrustProxies(trusted []netip.Prefix) server.Middleware {
+	return func(next server.Handler) server.Handler {
+		return func(w *response.Writer, req *request.Request) {
+			next(w, resolveClient(req, trusted))
+		}
+	}
+}
+
+// A hop is one proxy's account of who it received the request from.
+type hop struct {
+	node  string
+	proto string
+	host  string
+}
+
+func resolveClient(req *request.Request, trusted []netip.Prefix) *request.Request {
+	r := *req
+	r.Headers = req.Headers.Clone()
+	peer, _, ok := parseNode(req.RemoteAddr)
+	if !ok || !cidr.Contains(trusted, peer) {
+		for _, name := range forwardingHeaders {
+			r.Headers.Delete(name)
+		}
+		return &r
+	}
+
+	hops := forwardedHops(r.Headers)
+	client := -1
+	for i := len(hops) - 1; i >= 0; i-- {
+		ip, _, ok := parseNode(hops[i].node)
+		if !ok {
+			// Obfuscated or unknown; nothing further left can be
+			// verified.
+			break
+		}
+		client = i
+		if !cidr.Contains(trusted, ip) {
+			break
+		}
+	}
+	if client < 0 {
+		return &r
+	}
+
+	h := hops[client]
+	ip, port, _ := parseNode(h.node)
+	if port == "" {
+		port = "0"
+	}
+	r.RemoteAddr = net.JoinHostPort(ip.String(), port)
+	if proto := strings.ToLower(h.proto); proto == "http" || proto == "https" {
+		r.Scheme = proto
+	}
+	if h.host != "" && !strings.ContainsAny(h.host, " \t/\\@") {
+		r.Headers.Set("host", h.host)
+	}
+	return &r
+}
+
+func forwardedHops(h headers.Headers) []hop {
+	if v, err := h.Get("forwarded"); err == nil && v != "" {
+		var hops []hop
+		for _, elem := range parseForwarded(v) {
+			hops = append(hops, hop{node: elem["for"], proto: elem["proto"], host: elem["host"]})
+		}
+		return hops
+	}
+	v, err := h.Get("x-forwarded-for")
+	if err != nil || v == "" {
+		return nil
+	}
+	nodes := splitList(v)
+	protos := forwardedList(h, "x-forwarded-proto", len(nodes))
+	hosts := forwardedList(h, "x-forwarded-host", len(nodes))
+	hops := make([]hop, len(nodes))
+	for i, node := range nodes {
+		hops[i] = hop{node: node, proto: protos[i], host: hosts[i]}
+	}
+	return hops
+}
+
+// forwardedList returns the values of an X-Forwarded-* header lined up
+// with n X-Forwarded-For entries. A single value applies to all of them.
+func forwardedList(h headers.Headers, name string, n int) []string {
+	out := make([]string, n)
+	v, err := h.Get(name)
+	if err != nil {
+		return out
+	}
+	values := splitList(v)
+	switch len(values) {
+	case 1:
+		for i := range out {
+			out[i] = values[0]
+		}
+	case n:
+		copy(out, values)
+	}
+	return out
+}
+
+func splitList(v string) []string {
+	var out []string
+	for _, part := range strings.Split(v, ",") {
+		out = append(out, strings.TrimSpace(part))
+	}
+	return out
+}
+
+// parseForwarded splits an RFC 7239 Forwarded value into its elements'
+// lowercased parameters, unquoting quoted strings.
+func parseForwarded(v string) []map[string]string {
+	var elems []map[string]string
+	elem := map[string]string{}
+	for i := 0; i < len(v); {
+		switch v[i] {
+		case ' ', '\t', ';':
+			i++
+			continue
+		case ',':
+			elems = append(elems, elem)
+			elem = map[string]string{}
+			i++
+			continue
+		}
+		j := i
+		for j < len(v) && v[j] != '=' && v[j] != ';' && v[j] != ',' {
+			j++
+		}
+		key := strings.ToLower(strings.TrimSpace(v[i:j]))
+		if j == len(v) || v[j] != '=' {
+			i = j
+			continue
+		}
+		j++
+		var value string
+		if j < len(v) && v[j] == '"' {
+			var b strings.Builder
+			for j++; j < len(v) && v[j] != '"'; j++ {
+				if v[j] == '\\' && j+1 < len(v) {
+					j++
+				}
+				b.WriteByte(v[j])
+			}
+			j++
+			value = b.String()
+		} else {
+			k := j
+			for k < len(v) && v[k] != ';' && v[k] != ',' {
+				k++
+			}
+			value = strings.TrimSpace(v[j:k])
+			j = k
+		}
+		elem[key] = value
+		i = j
+	}
+	return append(elems, elem)
+}
+
+// parseNode parses an address as found in RemoteAddr, X-Forwarded-For or
+// a Forwarded "for" parameter: an IP with an optional port, IPv6
+// addresses with a port being bracketed.
+func parseNode(node string) (netip.Addr, string, bool) {
+	host, port := node, ""
+	if strings.HasPrefix(node, "[") || strings.Count(node, ":") == 1 {
+		var err error
+		if host, port, err = net.SplitHostPort(node); err != nil {
+			host, port = strings.Trim(node, "[]"), ""
+		}
+	}
+	ip, err := netip.ParseAddr(host)
+	if err != nil || ip.Zone() != "" {
+		return netip.Addr{}, "", false
+	}
+	return ip.Unmap(), port, true
+}
@@ -0,0 +1,115 @@
+package proxy
+
+import (
+	"net/netip"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/PeterKWIlliams/http/internal/headers"
+	"github.com/PeterKWIlliams/http/internal/request"
+	"github.com/PeterKWIlliams/http/internal/response"
+	"github.com/PeterKWIlliams/http/internal/server"
+)
+
+func TestTrustProxies(t *testing.T) {
+	trusted := []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8"), netip.MustParsePrefix("2001:db8:ffff::/48")}
+	tests := []struct {
+		name       string
+		remoteAddr string
+		headers    map[string]string
+		wantAddr   string
+		wantScheme string
+		wantHost   string
+	}{
+		{
+			name:       "X-Forwarded-For through two proxies",
+			remoteAddr: "10.0.0.2:4000",
+			headers:    map[string]string{"x-forwarded-for": "198.51.100.9, 10.0.0.1", "x-forwarded-proto": "https", "x-forwarded-host": "example.com"},
+			wantAddr:   "198.51.100.9:0",
+			wantScheme: "https",
+			wantHost:   "example.com",
+		},
+		{
+			name:       "spoofed entries left of the client are ignored",
+			remoteAddr: "10.0.0.2:4000",
+			headers:    map[string]string{"x-forwarded-for": "1.2.3.4, 198.51.100.9"},
+			wantAddr:   "198.51.100.9:0",
+			wantScheme: "http",
+			wantHost:   "internal",
+		},
+		{
+			name:       "positional X-Forwarded-Proto",
+			remoteAddr: "10.0.0.2:4000",
+			headers:    map[string]string{"x-forwarded-for": "198.51.100.9, 10.0.0.1", "x-forwarded-proto": "https, http"},
+			wantAddr:   "198.51.100.9:0",
+			wantScheme: "https",
+			wantHost:   "internal",
+		},
+		{
+			name:       "Forwarded is preferred and unquoted",
+			remoteAddr: "10.0.0.2:4000",
+			headers: map[string]string{
+				"forwarded":       `for="[2001:db8::9]:5555";proto=https;host="a.example:8443";note="x, y", for=10.0.0.1`,
+				"x-forwarded-for": "203.0.113.1",
+			},
+			wantAddr:   "[2001:db8::9]:5555",
+			wantScheme: "https",
+			wantHost:   "a.example:8443",
+		},
+		{
+			name:       "all hops trusted gives the leftmost",
+			remoteAddr: "[2001:db8:ffff::1]:443",
+			headers:    map[string]string{"forwarded": "for=10.0.0.7, for=10.0.0.1"},
+			wantAddr:   "10.0.0.7:0",
+			wantScheme: "http",
+			wantHost:   "internal",
+		},
+		{
+			name:       "obfuscated hop stops the walk",
+			remoteAddr: "10.0.0.2:4000",
+			headers:    map[string]string{"forwarded": "for=198.51.100.9, for=_hidden, for=10.0.0.1"},
+			wantAddr:   "10.0.0.1:0",
+			wantScheme: "http",
+			wantHost:   "internal",
+		},
+		{
+			name:       "untrusted peer",
+			remoteAddr: "198.51.100.9:4000",
+			headers:    map[string]string{"x-forwarded-for": "1.2.3.4", "x-forwarded-proto": "https", "forwarded": "for=1.2.3.4"},
+			wantAddr:   "198.51.100.9:4000",
+			wantScheme: "http",
+			wantHost:   "internal",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := headers.NewHeaders()
+			h.Set("host", "internal")
+			for name, value := range tt.headers {
+				h.Set(name, value)
+			}
+			req := &request.Request{Headers: h, RemoteAddr: tt.remoteAddr, Scheme: "http"}
+
+			var got *request.Request
+			handler := server.Chain(func(w *response.Writer, req *request.Request) {
+				got = req
+			}, TrustProxies(trusted))
+			handler(&response.Writer{}, req)
+
+			assert.Equal(t, tt.wantAddr, got.RemoteAddr)
+			assert.Equal(t, tt.wantScheme, got.Scheme)
+			host, _ := got.Headers.Get("host")
+			assert.Equal(t, tt.wantHost, host)
+			if tt.wantAddr == tt.remoteAddr {
+				// Test: Forwarding headers from untrusted peers are dropped
+				for _, name := range forwardingHeaders {
+					_, err := got.Headers.Get(name)
+					assert.Error(t, err, name)
+				}
+			}
+			// Test: The original request is left alone
+			assert.Equal(t, tt.remoteAddr, req.RemoteAddr)
+		})
+	}
+}
@@ -0,0 +1,315 @@
+// Package proxyproto reads HAProxy PROXY protocol headers (versions 1 and
+// 2) from connections accepted behind a layer 4 load balancer, so that
+// the server sees the original client address instead of the balancer's.
+package proxyproto
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/PeterKWIlliams/http/internal/cidr"
+)
+
+const DefaultHeaderTimeout = 5 * time.Second
+
+const (
+	sigV1 = "PROXY "
+	sigV2 = "\r\n\r\n\x00\r\nQUIT\n"
+
+	// maxV1Length is the longest v1 header, CRLF included.
+	maxV1Length = 107
+)
+
+var (
+	ErrMissingHeader = errors.New("proxyproto: missing PROXY header")
+	ErrInvalidHeader = errors.New("proxyproto: invalid PROXY header")
+)
+
+// Listener wraps a listener whose connections may start with a PROXY
+// header. Headers are only honoured from peers in Trusted; other
+// connections are passed through untouched, so a client cannot spoof its
+// address by sending a header itself.
+//
+// The header is read on the connection's first Read, RemoteAddr or
+// LocalAddr call rather than in Accept, so a slow peer cannot hold up
+// the accept loop.
+type Listener struct {
+	net.Listener
+	// Trusted lists the networks of the load balancers.
+	Trusted []netip.Prefix
+	// Optional lets trusted peers connect without a header. By default a
+	// connection from a trusted peer without one fails.
+	Optional bool
+	// HeaderTimeout bounds the time to receive the header. Zero means
+	// DefaultHeaderTimeout.
+	HeaderTimeout time.Duration
+}
+
+func (l *Listener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	if !l.trusted(conn.RemoteAddr()) {
+		return conn, nil
+	}
+	timeout := l.HeaderTimeout
+	if timeout <= 0 {
+		timeout = DefaultHeaderTimeout
+	}
+	return &Conn{
+		Conn:          conn,
+		br:            bufio.NewReader(conn),
+		optional:      l.Optional,
+		headerTimeout: timeout,
+	}, nil
+}
+
+func (l *Listener) trusted(addr net.Addr) bool {
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	ip, ok := netip.AddrFromSlice(tcpAddr.IP)
+	if !ok {
+		return false
+	}
+	return cidr.Contains(l.Trusted, ip.Unmap())
+}
+
+// Conn is a connection from a trusted peer. Its addresses are those
+// carried in the PROXY header, or the connection's own when the header
+// has none, as with health checks.
+type Conn struct {
+	net.Conn
+	br            *bufio.Reader
+	optional      bool
+	headerTimeout time.Duration
+
+	once   sync.Once
+	err    error
+	remote net.Addr
+	local  net.Addr
+
+	mu           sync.Mutex
+	readDeadline time.Time
+}
+
+func (c *Conn) Read(p []byte) (int, error) {
+	c.once.Do(c.readHeader)
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.br.Read(p)
+}
+
+func (c *Conn) RemoteAddr() net.Addr {
+	c.once.Do(c.readHeader)
+	if c.remote != nil {
+		return c.remote
+	}
+	return c.Conn.RemoteAddr()
+}
+
+func (c *Conn) LocalAddr() net.Addr {
+	c.once.Do(c.readHeader)
+	if c.local != nil {
+		return c.local
+	}
+	return c.Conn.LocalAddr()
+}
+
+// ProxyAddr returns the address of the load balancer.
+func (c *Conn) ProxyAddr() net.Addr {
+	return c.Conn.RemoteAddr()
+}
+
+// The deadline setters remember the read deadline so it can be restored
+// after the header has been read under its own timeout.
+func (c *Conn) SetDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.readDeadline = t
+	c.mu.Unlock()
+	return c.Conn.SetDeadline(t)
+}
+
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.readDeadline = t
+	c.mu.Unlock()
+	return c.Conn.SetReadDeadline(t)
+}
+
+// CloseWrite half-closes the connection when the underlying one
+// supports it.
+func (c *Conn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return c.Conn.Close()
+}
+
+func (c *Conn) readHeader() {
+	c.mu.Lock()
+	deadline := time.Now().Add(c.headerTimeout)
+	if !c.readDeadline.IsZero() && c.readDeadline.Before(deadline) {
+		deadline = c.readDeadline
+	}
+	c.mu.Unlock()
+	c.Conn.SetReadDeadline(deadline)
+	defer func() {
+		c.mu.Lock()
+		c.Conn.SetReadDeadline(c.readDeadline)
+		c.mu.Unlock()
+	}()
+
+	version, err := detect(c.br)
+	switch {
+	case err != nil:
+		c.err = err
+	case version == 1:
+		c.remote, c.local, c.err = readV1(c.br)
+	case version == 2:
+		c.remote, c.local, c.err = readV2(c.br)
+	case !c.optional:
+		c.err = ErrMissingHeader
+	}
+}
+
+// detect peeks at the start of the stream and reports the header version,
+// or 0 when there is none. It only waits for as many bytes as it takes to
+// rule a signature out.
+func detect(br *bufio.Reader) (int, error) {
+	for n := 1; n <= len(sigV2); n++ {
+		b, err := br.Peek(n)
+		if err != nil {
+			return 0, err
+		}
+		v1 := n <= len(sigV1) && string(b) == sigV1[:n]
+		v2 := string(b) == sigV2[:n]
+		switch {
+		case v1 && n == len(sigV1):
+			return 1, nil
+		case v2 && n == len(sigV2):
+			return 2, nil
+		case !v1 && !v2:
+			return 0, nil
+		}
+	}
+	return 0, nil
+}
+
+// readV1 parses "PROXY TCP4 src dst srcport dstport\r\n".
+func readV1(br *bufio.Reader) (net.Addr, net.Addr, error) {
+	var line []byte
+	for {
+		b, err := br.ReadByte()
+		if err != nil {
+			return nil, nil, err
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+		if len(line) >= maxV1Length {
+			return nil, nil, fmt.Errorf("%w: v1 header too long", ErrInvalidHeader)
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, nil, fmt.Errorf("%w: v1 header not terminated by CRLF", ErrInvalidHeader)
+	}
+	fields := strings.Split(string(line[:len(line)-2]), " ")
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, nil, fmt.Errorf("%w: %q", ErrInvalidHeader, line)
+	}
+	src, err := parseAddrPort(fields[2], fields[4], fields[1] == "TCP6")
+	if err != nil {
+		return nil, nil, err
+	}
+	dst, err := parseAddrPort(fields[3], fields[5], fields[1] == "TCP6")
+	if err != nil {
+		return nil, nil, err
+	}
+	return src, dst, nil
+}
+
+func parseAddrPort(host, port string, v6 bool) (*net.TCPAddr, error) {
+	addr, err := netip.ParseAddr(host)
+	if err != nil || addr.Is6() != v6 {
+		return nil, fmt.Errorf("%w: bad address %q", ErrInvalidHeader, host)
+	}
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil || (len(port) > 1 && port[0] == '0') {
+		return nil, fmt.Errorf("%w: bad port %q", ErrInvalidHeader, port)
+	}
+	return net.TCPAddrFromAddrPort(netip.AddrPortFrom(addr, uint16(p))), nil
+}
+
+// v2 commands and address families.
+const (
+	cmdLocal = 0x0
+	cmdProxy = 0x1
+	famTCP4  = 0x11
+	famTCP6  = 0x21
+	v2Fixed  = 16
+)
+
+func readV2(br *bufio.Reader) (net.Addr, net.Addr, error) {
+	header := make([]byte, v2Fixed)
+	if _, err := io.ReadFull(br, header); err != nil {
+		return nil, nil, err
+	}
+	verCmd, family := header[12], header[13]
+	length := int(binary.BigEndian.Uint16(header[14:]))
+	if verCmd>>4 != 2 {
+		return nil, nil, fmt.Errorf("%w: version %d", ErrInvalidHeader, verCmd>>4)
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(br, payload); err != nil {
+		return nil, nil, err
+	}
+
+	switch verCmd & 0xF {
+	case cmdLocal:
+		// Sent by the balancer itself, e.g. for health checks.
+		return nil, nil, nil
+	case cmdProxy:
+	default:
+		return nil, nil, fmt.Errorf("%w: command %d", ErrInvalidHeader, verCmd&0xF)
+	}
+
+	var ipLen int
+	switch family {
+	case famTCP4:
+		ipLen = 4
+	case famTCP6:
+		ipLen = 16
+	default:
+		// UDP, Unix sockets and unspecified families carry nothing we
+		// can use as a TCP address; keep the connection's own.
+		return nil, nil, nil
+	}
+	if len(payload) < 2*ipLen+4 {
+		return nil, nil, fmt.Errorf("%w: address block truncated", ErrInvalidHeader)
+	}
+	srcIP, _ := netip.AddrFromSlice(payload[:ipLen])
+	dstIP, _ := netip.AddrFromSlice(payload[ipLen : 2*ipLen])
+	srcPort := binary.BigEndian.Uint16(payload[2*ipLen:])
+	dstPort := binary.BigEndian.Uint16(payload[2*ipLen+2:])
+	// Any TLVs after the addresses are ignored.
+	return net.TCPAddrFromAddrPort(netip.AddrPortFrom(srcIP, srcPort)),
+		net.TCPAddrFromAddrPort(netip.AddrPortFrom(dstIP, dstPort)), nil
+}
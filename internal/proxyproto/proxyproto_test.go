@@ -0,0 +1,175 @@
+package proxyproto
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/PeterKWIlliams/http/internal/cidr"
+	"github.com/PeterKWIlliams/http/internal/request"
+	"github.com/PeterKWIlliams/http/internal/response"
+	"github.com/PeterKWIlliams/http/internal/server"
+)
+
+func v2Header(cmd byte, family byte, addrs []byte, tlvs []byte) []byte {
+	h := []byte(sigV2)
+	h = append(h, 0x20|cmd, family)
+	h = binary.BigEndian.AppendUint16(h, uint16(len(addrs)+len(tlvs)))
+	h = append(h, addrs...)
+	return append(h, tlvs...)
+}
+
+func v2Addrs(src, dst netip.AddrPort) []byte {
+	var b []byte
+	b = append(b, src.Addr().AsSlice()...)
+	b = append(b, dst.Addr().AsSlice()...)
+	b = binary.BigEndian.AppendUint16(b, src.Port())
+	return binary.BigEndian.AppendUint16(b, dst.Port())
+}
+
+// accept sends data over a connection to l and returns the remote address
+// and payload the accepted side sees.
+func accept(t *testing.T, l *Listener, data []byte) (string, string, error) {
+	t.Helper()
+	client, err := net.Dial("tcp", l.Addr().String())
+	require.NoError(t, err)
+	defer client.Close()
+	_, err = client.Write(data)
+	require.NoError(t, err)
+
+	conn, err := l.Accept()
+	require.NoError(t, err)
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	remote := conn.RemoteAddr().String()
+	payload := make([]byte, 5)
+	if _, err := io.ReadFull(conn, payload); err != nil {
+		return remote, "", err
+	}
+	return remote, string(payload), nil
+}
+
+func TestListener(t *testing.T) {
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer inner.Close()
+	trusted, err := cidr.ParseList("10.0.0.0/8, 127.0.0.1")
+	require.NoError(t, err)
+	l := &Listener{Listener: inner, Trusted: trusted, HeaderTimeout: time.Second}
+
+	src := netip.MustParseAddrPort("203.0.113.7:51000")
+	dst := netip.MustParseAddrPort("192.0.2.1:443")
+	src6 := netip.MustParseAddrPort("[2001:db8::7]:51000")
+	dst6 := netip.MustParseAddrPort("[2001:db8::1]:443")
+	tests := []struct {
+		name   string
+		data   []byte
+		remote string
+		err    error
+	}{
+		{
+			name:   "v1 tcp4",
+			data:   []byte("PROXY TCP4 203.0.113.7 192.0.2.1 51000 443\r\nhello"),
+			remote: "203.0.113.7:51000",
+		},
+		{
+			name:   "v1 tcp6",
+			data:   []byte("PROXY TCP6 2001:db8::7 2001:db8::1 51000 443\r\nhello"),
+			remote: "[2001:db8::7]:51000",
+		},
+		{
+			name: "v1 unknown",
+			data: []byte("PROXY UNKNOWN\r\nhello"),
+		},
+		{
+			name:   "v2 tcp4 with TLVs",
+			data:   append(v2Header(cmdProxy, famTCP4, v2Addrs(src, dst), []byte{0x04, 0x00, 0x01, 'x'}), "hello"...),
+			remote: "203.0.113.7:51000",
+		},
+		{
+			name:   "v2 tcp6",
+			data:   append(v2Header(cmdProxy, famTCP6, v2Addrs(src6, dst6), nil), "hello"...),
+			remote: "[2001:db8::7]:51000",
+		},
+		{
+			name: "v2 local",
+			data: append(v2Header(cmdLocal, 0, nil, nil), "hello"...),
+		},
+		{
+			name: "missing header",
+			data: []byte("GET / HTTP/1.1\r\n"),
+			err:  ErrMissingHeader,
+		},
+		{
+			name: "v1 bad address",
+			data: []byte("PROXY TCP4 2001:db8::7 192.0.2.1 51000 443\r\nhello"),
+			err:  ErrInvalidHeader,
+		},
+		{
+			name: "v1 bad port",
+			data: []byte("PROXY TCP4 203.0.113.7 192.0.2.1 051000 443\r\nhello"),
+			err:  ErrInvalidHeader,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			remote, payload, err := accept(t, l, tt.data)
+			if tt.err != nil {
+				assert.ErrorIs(t, err, tt.err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, "hello", payload)
+			if tt.remote != "" {
+				assert.Equal(t, tt.remote, remote)
+			} else {
+				assert.Contains(t, remote, "127.0.0.1:")
+			}
+		})
+	}
+
+	// Test: Trusted peers may skip the header when it is optional
+	l.Optional = true
+	_, payload, err := accept(t, l, []byte("hello"))
+	require.NoError(t, err)
+	assert.Equal(t, "hello", payload)
+
+	// Test: Headers from untrusted peers are not interpreted
+	l.Trusted = []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")}
+	remote, payload, err := accept(t, l, []byte("PROXY TCP4 203.0.113.7 192.0.2.1 51000 443\r\n"))
+	require.NoError(t, err)
+	assert.Contains(t, remote, "127.0.0.1:")
+	assert.Equal(t, "PROXY", payload)
+}
+
+func TestListener_Server(t *testing.T) {
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	l := &Listener{Listener: inner, Trusted: []netip.Prefix{netip.MustParsePrefix("127.0.0.0/8")}}
+	s := server.New(func(w *response.Writer, req *request.Request) {
+		body := []byte(req.RemoteAddr + " " + req.LocalAddr)
+		w.Write(response.OK, response.GetDefaultHeaders(len(body)), body)
+	})
+	go s.Serve(l)
+	defer s.Close()
+
+	conn, err := net.Dial("tcp", inner.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	_, err = conn.Write([]byte("PROXY TCP4 203.0.113.7 192.0.2.1 51000 80\r\nGET / HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	require.NoError(t, err)
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	require.NoError(t, err)
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.Equal(t, "203.0.113.7:51000 192.0.2.1:80", string(body))
+}
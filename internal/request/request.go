@@ -1,9 +1,13 @@
 package request
 
 import (
+	"context"
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"io"
+	"net"
+	"net/url"
 	"strconv"
 	"strings"
 
@@ -27,6 +31,51 @@ type Request struct {
 	Body          []byte
 	State         requestState
 	Contentlength int
+	RemoteAddr    string
+	// LocalAddr is the server address the connection was accepted on.
+	LocalAddr string
+	// TLS is set for requests received over TLS.
+	TLS *tls.ConnectionState
+	// Scheme is "https" for requests received over TLS and "http"
+	// otherwise, unless rewritten from the headers of a trusted proxy.
+	Scheme string
+	// ConnID identifies the connection within the server, and Sequence
+	// counts requests on it from 1.
+	ConnID   uint64
+	Sequence int
+	ctx      context.Context
+}
+
+// Context returns the request's context. For requests served by the
+// server it is cancelled when the client goes away, the server closes or
+// the request times out; otherwise it is context.Background.
+func (r *Request) Context() context.Context {
+	if r.ctx == nil {
+		return context.Background()
+	}
+	return r.ctx
+}
+
+// WithContext returns a shallow copy of r with its context set to ctx.
+func (r *Request) WithContext(ctx context.Context) *Request {
+	r2 := *r
+	r2.ctx = ctx
+	return &r2
+}
+
+type contextKey int
+
+const idKey contextKey = iota
+
+// ContextWithID returns a copy of ctx carrying the request ID id.
+func ContextWithID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, idKey, id)
+}
+
+// IDFromContext returns the request ID stored in ctx, or "".
+func IDFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(idKey).(string)
+	return id
 }
 
 type RequestLine struct {
@@ -36,21 +85,49 @@ type RequestLine struct {
 }
 
 func RequestFromReader(reader io.Reader) (*Request, error) {
+	return NewReader(reader).Next()
+}
+
+// Reader parses successive requests from a connection. Bytes read past the
+// end of a request are kept for the next call to Next and can be
+// retrieved with Buffered.
+type Reader struct {
+	src         io.Reader
+	buffer      []byte
+	readToIndex int
+}
+
+func NewReader(src io.Reader) *Reader {
+	return &Reader{
+		src:    src,
+		buffer: make([]byte, bufferSize),
+	}
+}
+
+// Next reads the next request. It returns io.EOF when the source ends
+// before any byte of a new request arrives.
+func (rd *Reader) Next() (*Request, error) {
 	request := &Request{
 		State:   initialized,
 		Headers: headers.NewHeaders(),
 	}
-	buffer := make([]byte, bufferSize)
-	var readToIndex int
 
+	if rd.readToIndex > 0 {
+		if err := rd.parseBuffered(request); err != nil {
+			return nil, err
+		}
+	}
 	for request.State != done {
-		if readToIndex == len(buffer) {
-			newBuffer := make([]byte, len(buffer)*2)
-			copy(newBuffer, buffer)
-			buffer = newBuffer
+		if rd.readToIndex == len(rd.buffer) {
+			newBuffer := make([]byte, len(rd.buffer)*2)
+			copy(newBuffer, rd.buffer)
+			rd.buffer = newBuffer
 		}
-		r, err := reader.Read(buffer[readToIndex:])
+		r, err := rd.src.Read(rd.buffer[rd.readToIndex:])
 		if err == io.EOF {
+			if request.State == initialized && rd.readToIndex == 0 {
+				return nil, io.EOF
+			}
 			if request.validBody() {
 				return nil, errors.New("invalid body size")
 			}
@@ -61,20 +138,33 @@ func RequestFromReader(reader io.Reader) (*Request, error) {
 		if err != nil {
 			return nil, fmt.Errorf("error getting request from reader: %s", err)
 		}
-		readToIndex += r
+		rd.readToIndex += r
 
-		p, err := request.parse(buffer[:readToIndex])
-		if err != nil {
-			return nil, fmt.Errorf("error parsing request: %s", err)
+		if err := rd.parseBuffered(request); err != nil {
+			return nil, err
 		}
-
-		copy(buffer, buffer[p:readToIndex])
-		readToIndex -= p
 	}
 
 	return request, nil
 }
 
+func (rd *Reader) parseBuffered(request *Request) error {
+	p, err := request.parse(rd.buffer[:rd.readToIndex])
+	if err != nil {
+		return fmt.Errorf("error parsing request: %w", err)
+	}
+
+	copy(rd.buffer, rd.buffer[p:rd.readToIndex])
+	rd.readToIndex -= p
+	return nil
+}
+
+// Buffered returns a copy of the bytes that have been read from the source
+// but not yet consumed by a request.
+func (rd *Reader) Buffered() []byte {
+	return append([]byte(nil), rd.buffer[:rd.readToIndex]...)
+}
+
 func (r *Request) validBody() bool {
 	return r.BodyLength() != int64(r.Contentlength)
 }
@@ -84,7 +174,7 @@ func (r *Request) parse(data []byte) (int, error) {
 	for r.State != done {
 		n, err := r.parseSingle(data[totalBytesParsed:])
 		if err != nil {
-			return 0, fmt.Errorf("could not parse request component: %s", err)
+			return 0, fmt.Errorf("could not parse request component: %w", err)
 		}
 		if n == 0 {
 			break
@@ -103,7 +193,7 @@ func (r *Request) parseSingle(data []byte) (int, error) {
 	case initialized:
 		rl, consumedBytes, err := parseRequestLine(data)
 		if err != nil {
-			return 0, fmt.Errorf("could not parse request line: %s", err)
+			return 0, fmt.Errorf("could not parse request line: %w", err)
 		}
 		if consumedBytes == 0 {
 			return 0, nil
@@ -131,14 +221,21 @@ func (r *Request) parseSingle(data []byte) (int, error) {
 				r.State = done
 				return 0, errors.New("invalid content-length: NaN")
 			}
+			if contentLength < 0 {
+				r.State = done
+				return 0, errors.New("invalid content-length: negative")
+			}
 
 			r.Contentlength = int(contentLength)
 			r.State = parsingBody
+			if r.Contentlength == 0 {
+				r.State = done
+			}
 		}
 		return n, nil
 	case parsingBody:
-		bytesParsed := len(data)
-		r.Body = append(r.Body, data...)
+		bytesParsed := min(len(data), r.Contentlength-len(r.Body))
+		r.Body = append(r.Body, data[:bytesParsed]...)
 
 		if r.BodyLength() > int64(r.Contentlength) {
 			return 0, errors.New("error parsing body: invalid body size")
@@ -160,12 +257,20 @@ func (r *Request) BodyLength() int64 {
 	return int64(len(r.Body))
 }
 
+// ErrHTTP2Preface is returned when the connection starts with the HTTP/2
+// client preface instead of an HTTP/1.1 request.
+var ErrHTTP2Preface = errors.New("HTTP/2 connection preface")
+
 var supportedMethods = map[string]struct{}{
-	"GET":    {},
-	"POST":   {},
-	"DELETE": {},
-	"HEAD":   {},
-	"PUT":    {},
+	"GET":     {},
+	"POST":    {},
+	"DELETE":  {},
+	"HEAD":    {},
+	"PUT":     {},
+	"PATCH":   {},
+	"OPTIONS": {},
+	"TRACE":   {},
+	"CONNECT": {},
 }
 
 func parseRequestLine(rl []byte) (*RequestLine, int, error) {
@@ -179,6 +284,10 @@ func parseRequestLine(rl []byte) (*RequestLine, int, error) {
 	consumedBytes := index + 2
 	rlString = rlString[:index]
 
+	if rlString == "PRI * HTTP/2.0" {
+		return nil, consumedBytes, ErrHTTP2Preface
+	}
+
 	requestLineParts := strings.Fields(rlString)
 	if len(requestLineParts) != 3 {
 		return nil, consumedBytes, fmt.Errorf("invalid number of parts in request line: %s", rlString)
@@ -189,6 +298,11 @@ func parseRequestLine(rl []byte) (*RequestLine, int, error) {
 		return nil, consumedBytes, fmt.Errorf("invalid HTTP method: %s", method)
 	}
 
+	requestTarget := requestLineParts[1]
+	if err := validRequestTarget(method, requestTarget); err != nil {
+		return nil, consumedBytes, err
+	}
+
 	httpVersion := requestLineParts[2]
 	if httpVersion != "HTTP/1.1" {
 		return nil, consumedBytes, fmt.Errorf("unsupported HTTP version: %s", httpVersion)
@@ -196,7 +310,38 @@ func parseRequestLine(rl []byte) (*RequestLine, int, error) {
 
 	return &RequestLine{
 		Method:        method,
-		RequestTarget: requestLineParts[1],
+		RequestTarget: requestTarget,
 		HttpVersion:   "1.1",
 	}, consumedBytes, nil
 }
+
+// validRequestTarget accepts the authority form (host:port) for CONNECT and
+// the origin form (/path) or absolute form (http://host/path) otherwise.
+func validRequestTarget(method string, target string) error {
+	if method == "CONNECT" {
+		host, port, err := net.SplitHostPort(target)
+		if err != nil || host == "" {
+			return fmt.Errorf("invalid CONNECT target: %s", target)
+		}
+		if n, err := strconv.Atoi(port); err != nil || n <= 0 || n > 65535 {
+			return fmt.Errorf("invalid CONNECT port: %s", target)
+		}
+		return nil
+	}
+	if strings.HasPrefix(target, "/") {
+		return nil
+	}
+	u, err := url.Parse(target)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("invalid request target: %s", target)
+	}
+	return nil
+}
+
+// IsAbsoluteForm reports whether the request target is a full URL, as sent
+// to forward proxies. The scheme is case-insensitive.
+func (rl RequestLine) IsAbsoluteForm() bool {
+	scheme, _, found := strings.Cut(rl.RequestTarget, "://")
+	scheme = strings.ToLower(scheme)
+	return found && (scheme == "http" || scheme == "https")
+}
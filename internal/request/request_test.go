@@ -1,6 +1,7 @@
 package request
 
 import (
+	"context"
 	"io"
 	"strings"
 	"testing"
@@ -76,6 +77,14 @@ func TestRequestLineParse_InvalidMethod(t *testing.T) {
 	require.Nil(t, r)
 }
 
+func TestRequestLineParse_Methods(t *testing.T) {
+	for _, method := range []string{"PATCH", "OPTIONS", "TRACE"} {
+		r, err := RequestFromReader(strings.NewReader(method + " /coffee HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+		require.NoError(t, err, method)
+		assert.Equal(t, method, r.RequestLine.Method)
+	}
+}
+
 func TestRequestLineParse_InvalidOrder(t *testing.T) {
 	r, err := RequestFromReader(strings.NewReader("/coffee PUSH HTTP/1.1\r\nHost:localhost:32020\r\nUser-Agent: curl/7.81.0\r\nAccept: */*\r\n\r\n"))
 	require.Error(t, err)
@@ -162,3 +171,84 @@ func TestBodyParse(t *testing.T) {
 	_, err = RequestFromReader(reader)
 	require.Error(t, err)
 }
+
+func TestRequestLineParse_RequestTargetForms(t *testing.T) {
+	// Test: CONNECT with authority form
+	r, err := RequestFromReader(strings.NewReader("CONNECT example.com:443 HTTP/1.1\r\nHost: example.com:443\r\n\r\n"))
+	require.NoError(t, err)
+	assert.Equal(t, "CONNECT", r.RequestLine.Method)
+	assert.Equal(t, "example.com:443", r.RequestLine.RequestTarget)
+	assert.False(t, r.RequestLine.IsAbsoluteForm())
+
+	// Test: CONNECT without a port
+	_, err = RequestFromReader(strings.NewReader("CONNECT example.com HTTP/1.1\r\nHost: example.com\r\n\r\n"))
+	require.Error(t, err)
+
+	// Test: Absolute form
+	r, err = RequestFromReader(strings.NewReader("GET http://example.com/coffee?x=1 HTTP/1.1\r\nHost: example.com\r\n\r\n"))
+	require.NoError(t, err)
+	assert.Equal(t, "http://example.com/coffee?x=1", r.RequestLine.RequestTarget)
+	assert.True(t, r.RequestLine.IsAbsoluteForm())
+
+	// Test: The scheme is case-insensitive
+	r, err = RequestFromReader(strings.NewReader("GET HTTP://example.com/ HTTP/1.1\r\nHost: example.com\r\n\r\n"))
+	require.NoError(t, err)
+	assert.True(t, r.RequestLine.IsAbsoluteForm())
+
+	// Test: Neither origin nor absolute form
+	_, err = RequestFromReader(strings.NewReader("GET coffee HTTP/1.1\r\nHost: example.com\r\n\r\n"))
+	require.Error(t, err)
+}
+
+func TestReader_Pipelined(t *testing.T) {
+	src := &chunkReader{
+		data: "POST /first HTTP/1.1\r\nHost: localhost\r\nContent-Length: 5\r\n\r\nhello" +
+			"GET /second HTTP/1.1\r\nHost: localhost\r\nContent-Length: 0\r\n\r\n" +
+			"GET /third HTTP/1.1\r\n",
+		numBytesPerRead: 7,
+	}
+	reader := NewReader(src)
+
+	r, err := reader.Next()
+	require.NoError(t, err)
+	assert.Equal(t, "/first", r.RequestLine.RequestTarget)
+	assert.Equal(t, "hello", string(r.Body))
+
+	r, err = reader.Next()
+	require.NoError(t, err)
+	assert.Equal(t, "/second", r.RequestLine.RequestTarget)
+	assert.Empty(t, r.Body)
+
+	// Test: Unconsumed bytes are available to callers taking over the source
+	buffered := string(reader.Buffered())
+	assert.NotEmpty(t, buffered)
+	rest, err := io.ReadAll(src)
+	require.NoError(t, err)
+	assert.Equal(t, "GET /third HTTP/1.1\r\n", buffered+string(rest))
+
+	// Test: Clean end of input between requests
+	reader = NewReader(strings.NewReader(""))
+	_, err = reader.Next()
+	assert.ErrorIs(t, err, io.EOF)
+}
+
+func TestReader_HTTP2Preface(t *testing.T) {
+	preface := "PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n"
+	reader := NewReader(&chunkReader{data: preface + "\x00\x00\x00\x04", numBytesPerRead: 3})
+	_, err := reader.Next()
+	assert.ErrorIs(t, err, ErrHTTP2Preface)
+	assert.True(t, strings.HasPrefix(string(reader.Buffered()), "PRI * HTTP/2.0\r\n"))
+}
+
+func TestRequest_Context(t *testing.T) {
+	r, err := RequestFromReader(strings.NewReader("GET / HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	require.NoError(t, err)
+	assert.Equal(t, context.Background(), r.Context())
+
+	ctx := ContextWithID(context.Background(), "abc")
+	r2 := r.WithContext(ctx)
+	assert.Equal(t, "abc", IDFromContext(r2.Context()))
+	assert.Equal(t, "/", r2.RequestLine.RequestTarget)
+	// Test: The original request is unchanged
+	assert.Equal(t, "", IDFromContext(r.Context()))
+}
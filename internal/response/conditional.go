@@ -0,0 +1,137 @@
+package response
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/PeterKWIlliams/http/internal/headers"
+)
+
+// Validators describe the current representation for conditional requests.
+// A zero value field is treated as unavailable. Exists reports whether there
+// is a current representation at all, which is what "*" matches, so a
+// resource without an ETag can still satisfy If-Match: *.
+type Validators struct {
+	Exists       bool
+	ETag         string
+	LastModified time.Time
+}
+
+// StrongETag derives a strong entity tag from the representation bytes.
+func StrongETag(data []byte) string {
+	sum := sha256.Sum256(data)
+	return `"` + hex.EncodeToString(sum[:16]) + `"`
+}
+
+// WeakETag derives a weak entity tag from the representation bytes, for
+// content that is semantically but not byte-for-byte stable.
+func WeakETag(data []byte) string {
+	return "W/" + StrongETag(data)
+}
+
+// ModTimeETag builds a cheap strong entity tag from a modification time
+// and size, the way most file servers do.
+func ModTimeETag(modTime time.Time, size int64) string {
+	return fmt.Sprintf(`"%x-%x"`, modTime.UnixNano(), size)
+}
+
+// EvaluatePreconditions applies If-Match, If-Unmodified-Since, If-None-Match
+// and If-Modified-Since in the order RFC 9110 section 13.2.2 gives. It
+// returns OK when the request should proceed, otherwise NotModified or
+// PreconditionFailed.
+func EvaluatePreconditions(method string, reqHeaders headers.Headers, v Validators) StatusCode {
+	safe := method == "GET" || method == "HEAD"
+
+	if ifMatch, err := reqHeaders.Get("if-match"); err == nil {
+		if !matchETag(ifMatch, v, false) {
+			return PreconditionFailed
+		}
+	} else if ius, err := reqHeaders.Get("if-unmodified-since"); err == nil {
+		if t, ok := parseHTTPDate(ius); ok && !v.LastModified.IsZero() && modifiedSince(v.LastModified, t) {
+			return PreconditionFailed
+		}
+	}
+
+	if ifNoneMatch, err := reqHeaders.Get("if-none-match"); err == nil {
+		if matchETag(ifNoneMatch, v, true) {
+			if safe {
+				return NotModified
+			}
+			return PreconditionFailed
+		}
+	} else if ims, err := reqHeaders.Get("if-modified-since"); err == nil && safe {
+		if t, ok := parseHTTPDate(ims); ok && !v.LastModified.IsZero() && !modifiedSince(v.LastModified, t) {
+			return NotModified
+		}
+	}
+	return OK
+}
+
+// CheckPreconditions evaluates the request's conditional headers and, when
+// they fail, writes the 304 or 412 response itself. It reports whether a
+// response was written, in which case the handler must not write another.
+func (w *Writer) CheckPreconditions(method string, reqHeaders headers.Headers, v Validators) (bool, error) {
+	statusCode := EvaluatePreconditions(method, reqHeaders, v)
+	if statusCode == OK {
+		return false, nil
+	}
+
+	h := headers.NewHeaders()
+	h.Set("connection", "close")
+	if v.ETag != "" {
+		h.Set("etag", v.ETag)
+	}
+	if !v.LastModified.IsZero() {
+		h.Set("last-modified", v.LastModified.UTC().Format(TimeFormat))
+	}
+	if statusCode == PreconditionFailed {
+		h.Set("content-length", "0")
+	}
+	if err := w.WriteStatusLine(statusCode); err != nil {
+		return true, err
+	}
+	return true, w.WriteHeaders(h)
+}
+
+// matchETag compares the current ETag against a comma separated list of
+// entity tags, or "*" against whether the resource exists. Weak comparison
+// ignores the W/ prefix; strong comparison never matches a weak tag.
+func matchETag(list string, v Validators, weak bool) bool {
+	list = strings.TrimSpace(list)
+	if list == "*" {
+		return v.Exists
+	}
+	current := v.ETag
+	if current == "" {
+		return false
+	}
+	for _, candidate := range strings.Split(list, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if weak {
+			if strings.TrimPrefix(candidate, "W/") == strings.TrimPrefix(current, "W/") {
+				return true
+			}
+			continue
+		}
+		if !strings.HasPrefix(candidate, "W/") && !strings.HasPrefix(current, "W/") && candidate == current {
+			return true
+		}
+	}
+	return false
+}
+
+func modifiedSince(lastModified time.Time, t time.Time) bool {
+	return lastModified.Truncate(time.Second).After(t)
+}
+
+func parseHTTPDate(value string) (time.Time, bool) {
+	for _, layout := range []string{TimeFormat, time.RFC850, time.ANSIC} {
+		if t, err := time.Parse(layout, strings.TrimSpace(value)); err == nil {
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
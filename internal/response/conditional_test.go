@@ -0,0 +1,84 @@
+package response
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/PeterKWIlliams/http/internal/headers"
+)
+
+func TestETags(t *testing.T) {
+	etag := StrongETag([]byte("hello"))
+	assert.True(t, strings.HasPrefix(etag, `"`))
+	assert.Equal(t, etag, StrongETag([]byte("hello")))
+	assert.NotEqual(t, etag, StrongETag([]byte("hello!")))
+	assert.Equal(t, "W/"+etag, WeakETag([]byte("hello")))
+}
+
+func TestEvaluatePreconditions(t *testing.T) {
+	lastModified := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	v := Validators{Exists: true, ETag: `"abc"`, LastModified: lastModified}
+	before := "Tue, 30 Apr 2024 12:00:00 GMT"
+	after := "Thu, 02 May 2024 12:00:00 GMT"
+
+	tests := []struct {
+		name   string
+		method string
+		fields map[string]string
+		want   StatusCode
+	}{
+		{"no conditions", "GET", nil, OK},
+		{"if-none-match hit", "GET", map[string]string{"if-none-match": `"xyz", W/"abc"`}, NotModified},
+		{"if-none-match miss", "GET", map[string]string{"if-none-match": `"xyz"`}, OK},
+		{"if-none-match star on unsafe method", "PUT", map[string]string{"if-none-match": "*"}, PreconditionFailed},
+		{"if-modified-since not modified", "GET", map[string]string{"if-modified-since": after}, NotModified},
+		{"if-modified-since modified", "GET", map[string]string{"if-modified-since": before}, OK},
+		{"if-modified-since ignored for POST", "POST", map[string]string{"if-modified-since": after}, OK},
+		{"if-none-match takes precedence", "GET", map[string]string{"if-none-match": `"xyz"`, "if-modified-since": after}, OK},
+		{"if-match hit", "PUT", map[string]string{"if-match": `"abc"`}, OK},
+		{"if-match weak tag never matches", "PUT", map[string]string{"if-match": `W/"abc"`}, PreconditionFailed},
+		{"if-match star", "PUT", map[string]string{"if-match": "*"}, OK},
+		{"if-unmodified-since fails", "PUT", map[string]string{"if-unmodified-since": before}, PreconditionFailed},
+		{"if-unmodified-since passes", "PUT", map[string]string{"if-unmodified-since": after}, OK},
+		{"if-match takes precedence", "PUT", map[string]string{"if-match": `"abc"`, "if-unmodified-since": before}, OK},
+		{"invalid date is ignored", "GET", map[string]string{"if-modified-since": "yesterday"}, OK},
+	}
+	for _, tc := range tests {
+		h := headers.NewHeaders()
+		for k, val := range tc.fields {
+			h.Set(k, val)
+		}
+		assert.Equal(t, tc.want, EvaluatePreconditions(tc.method, h, v), tc.name)
+	}
+
+	// Test: "*" depends on whether the resource exists, not on its ETag
+	h := headers.NewHeaders()
+	h.Set("if-match", "*")
+	assert.Equal(t, OK, EvaluatePreconditions("PUT", h, Validators{Exists: true}))
+	assert.Equal(t, PreconditionFailed, EvaluatePreconditions("PUT", h, Validators{}))
+
+	h = headers.NewHeaders()
+	h.Set("if-none-match", "*")
+	assert.Equal(t, PreconditionFailed, EvaluatePreconditions("PUT", h, Validators{Exists: true}))
+	assert.Equal(t, OK, EvaluatePreconditions("PUT", h, Validators{}))
+}
+
+func TestCheckPreconditions(t *testing.T) {
+	v := Validators{Exists: true, ETag: `"abc"`}
+	h := headers.NewHeaders()
+	h.Set("if-none-match", `"abc"`)
+
+	var out bytes.Buffer
+	w := &Writer{Writer: &out}
+	done, err := w.CheckPreconditions("GET", h, v)
+	require.NoError(t, err)
+	assert.True(t, done)
+	assert.True(t, strings.HasPrefix(out.String(), "HTTP/1.1 304 Not Modified\r\n"))
+	assert.Contains(t, out.String(), "etag: \"abc\"\r\n")
+	assert.True(t, strings.HasSuffix(out.String(), "\r\n\r\n"))
+}
@@ -0,0 +1,32 @@
+package response
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// TimeFormat is the IMF-fixdate layout RFC 9110 requires for the Date header.
+const TimeFormat = "Mon, 02 Jan 2006 15:04:05 GMT"
+
+type cachedDate struct {
+	unix  int64
+	value string
+}
+
+var dateCache atomic.Pointer[cachedDate]
+
+// HTTPDate returns the current time formatted for a Date header. The
+// formatted value is cached and only rebuilt once per second.
+func HTTPDate() string {
+	now := time.Now()
+	sec := now.Unix()
+	if cached := dateCache.Load(); cached != nil && cached.unix == sec {
+		return cached.value
+	}
+	cached := &cachedDate{
+		unix:  sec,
+		value: now.UTC().Format(TimeFormat),
+	}
+	dateCache.Store(cached)
+	return cached.value
+}
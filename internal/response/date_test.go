@@ -0,0 +1,41 @@
+package response
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHTTPDate(t *testing.T) {
+	before := time.Now().Truncate(time.Second)
+	date := HTTPDate()
+	after := time.Now()
+
+	// Test: The value is an IMF-fixdate for the current second
+	parsed, err := time.Parse(TimeFormat, date)
+	require.NoError(t, err)
+	assert.False(t, parsed.Before(before))
+	assert.False(t, parsed.After(after))
+	assert.Regexp(t, `^[A-Z][a-z]{2}, \d{2} [A-Z][a-z]{2} \d{4} \d{2}:\d{2}:\d{2} GMT$`, date)
+
+	// Test: The formatted value is reused within a second
+	cached := dateCache.Load()
+	require.NotNil(t, cached)
+	assert.Equal(t, date, cached.value)
+	for {
+		sec := time.Now().Unix()
+		dateCache.Store(&cachedDate{unix: sec, value: "cached"})
+		got := HTTPDate()
+		if time.Now().Unix() == sec {
+			assert.Equal(t, "cached", got)
+			break
+		}
+	}
+
+	// Test: A stale cache entry is replaced
+	dateCache.Store(&cachedDate{unix: 1, value: "stale"})
+	assert.NotEqual(t, "stale", HTTPDate())
+	assert.NotEqual(t, int64(1), dateCache.Load().unix)
+}
@@ -4,7 +4,9 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"net"
 	"strconv"
+	"strings"
 
 	"github.com/PeterKWIlliams/http/internal/headers"
 )
@@ -12,9 +14,24 @@ import (
 type StatusCode int
 
 const (
-	OK                  = StatusCode(200)
-	BadRequest          = StatusCode(400)
-	InternalServerError = StatusCode(500)
+	SwitchingProtocols   = StatusCode(101)
+	OK                   = StatusCode(200)
+	PartialContent       = StatusCode(206)
+	MovedPermanently     = StatusCode(301)
+	NotModified          = StatusCode(304)
+	BadRequest           = StatusCode(400)
+	Forbidden            = StatusCode(403)
+	NotFound             = StatusCode(404)
+	MethodNotAllowed     = StatusCode(405)
+	PreconditionFailed   = StatusCode(412)
+	PayloadTooLarge      = StatusCode(413)
+	UnsupportedMediaType = StatusCode(415)
+	RangeNotSatisfiable  = StatusCode(416)
+	UpgradeRequired      = StatusCode(426)
+	InternalServerError  = StatusCode(500)
+	BadGateway           = StatusCode(502)
+	ServiceUnavailable   = StatusCode(503)
+	GatewayTimeout       = StatusCode(504)
 )
 
 type writerState int
@@ -23,32 +40,121 @@ const (
 	writeSL writerState = iota
 	writeHD
 	writeBOD
+	hijacked
 )
 
 var statusText = map[StatusCode]string{
-	OK:                  "OK",
-	BadRequest:          "Bad Request",
-	InternalServerError: "Server Error",
+	SwitchingProtocols:   "Switching Protocols",
+	OK:                   "OK",
+	PartialContent:       "Partial Content",
+	MovedPermanently:     "Moved Permanently",
+	NotModified:          "Not Modified",
+	BadRequest:           "Bad Request",
+	Forbidden:            "Forbidden",
+	NotFound:             "Not Found",
+	MethodNotAllowed:     "Method Not Allowed",
+	PreconditionFailed:   "Precondition Failed",
+	PayloadTooLarge:      "Content Too Large",
+	UnsupportedMediaType: "Unsupported Media Type",
+	RangeNotSatisfiable:  "Range Not Satisfiable",
+	UpgradeRequired:      "Upgrade Required",
+	InternalServerError:  "Server Error",
+	BadGateway:           "Bad Gateway",
+	ServiceUnavailable:   "Service Unavailable",
+	GatewayTimeout:       "Gateway Timeout",
 }
 
 type Writer struct {
-	Writer      io.Writer
-	writerState writerState
+	Writer       io.Writer
+	writerState  writerState
+	statusCode   StatusCode
+	headerHooks  []HeaderHook
+	bodyWrappers []BodyWrapper
+	body         io.Writer
+	bodyClosers  []io.Closer
+	chunked      bool
+	finished     bool
+	hijacker     Hijacker
+	transport    Transport
+	bodyBytes    int64
 }
 
-var errOutOfOrderCall = errors.New("out of order call")
+// A Transport carries a response over a protocol other than HTTP/1.1,
+// such as an HTTP/2 stream. It receives the status and headers together
+// and the body without any HTTP/1.1 framing.
+type Transport interface {
+	WriteHeader(statusCode StatusCode, h headers.Headers) error
+	io.Writer
+	// Close marks the end of the body.
+	Close() error
+}
 
-func (w *Writer) WriteStatusLine(statusCode StatusCode) error {
-	if w.writerState != writeSL {
+// SetTransport routes the response through t instead of Writer.
+func (w *Writer) SetTransport(t Transport) {
+	w.transport = t
+}
+
+// A HeaderHook is run by WriteHeaders just before the headers go out on the
+// wire, and may add, change or remove fields.
+type HeaderHook func(statusCode StatusCode, h headers.Headers)
+
+func (w *Writer) OnWriteHeaders(hook HeaderHook) {
+	w.headerHooks = append(w.headerHooks, hook)
+}
+
+// A BodyWrapper layers an encoder, such as a compressor, over the body
+// stream. The returned writer is closed when the response is finished.
+type BodyWrapper func(dst io.Writer) io.WriteCloser
+
+// WrapBody registers a body wrapper. It is meant to be called from a
+// HeaderHook so the wrapper can be chosen based on the final headers.
+func (w *Writer) WrapBody(wrap BodyWrapper) {
+	w.bodyWrappers = append(w.bodyWrappers, wrap)
+}
+
+func (w *Writer) checkState(want writerState) error {
+	if w.writerState == hijacked {
+		return ErrHijacked
+	}
+	if w.writerState != want {
 		return errOutOfOrderCall
 	}
+	return nil
+}
+
+func (w *Writer) StatusCode() StatusCode {
+	return w.statusCode
+}
+
+// BodyBytes returns the number of body bytes sent so far, after any
+// encoding such as compression but without chunked framing.
+func (w *Writer) BodyBytes() int64 {
+	return w.bodyBytes
+}
+
+var (
+	errOutOfOrderCall = errors.New("out of order call")
+	ErrHijacked       = errors.New("connection has been hijacked")
+	ErrNotHijackable  = errors.New("underlying writer is not a net.Conn")
+)
+
+const chunkedTerminator = "0\r\n\r\n"
+
+func (w *Writer) WriteStatusLine(statusCode StatusCode) error {
+	if err := w.checkState(writeSL); err != nil {
+		return err
+	}
+	w.statusCode = statusCode
+	w.writerState = writeHD
+	if w.transport != nil {
+		return nil
+	}
 	reasonPhrase, found := statusText[statusCode]
 	if !found {
 		reasonPhrase = ""
 	}
 	statusLine := fmt.Sprintf("HTTP/1.1 %d %s\r\n", statusCode, reasonPhrase)
 	_, err := w.Writer.Write([]byte(statusLine))
-	w.writerState = writeHD
 	return err
 }
 
@@ -66,36 +172,183 @@ func GetDefaultHeaders(contentLen int) headers.Headers {
 }
 
 func (w *Writer) WriteHeaders(headers headers.Headers) error {
-	if w.writerState != writeHD {
-		return errOutOfOrderCall
+	if err := w.checkState(writeHD); err != nil {
+		return err
 	}
-	for fieldName, fieldValue := range headers {
-		res := fmt.Sprintf("%s: %s\r\n", fieldName, fieldValue)
-		_, err := w.Writer.Write([]byte(res))
-		if err != nil {
+	if len(w.headerHooks) > 0 {
+		headers = headers.Clone()
+		for _, hook := range w.headerHooks {
+			hook(w.statusCode, headers)
+		}
+	}
+	if w.transport != nil {
+		if err := w.transport.WriteHeader(w.statusCode, headers); err != nil {
 			return fmt.Errorf("error writing headers: %w", err)
 		}
+		w.setupBody(headers)
+		w.writerState = writeBOD
+		return nil
+	}
+	for fieldName := range headers {
+		for _, fieldValue := range headers.Values(fieldName) {
+			res := fmt.Sprintf("%s: %s\r\n", fieldName, fieldValue)
+			_, err := w.Writer.Write([]byte(res))
+			if err != nil {
+				return fmt.Errorf("error writing headers: %w", err)
+			}
+		}
 	}
 	_, err := w.Writer.Write([]byte("\r\n"))
 	if err != nil {
 		return fmt.Errorf("error writing final header CRLF: %w", err)
 	}
+	w.setupBody(headers)
 	w.writerState = writeBOD
 	return nil
 }
 
+func (w *Writer) setupBody(h headers.Headers) {
+	var body io.Writer = w.Writer
+	if w.transport != nil {
+		body = w.transport
+	} else {
+		te, _ := h.Get("transfer-encoding")
+		w.chunked = strings.Contains(strings.ToLower(te), "chunked")
+		if w.chunked {
+			body = &chunkWriter{w: w.Writer}
+		}
+	}
+	body = &countingWriter{w: body, n: &w.bodyBytes}
+	for _, wrap := range w.bodyWrappers {
+		wc := wrap(body)
+		w.bodyClosers = append(w.bodyClosers, wc)
+		body = wc
+	}
+	w.body = body
+}
+
 func (w *Writer) WriteBody(body []byte) (int, error) {
-	if w.writerState != writeBOD {
-		return 0, errOutOfOrderCall
+	if err := w.checkState(writeBOD); err != nil {
+		return 0, err
 	}
-	n, err := w.Writer.Write(body)
+	n, err := w.body.Write(body)
 	if err != nil {
 		return 0, fmt.Errorf("error writing body %w", err)
 	}
-	w.writerState = writeSL
 	return n, nil
 }
 
+// BodyWriter adapts WriteBody to io.Writer so bodies can be streamed with
+// io.Copy.
+func (w *Writer) BodyWriter() io.Writer {
+	return bodyWriter{w}
+}
+
+type bodyWriter struct {
+	w *Writer
+}
+
+func (b bodyWriter) Write(p []byte) (int, error) {
+	return b.w.WriteBody(p)
+}
+
+// A Hijacker releases the connection behind a Writer along with any bytes
+// the server has already read from it but not consumed.
+type Hijacker func() (net.Conn, []byte, error)
+
+// SetHijacker installs the function Hijack uses to take over the
+// connection. Servers set it; without one Hijack falls back to the
+// underlying writer when it is a net.Conn.
+func (w *Writer) SetHijacker(hijacker Hijacker) {
+	w.hijacker = hijacker
+}
+
+// Hijack hands the underlying connection to the caller together with any
+// bytes that were read past the end of the request. The server stops
+// managing the connection: the response is not finished and the
+// connection is not closed once the handler returns. It must be called
+// before anything has been written.
+func (w *Writer) Hijack() (net.Conn, []byte, error) {
+	if err := w.checkState(writeSL); err != nil {
+		return nil, nil, err
+	}
+
+	var conn net.Conn
+	var buffered []byte
+	if w.hijacker != nil {
+		var err error
+		conn, buffered, err = w.hijacker()
+		if err != nil {
+			return nil, nil, err
+		}
+	} else {
+		var ok bool
+		if conn, ok = w.Writer.(net.Conn); !ok {
+			return nil, nil, ErrNotHijackable
+		}
+	}
+	w.writerState = hijacked
+	return conn, buffered, nil
+}
+
+func (w *Writer) Hijacked() bool {
+	return w.writerState == hijacked
+}
+
+// SetHijackedStatus records the status of a response the handler wrote
+// itself on the hijacked connection, so that StatusCode reports it.
+func (w *Writer) SetHijackedStatus(statusCode StatusCode) {
+	if w.writerState == hijacked {
+		w.statusCode = statusCode
+	}
+}
+
+type flusher interface {
+	Flush() error
+}
+
+// Flush pushes any data held by body wrappers out to the connection.
+func (w *Writer) Flush() error {
+	for i := len(w.bodyClosers) - 1; i >= 0; i-- {
+		if f, ok := w.bodyClosers[i].(flusher); ok {
+			if err := f.Flush(); err != nil {
+				return fmt.Errorf("error flushing body: %w", err)
+			}
+		}
+	}
+	if f, ok := w.transport.(flusher); ok {
+		if err := f.Flush(); err != nil {
+			return fmt.Errorf("error flushing body: %w", err)
+		}
+	}
+	return nil
+}
+
+// Finish closes the body wrappers and terminates a chunked body. It is
+// safe to call more than once; the server calls it after every handler.
+func (w *Writer) Finish() error {
+	if w.finished || w.writerState != writeBOD {
+		return nil
+	}
+	w.finished = true
+	for i := len(w.bodyClosers) - 1; i >= 0; i-- {
+		if err := w.bodyClosers[i].Close(); err != nil {
+			return fmt.Errorf("error closing body: %w", err)
+		}
+	}
+	if w.transport != nil {
+		if err := w.transport.Close(); err != nil {
+			return fmt.Errorf("error ending body: %w", err)
+		}
+	}
+	if w.chunked {
+		if _, err := w.Writer.Write([]byte(chunkedTerminator)); err != nil {
+			return fmt.Errorf("error writing chunked resp end mark: %w", err)
+		}
+	}
+	return nil
+}
+
 func (w *Writer) Write(statusCode StatusCode, headers headers.Headers, body []byte) error {
 	err := w.WriteStatusLine(statusCode)
 	if err != nil {
@@ -113,6 +366,50 @@ func (w *Writer) Write(statusCode StatusCode, headers headers.Headers, body []by
 }
 
 func (w *Writer) WriteChunkedBody(p []byte) (int, error) {
+	if (w.chunked || w.transport != nil) && w.writerState == writeBOD {
+		return w.WriteBody(p)
+	}
+	return writeChunk(w.Writer, p)
+}
+
+func (w *Writer) WriteChunkedBodyDone() (int, error) {
+	if (w.chunked || w.transport != nil) && w.writerState == writeBOD {
+		if w.finished {
+			return 0, nil
+		}
+		if err := w.Finish(); err != nil {
+			return 0, err
+		}
+		return len(chunkedTerminator), nil
+	}
+	resp := []byte(chunkedTerminator)
+	r, err := w.Writer.Write(resp)
+	if err != nil {
+		return 0, fmt.Errorf("error writing chunked resp end mark")
+	}
+	return r, nil
+}
+
+type countingWriter struct {
+	w io.Writer
+	n *int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	*c.n += int64(n)
+	return n, err
+}
+
+type chunkWriter struct {
+	w io.Writer
+}
+
+func (c *chunkWriter) Write(p []byte) (int, error) {
+	return writeChunk(c.w, p)
+}
+
+func writeChunk(w io.Writer, p []byte) (int, error) {
 	payloadSize := len(p)
 	if payloadSize == 0 {
 		return 0, nil
@@ -124,19 +421,9 @@ func (w *Writer) WriteChunkedBody(p []byte) (int, error) {
 	chunk = append(chunk, p...)
 	chunk = append(chunk, []byte("\r\n")...)
 
-	_, err := w.Writer.Write(chunk)
+	_, err := w.Write(chunk)
 	if err != nil {
 		return 0, fmt.Errorf("there was an error %w", err)
 	}
 	return payloadSize, nil
 }
-
-func (w *Writer) WriteChunkedBodyDone() (int, error) {
-	resp := []byte("0\r\n\r\n")
-	fmt.Println("ONE TIME")
-	r, err := w.Writer.Write(resp)
-	if err != nil {
-		return 0, fmt.Errorf("error writing chunked resp end mark")
-	}
-	return r, nil
-}
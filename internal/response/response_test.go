@@ -0,0 +1,126 @@
+package response
+
+import (
+	"bytes"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/PeterKWIlliams/http/internal/headers"
+)
+
+func TestHijack(t *testing.T) {
+	serverConn, clientConn := net.Pipe()
+	defer serverConn.Close()
+	defer clientConn.Close()
+
+	w := &Writer{Writer: serverConn}
+	w.SetHijacker(func() (net.Conn, []byte, error) {
+		return serverConn, []byte("leftover"), nil
+	})
+	conn, buffered, err := w.Hijack()
+	require.NoError(t, err)
+	assert.Equal(t, serverConn, conn)
+	assert.Equal(t, []byte("leftover"), buffered)
+	assert.True(t, w.Hijacked())
+	assert.Zero(t, w.StatusCode())
+	w.SetHijackedStatus(SwitchingProtocols)
+	assert.Equal(t, SwitchingProtocols, w.StatusCode())
+
+	// Test: The writer is unusable once hijacked
+	assert.ErrorIs(t, w.WriteStatusLine(OK), ErrHijacked)
+	_, _, err = w.Hijack()
+	assert.ErrorIs(t, err, ErrHijacked)
+	assert.NoError(t, w.Finish())
+}
+
+func TestHijack_Errors(t *testing.T) {
+	// Test: Writer that is not a connection
+	w := &Writer{Writer: &bytes.Buffer{}}
+	_, _, err := w.Hijack()
+	assert.ErrorIs(t, err, ErrNotHijackable)
+
+	// Test: Response already started
+	serverConn, clientConn := net.Pipe()
+	defer serverConn.Close()
+	defer clientConn.Close()
+	go func() {
+		buf := make([]byte, 64)
+		_, _ = clientConn.Read(buf)
+	}()
+	w = &Writer{Writer: serverConn}
+	require.NoError(t, w.WriteStatusLine(OK))
+	_, _, err = w.Hijack()
+	assert.Error(t, err)
+	assert.False(t, w.Hijacked())
+}
+
+type recordingTransport struct {
+	statusCode StatusCode
+	headers    headers.Headers
+	body       bytes.Buffer
+	closed     bool
+}
+
+func (r *recordingTransport) WriteHeader(statusCode StatusCode, h headers.Headers) error {
+	r.statusCode = statusCode
+	r.headers = h
+	return nil
+}
+
+func (r *recordingTransport) Write(p []byte) (int, error) {
+	return r.body.Write(p)
+}
+
+func (r *recordingTransport) Close() error {
+	r.closed = true
+	return nil
+}
+
+func TestTransport(t *testing.T) {
+	transport := &recordingTransport{}
+	w := &Writer{}
+	w.SetTransport(transport)
+	w.OnWriteHeaders(func(_ StatusCode, h headers.Headers) {
+		h.Set("x-hook", "ran")
+	})
+
+	h := GetDefaultHeaders(0)
+	h.Delete("content-length")
+	h.Set("transfer-encoding", "chunked")
+	require.NoError(t, w.WriteStatusLine(NotFound))
+	require.NoError(t, w.WriteHeaders(h))
+	_, err := w.WriteChunkedBody([]byte("hello "))
+	require.NoError(t, err)
+	_, err = w.WriteBody([]byte("world"))
+	require.NoError(t, err)
+	require.NoError(t, w.Finish())
+
+	assert.Equal(t, NotFound, transport.statusCode)
+	assert.Equal(t, "ran", transport.headers["x-hook"])
+	assert.Equal(t, "hello world", transport.body.String(), "body must not be chunk encoded")
+	assert.True(t, transport.closed)
+
+	_, _, err = (&Writer{transport: transport}).Hijack()
+	assert.ErrorIs(t, err, ErrNotHijackable)
+}
+
+func TestBodyBytes(t *testing.T) {
+	var out bytes.Buffer
+	w := &Writer{Writer: &out}
+	h := headers.NewHeaders()
+	h.Set("transfer-encoding", "chunked")
+	require.NoError(t, w.WriteStatusLine(OK))
+	require.NoError(t, w.WriteHeaders(h))
+	_, err := w.WriteBody([]byte("hello"))
+	require.NoError(t, err)
+	_, err = w.WriteBody([]byte(", world"))
+	require.NoError(t, err)
+	require.NoError(t, w.Finish())
+
+	// Test: Chunk framing is not counted as body
+	assert.Equal(t, int64(12), w.BodyBytes())
+	assert.Contains(t, out.String(), "5\r\nhello\r\n")
+}
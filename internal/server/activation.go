@@ -0,0 +1,265 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Environment used to hand listening sockets to a process. LISTEN_PID,
+// LISTEN_FDS and LISTEN_FDNAMES follow systemd's sd_listen_fds protocol.
+// Reexec cannot know the child's pid in advance, so it sets
+// LISTEN_PARENT_PID to its own pid instead, and LISTEN_READY_FD to the
+// descriptor the child reports readiness on.
+const (
+	envListenPID       = "LISTEN_PID"
+	envListenFDs       = "LISTEN_FDS"
+	envListenFDNames   = "LISTEN_FDNAMES"
+	envListenParentPID = "LISTEN_PARENT_PID"
+	envListenReadyFD   = "LISTEN_READY_FD"
+	envNotifySocket    = "NOTIFY_SOCKET"
+
+	// listenFDsStart is the first inherited descriptor, after stdin,
+	// stdout and stderr.
+	listenFDsStart = 3
+)
+
+// DefaultReexecTimeout is how long Reexec waits for the new process to
+// report that it is ready.
+const DefaultReexecTimeout = 30 * time.Second
+
+// A NamedListener pairs a listener with the name it is passed on under,
+// such as systemd's FileDescriptorName=.
+type NamedListener struct {
+	Name     string
+	Listener net.Listener
+}
+
+// InheritedListeners returns the listening sockets passed to the process
+// by systemd socket activation or by Reexec, or nil when there are none.
+// The environment variables describing them are cleared so that child
+// processes do not claim the same descriptors.
+func InheritedListeners() ([]NamedListener, error) {
+	n, names, err := parseListenEnv(os.Getenv, os.Getpid(), os.Getppid())
+	defer func() {
+		os.Unsetenv(envListenPID)
+		os.Unsetenv(envListenFDs)
+		os.Unsetenv(envListenFDNames)
+		os.Unsetenv(envListenParentPID)
+	}()
+	if err != nil || n == 0 {
+		return nil, err
+	}
+
+	listeners := make([]NamedListener, 0, n)
+	for i := 0; i < n; i++ {
+		f := os.NewFile(uintptr(listenFDsStart+i), names[i])
+		l, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			for _, nl := range listeners {
+				nl.Listener.Close()
+			}
+			return nil, fmt.Errorf("inherited fd %d (%s): %w", listenFDsStart+i, names[i], err)
+		}
+		listeners = append(listeners, NamedListener{Name: names[i], Listener: l})
+	}
+	return listeners, nil
+}
+
+// parseListenEnv reports how many descriptors were passed to the process
+// with pid and parent ppid, and their names.
+func parseListenEnv(getenv func(string) string, pid, ppid int) (int, []string, error) {
+	fds := getenv(envListenFDs)
+	if fds == "" {
+		return 0, nil, nil
+	}
+	switch {
+	case getenv(envListenPID) != "":
+		if getenv(envListenPID) != strconv.Itoa(pid) {
+			return 0, nil, nil
+		}
+	case getenv(envListenParentPID) != "":
+		if getenv(envListenParentPID) != strconv.Itoa(ppid) {
+			return 0, nil, nil
+		}
+	default:
+		return 0, nil, nil
+	}
+
+	n, err := strconv.Atoi(fds)
+	if err != nil || n < 0 {
+		return 0, nil, fmt.Errorf("invalid %s %q", envListenFDs, fds)
+	}
+	names := make([]string, n)
+	if v := getenv(envListenFDNames); v != "" {
+		parts := strings.Split(v, ":")
+		if len(parts) != n {
+			return 0, nil, fmt.Errorf("%s has %d names for %d descriptors", envListenFDNames, len(parts), n)
+		}
+		copy(names, parts)
+	}
+	for i := range names {
+		if names[i] == "" {
+			names[i] = "unknown"
+		}
+	}
+	return n, names, nil
+}
+
+// FindListener returns the first listener named name.
+func FindListener(listeners []NamedListener, name string) (net.Listener, bool) {
+	for _, nl := range listeners {
+		if nl.Name == name {
+			return nl.Listener, true
+		}
+	}
+	return nil, false
+}
+
+type filer interface {
+	File() (*os.File, error)
+}
+
+var errNotReady = errors.New("new process exited before it was ready")
+
+// Reexec starts a new copy of the running executable with the same
+// arguments, passing it listeners to pick up with InheritedListeners.
+// It returns once the new process has called NotifyReady, after which
+// the caller should stop accepting and drain, typically with
+// Server.Shutdown. If the new process fails to become ready within
+// timeout it is killed and the caller keeps serving.
+//
+// Unix listeners are switched to leave their socket file in place when
+// closed, since the new process is now serving it.
+func Reexec(listeners []NamedListener, timeout time.Duration) (*os.Process, error) {
+	exe, err := os.Executable()
+	if err != nil {
+		return nil, err
+	}
+
+	var files []*os.File
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+	names := make([]string, 0, len(listeners))
+	for _, nl := range listeners {
+		lf, ok := nl.Listener.(filer)
+		if !ok {
+			return nil, fmt.Errorf("listener %q of type %T cannot be passed on", nl.Name, nl.Listener)
+		}
+		f, err := lf.File()
+		if err != nil {
+			return nil, fmt.Errorf("listener %q: %w", nl.Name, err)
+		}
+		files = append(files, f)
+		names = append(names, nl.Name)
+	}
+
+	readyR, readyW, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	defer readyR.Close()
+	files = append(files, readyW)
+
+	env := make([]string, 0, len(os.Environ())+5)
+	for _, kv := range os.Environ() {
+		switch strings.SplitN(kv, "=", 2)[0] {
+		case envListenPID, envListenFDs, envListenFDNames, envListenParentPID, envListenReadyFD:
+			continue
+		}
+		env = append(env, kv)
+	}
+	env = append(env,
+		envListenFDs+"="+strconv.Itoa(len(listeners)),
+		envListenFDNames+"="+strings.Join(names, ":"),
+		envListenParentPID+"="+strconv.Itoa(os.Getpid()),
+		envListenReadyFD+"="+strconv.Itoa(listenFDsStart+len(listeners)),
+	)
+
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Env = env
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = files
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	// Our copy of the write end must be closed for the read below to see
+	// EOF if the child exits without reporting.
+	readyW.Close()
+	files = files[:len(files)-1]
+
+	ready := make(chan error, 1)
+	go func() {
+		buf := make([]byte, 1)
+		if _, err := readyR.Read(buf); err != nil {
+			ready <- errNotReady
+			return
+		}
+		ready <- nil
+	}()
+	select {
+	case err = <-ready:
+	case <-time.After(timeout):
+		err = fmt.Errorf("new process not ready after %v", timeout)
+	}
+	if err != nil {
+		cmd.Process.Kill()
+		cmd.Wait()
+		return nil, err
+	}
+	go cmd.Wait()
+
+	for _, nl := range listeners {
+		if ul, ok := nl.Listener.(*net.UnixListener); ok {
+			ul.SetUnlinkOnClose(false)
+		}
+	}
+	return cmd.Process, nil
+}
+
+// NotifyReady tells the process that started this one with Reexec that
+// it is serving, and systemd, when running under Type=notify, that this
+// process is now the service's main process. It does nothing otherwise.
+func NotifyReady() error {
+	var errs []error
+	if v := os.Getenv(envListenReadyFD); v != "" {
+		os.Unsetenv(envListenReadyFD)
+		fd, err := strconv.Atoi(v)
+		if err != nil {
+			return fmt.Errorf("invalid %s %q", envListenReadyFD, v)
+		}
+		f := os.NewFile(uintptr(fd), "ready")
+		_, err = f.Write([]byte{1})
+		f.Close()
+		errs = append(errs, err)
+	}
+	if addr := os.Getenv(envNotifySocket); addr != "" {
+		errs = append(errs, sdNotify(addr, "READY=1\nMAINPID="+strconv.Itoa(os.Getpid())))
+	}
+	return errors.Join(errs...)
+}
+
+// sdNotify sends state to the systemd notification socket at addr.
+func sdNotify(addr, state string) error {
+	if strings.HasPrefix(addr, "@") {
+		addr = "\x00" + addr[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: addr, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte(state))
+	return err
+}
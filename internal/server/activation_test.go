@@ -0,0 +1,141 @@
+package server
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/PeterKWIlliams/http/internal/request"
+	"github.com/PeterKWIlliams/http/internal/response"
+)
+
+// reexecChildEnv makes the test binary act as the process started by
+// Reexec instead of running tests.
+const reexecChildEnv = "SERVER_TEST_REEXEC_CHILD"
+
+func TestMain(m *testing.M) {
+	if mode := os.Getenv(reexecChildEnv); mode != "" {
+		runReexecChild(mode)
+		return
+	}
+	os.Exit(m.Run())
+}
+
+func runReexecChild(mode string) {
+	listeners, err := InheritedListeners()
+	if err != nil || len(listeners) != 1 {
+		os.Exit(1)
+	}
+	body := []byte(strconv.Itoa(os.Getpid()) + " " + listeners[0].Name + " " + os.Getenv(envListenFDs))
+	s := New(func(w *response.Writer, req *request.Request) {
+		w.Write(response.OK, response.GetDefaultHeaders(len(body)), body)
+	})
+	go s.Serve(listeners[0].Listener)
+	if mode == "ready" {
+		NotifyReady()
+	}
+	time.Sleep(10 * time.Second)
+}
+
+func TestParseListenEnv(t *testing.T) {
+	tests := []struct {
+		name    string
+		env     map[string]string
+		n       int
+		names   []string
+		wantErr bool
+	}{
+		{name: "none"},
+		{
+			name:  "systemd",
+			env:   map[string]string{"LISTEN_PID": "10", "LISTEN_FDS": "2", "LISTEN_FDNAMES": "http:https"},
+			n:     2,
+			names: []string{"http", "https"},
+		},
+		{
+			name:  "unnamed",
+			env:   map[string]string{"LISTEN_PID": "10", "LISTEN_FDS": "1"},
+			n:     1,
+			names: []string{"unknown"},
+		},
+		{
+			name: "for another process",
+			env:  map[string]string{"LISTEN_PID": "11", "LISTEN_FDS": "1"},
+		},
+		{
+			name:  "from parent",
+			env:   map[string]string{"LISTEN_PARENT_PID": "1", "LISTEN_FDS": "1", "LISTEN_FDNAMES": "http"},
+			n:     1,
+			names: []string{"http"},
+		},
+		{
+			name: "without pid",
+			env:  map[string]string{"LISTEN_FDS": "1"},
+		},
+		{
+			name:    "bad count",
+			env:     map[string]string{"LISTEN_PID": "10", "LISTEN_FDS": "x"},
+			wantErr: true,
+		},
+		{
+			name:    "names mismatch",
+			env:     map[string]string{"LISTEN_PID": "10", "LISTEN_FDS": "2", "LISTEN_FDNAMES": "http"},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			getenv := func(key string) string { return tt.env[key] }
+			n, names, err := parseListenEnv(getenv, 10, 1)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.n, n)
+			assert.Equal(t, tt.names, names)
+		})
+	}
+}
+
+func TestReexec(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+	addr := l.Addr().String()
+
+	// Test: The new process serves the passed listener once ready
+	t.Setenv(reexecChildEnv, "ready")
+	proc, err := Reexec([]NamedListener{{Name: "http", Listener: l}}, 5*time.Second)
+	require.NoError(t, err)
+	defer proc.Kill()
+	l.Close()
+
+	conn, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	_, err = conn.Write([]byte("GET / HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	require.NoError(t, err)
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	require.NoError(t, err)
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.Equal(t, strconv.Itoa(proc.Pid)+" http ", string(body))
+
+	// Test: A process that never becomes ready is killed
+	l, err = net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+	t.Setenv(reexecChildEnv, "hang")
+	_, err = Reexec([]NamedListener{{Name: "http", Listener: l}}, 200*time.Millisecond)
+	assert.Error(t, err)
+}
@@ -0,0 +1,107 @@
+package server
+
+import "net"
+
+// A ConnState is a stage in the life of a connection, reported to the
+// hook set with WithConnState.
+type ConnState int
+
+const (
+	// StateNew connections have been accepted but have not sent any
+	// request bytes yet.
+	StateNew ConnState = iota
+	// StateActive connections are receiving or serving a request, or for
+	// HTTP/2 have at least one open stream.
+	StateActive
+	// StateIdle connections are waiting for their next request, or for
+	// HTTP/2 have no open streams.
+	StateIdle
+	// StateHijacked connections were taken over by a handler. This is a
+	// final state; the server no longer tracks them.
+	StateHijacked
+	// StateClosed connections have been closed. This is a final state.
+	StateClosed
+)
+
+var connStateNames = map[ConnState]string{
+	StateNew:      "new",
+	StateActive:   "active",
+	StateIdle:     "idle",
+	StateHijacked: "hijacked",
+	StateClosed:   "closed",
+}
+
+func (c ConnState) String() string {
+	return connStateNames[c]
+}
+
+// WithConnState sets a hook called whenever a connection changes state.
+// Calls for different connections may run concurrently, so the hook must
+// be safe for concurrent use, and it must not block.
+func WithConnState(hook func(conn net.Conn, state ConnState)) Option {
+	return func(s *Server) {
+		s.connStateHook = hook
+	}
+}
+
+func (s *Server) setState(conn net.Conn, state ConnState) {
+	if !s.trackState(conn, state) || s.connStateHook == nil {
+		return
+	}
+	s.connStateHook(conn, state)
+}
+
+// trackState records state for conn and reports whether it changed.
+func (s *Server) trackState(conn net.Conn, state ConnState) bool {
+	s.stateMu.Lock()
+	defer s.stateMu.Unlock()
+	if s.conns == nil {
+		s.conns = map[net.Conn]ConnState{}
+	}
+	old, tracked := s.conns[conn]
+	if tracked && old == state {
+		return false
+	}
+	if !tracked && state != StateNew {
+		// Already hijacked or closed.
+		return false
+	}
+	switch state {
+	case StateHijacked, StateClosed:
+		delete(s.conns, conn)
+	default:
+		s.conns[conn] = state
+	}
+	return true
+}
+
+// closeIdleConns closes connections that are not serving a request and
+// reports whether no connections are left. Closed connections are
+// forgotten once their handler notices.
+func (s *Server) closeIdleConns() bool {
+	s.stateMu.Lock()
+	defer s.stateMu.Unlock()
+	for conn, state := range s.conns {
+		if state == StateNew || state == StateIdle {
+			conn.Close()
+		}
+	}
+	return len(s.conns) == 0
+}
+
+// activityReader marks its connection active once the first bytes of a
+// request arrive, so Shutdown leaves it to finish.
+type activityReader struct {
+	s      *Server
+	conn   net.Conn
+	active bool
+}
+
+func (r *activityReader) Read(p []byte) (int, error) {
+	n, err := r.conn.Read(p)
+	if n > 0 && !r.active {
+		r.active = true
+		r.s.setState(r.conn, StateActive)
+	}
+	return n, err
+}
@@ -0,0 +1,53 @@
+package server
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+
+	"github.com/PeterKWIlliams/http/internal/headers"
+	"github.com/PeterKWIlliams/http/internal/request"
+	"github.com/PeterKWIlliams/http/internal/response"
+)
+
+const (
+	RequestIDHeader = "x-request-id"
+
+	maxRequestIDLength = 128
+)
+
+// RequestID gives every request an ID, stored in its context for
+// request.IDFromContext and echoed in the X-Request-Id response header.
+// A well-formed X-Request-Id from the client is kept so IDs can be
+// followed across services; otherwise a random one is generated.
+func RequestID() Middleware {
+	return func(next Handler) Handler {
+		return func(w *response.Writer, req *request.Request) {
+			id, err := req.Headers.Get(RequestIDHeader)
+			if err != nil || !validRequestID(id) {
+				id = newRequestID()
+			}
+			w.OnWriteHeaders(func(_ response.StatusCode, h headers.Headers) {
+				h.Set(RequestIDHeader, id)
+			})
+			next(w, req.WithContext(request.ContextWithID(req.Context(), id)))
+		}
+	}
+}
+
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] <= ' ' || id[i] > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+func newRequestID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
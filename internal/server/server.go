@@ -1,69 +1,410 @@
 package server
 
 import (
+	"context"
+	"crypto/tls"
 	"errors"
 	"fmt"
+	"io"
 	"log"
+	"math"
 	"net"
 	"strconv"
+	"strings"
+	"sync"
 	"sync/atomic"
+	"time"
 
+	"github.com/PeterKWIlliams/http/internal/headers"
+	"github.com/PeterKWIlliams/http/internal/http2"
 	"github.com/PeterKWIlliams/http/internal/request"
 	"github.com/PeterKWIlliams/http/internal/response"
 )
 
 type Server struct {
+	// Addr is the address of the most recent listener passed to Serve, as
+	// actually bound, e.g. with the port chosen for ":0".
 	Addr     string
-	listener net.Listener
 	isClosed atomic.Bool
 	Handler  Handler
+	Name     string
+
+	mu        sync.Mutex
+	listeners []net.Listener
+	// done is closed by Close to stop background work such as
+	// certificate reloading.
+	done chan struct{}
+
+	// stateMu guards conns. connStateHook is called without it held.
+	stateMu       sync.Mutex
+	conns         map[net.Conn]ConnState
+	connStateHook func(net.Conn, ConnState)
+
+	// connSlots and requestSlots are semaphores for the limits set by
+	// WithMaxConnections and WithMaxRequests. rejectSlots bounds how many
+	// connections over the limit are being answered with 503 at once.
+	connSlots    chan struct{}
+	requestSlots chan struct{}
+	rejectSlots  chan struct{}
+	retryAfter   time.Duration
+
+	requestTimeout time.Duration
+	parseErrorHook func(error)
+	lastConnID     atomic.Uint64
+	// ctx is the parent of every request context and is cancelled by
+	// Close.
+	ctx    context.Context
+	cancel context.CancelFunc
 }
 
+// shutdownPollInterval is how often Shutdown checks for idle connections.
+const shutdownPollInterval = 10 * time.Millisecond
+
 type Handler func(w *response.Writer, req *request.Request)
 
-func Serve(port int, handler Handler) (*Server, error) {
-	listenAddr := ":" + strconv.Itoa(port)
-	listener, err := net.Listen("tcp", listenAddr)
-	if err != nil {
-		return nil, err
+type Middleware func(Handler) Handler
+
+// Chain wraps handler with middlewares so that the first middleware is the
+// outermost one.
+func Chain(handler Handler, middlewares ...Middleware) Handler {
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		handler = middlewares[i](handler)
 	}
-	server := &Server{
-		listener: listener,
-		Addr:     listenAddr,
-		Handler:  handler,
+	return handler
+}
+
+type Option func(*Server)
+
+// WithName sets the value advertised in the Server response header. No
+// Server header is sent when the name is empty.
+func WithName(name string) Option {
+	return func(s *Server) {
+		s.Name = name
 	}
+}
 
-	go func() {
-		server.listen()
-	}()
-	return server, nil
+// WithMaxConnections limits how many connections are served at once.
+// Once the limit is reached the server stops accepting until one closes,
+// or turns new ones away if WithRetryAfter is set. Hijacked connections
+// no longer count. An n of zero or less means no limit.
+func WithMaxConnections(n int) Option {
+	return func(s *Server) {
+		if n <= 0 {
+			s.connSlots = nil
+			return
+		}
+		s.connSlots = make(chan struct{}, n)
+		s.rejectSlots = make(chan struct{}, maxRejecting)
+	}
 }
 
-func (s *Server) Close() error {
-	s.isClosed.Store(true)
-	err := s.listener.Close()
+// WithMaxRequests limits how many handlers run at once, across HTTP/1.1
+// connections and HTTP/2 streams. Further requests wait for a slot, or
+// are answered with 503 if WithRetryAfter is set. An n of zero or less
+// means no limit.
+func WithMaxRequests(n int) Option {
+	return func(s *Server) {
+		if n <= 0 {
+			s.requestSlots = nil
+			return
+		}
+		s.requestSlots = make(chan struct{}, n)
+	}
+}
+
+// WithRetryAfter makes a saturated server answer 503 Service Unavailable
+// with a Retry-After of d instead of waiting for capacity.
+func WithRetryAfter(d time.Duration) Option {
+	return func(s *Server) {
+		s.retryAfter = d
+	}
+}
+
+// WithRequestTimeout sets a deadline on each request's context, d after
+// the handler is called. Handlers that respect the context stop when it
+// passes; the server does not interrupt them.
+func WithRequestTimeout(d time.Duration) Option {
+	return func(s *Server) {
+		s.requestTimeout = d
+	}
+}
+
+// WithParseErrorHook sets a hook called with the error whenever a
+// request cannot be parsed and is answered with 400, or for HTTP/2 has
+// its stream reset.
+func WithParseErrorHook(hook func(err error)) Option {
+	return func(s *Server) {
+		s.parseErrorHook = hook
+	}
+}
+
+// ErrServerClosed is returned by Server.Serve once Close has been called.
+var ErrServerClosed = errors.New("server closed")
+
+func New(handler Handler, opts ...Option) *Server {
+	server := &Server{Handler: handler}
+	for _, opt := range opts {
+		opt(server)
+	}
+	return server
+}
+
+// Serve listens on port on all interfaces and serves connections in the
+// background.
+func Serve(port int, handler Handler, opts ...Option) (*Server, error) {
+	listener, err := net.Listen("tcp", ":"+strconv.Itoa(port))
 	if err != nil {
-		return fmt.Errorf("failed to close listener: %w", err)
+		return nil, err
 	}
-	return nil
+	server := New(handler, opts...)
+	server.track(listener)
+	go server.serve(listener)
+	return server, nil
+}
+
+// Serve accepts connections on l until the server is closed, and then
+// returns ErrServerClosed. It may be called for several listeners; Close
+// closes all of them.
+func (s *Server) Serve(l net.Listener) error {
+	if !s.track(l) {
+		l.Close()
+		return ErrServerClosed
+	}
+	return s.serve(l)
 }
 
-func (s *Server) listen() {
+// Accept errors other than a closed listener, such as running out of
+// file descriptors, are retried with a delay that doubles up to
+// maxAcceptDelay.
+const (
+	minAcceptDelay = 5 * time.Millisecond
+	maxAcceptDelay = time.Second
+)
+
+func (s *Server) serve(l net.Listener) error {
+	// Without a Retry-After to send, a full server simply stops accepting
+	// and leaves new connections in the listen backlog.
+	wait := s.connSlots != nil && s.retryAfter == 0
+	var delay time.Duration
 	for {
-		conn, err := s.listener.Accept()
+		if wait {
+			select {
+			case s.connSlots <- struct{}{}:
+			case <-s.doneChan():
+				return ErrServerClosed
+			}
+		}
+		conn, err := l.Accept()
+		if err != nil || s.isClosed.Load() {
+			if wait {
+				<-s.connSlots
+			}
+		}
 		if s.isClosed.Load() {
 			if err != nil && !errors.Is(err, net.ErrClosed) {
 				log.Printf("Non-ErrClosed error during shutdown %v", err)
 			}
-			return
+			if conn != nil {
+				conn.Close()
+			}
+			return ErrServerClosed
+		}
+		if errors.Is(err, net.ErrClosed) {
+			return err
 		}
 		if err != nil {
-			log.Printf("Error accepting connection:%v", err)
+			delay = min(max(2*delay, minAcceptDelay), maxAcceptDelay)
+			log.Printf("Error accepting connection: %v; retrying in %v", err, delay)
+			select {
+			case <-time.After(delay):
+			case <-s.doneChan():
+			}
 			continue
 		}
+		delay = 0
+
+		if s.connSlots != nil && !wait {
+			select {
+			case s.connSlots <- struct{}{}:
+			default:
+				select {
+				case s.rejectSlots <- struct{}{}:
+					go s.reject(conn)
+				default:
+					// Already turning away as many as we are
+					// willing to; drop this one unanswered.
+					conn.Close()
+				}
+				continue
+			}
+		}
+		go func() {
+			if s.connSlots != nil {
+				defer func() { <-s.connSlots }()
+			}
+			s.handle(conn)
+		}()
+	}
+}
+
+const (
+	// rejectTimeout bounds how long turning away a connection may take.
+	rejectTimeout = 5 * time.Second
+	// maxRejecting is how many connections may be turned away at once.
+	maxRejecting = 16
+	// rejectDrainLimit is how much of a rejected request is discarded
+	// after the response, so that closing does not reset the connection.
+	rejectDrainLimit = 64 << 10
+)
+
+// reject answers conn with 503 without reading its request and closes it.
+func (s *Server) reject(conn net.Conn) {
+	s.setState(conn, StateNew)
+	defer func() {
+		conn.Close()
+		s.setState(conn, StateClosed)
+		<-s.rejectSlots
+	}()
+	conn.SetDeadline(time.Now().Add(rejectTimeout))
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		if err := tlsConn.Handshake(); err != nil || tlsConn.ConnectionState().NegotiatedProtocol == "h2" {
+			return
+		}
+	}
+	w := &response.Writer{Writer: conn}
+	w.OnWriteHeaders(s.addDefaultHeaders)
+	if err := s.writeBusy(w); err != nil {
+		log.Printf("error rejecting connection: %v", err)
+		return
+	}
+	// Closing with the request still unread would reset the connection
+	// and could discard the response before the client reads it.
+	if cw, ok := conn.(interface{ CloseWrite() error }); ok {
+		cw.CloseWrite()
+	}
+	io.CopyN(io.Discard, conn, rejectDrainLimit)
+}
+
+// serveRequest runs the handler within the WithMaxRequests and
+// WithRequestTimeout limits.
+func (s *Server) serveRequest(w *response.Writer, req *request.Request) {
+	if s.requestTimeout > 0 {
+		ctx, cancel := context.WithTimeout(req.Context(), s.requestTimeout)
+		defer cancel()
+		req = req.WithContext(ctx)
+	}
+	if s.requestSlots != nil {
+		if s.retryAfter > 0 {
+			select {
+			case s.requestSlots <- struct{}{}:
+			default:
+				if err := s.writeBusy(w); err != nil {
+					log.Printf("error rejecting request: %v", err)
+				}
+				return
+			}
+		} else {
+			s.requestSlots <- struct{}{}
+		}
+		defer func() { <-s.requestSlots }()
+	}
+	s.Handler(w, req)
+}
+
+func (s *Server) writeBusy(w *response.Writer) error {
+	body := []byte("server is busy")
+	h := response.GetDefaultHeaders(len(body))
+	h.Set("retry-after", strconv.Itoa(int(math.Ceil(s.retryAfter.Seconds()))))
+	return w.Write(response.ServiceUnavailable, h, body)
+}
+
+// track records l so Close can close it, and reports false if the server
+// is already closed.
+func (s *Server) track(l net.Listener) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.isClosed.Load() {
+		return false
+	}
+	s.listeners = append(s.listeners, l)
+	s.Addr = l.Addr().String()
+	return true
+}
+
+// doneChan returns the channel closed by Close.
+func (s *Server) doneChan() <-chan struct{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.done == nil {
+		s.done = make(chan struct{})
+	}
+	return s.done
+}
+
+// baseContext returns the context cancelled by Close.
+func (s *Server) baseContext() context.Context {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.ctx == nil {
+		s.ctx, s.cancel = context.WithCancel(context.Background())
+	}
+	return s.ctx
+}
 
-		go s.handle(conn)
+func (s *Server) cancelRequests() {
+	s.baseContext()
+	s.cancel()
+}
 
+// Close stops the server accepting connections and cancels the contexts
+// of requests in flight. Use Shutdown to let them finish instead.
+func (s *Server) Close() error {
+	err := s.closeListeners()
+	s.cancelRequests()
+	return err
+}
+
+func (s *Server) closeListeners() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.isClosed.Swap(true) {
+		return nil
+	}
+	if s.done == nil {
+		s.done = make(chan struct{})
+	}
+	close(s.done)
+	var errs []error
+	for _, l := range s.listeners {
+		if err := l.Close(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if err := errors.Join(errs...); err != nil {
+		return fmt.Errorf("failed to close listener: %w", err)
+	}
+	return nil
+}
+
+// Shutdown stops the server accepting connections, closes idle ones and
+// waits for active ones to finish, or for ctx to end. HTTP/2 connections
+// are sent GOAWAY and close once their open streams complete. Hijacked
+// connections are not waited for. If ctx ends first, the contexts of the
+// remaining requests are cancelled.
+func (s *Server) Shutdown(ctx context.Context) error {
+	err := s.closeListeners()
+	ticker := time.NewTicker(shutdownPollInterval)
+	defer ticker.Stop()
+	for {
+		if s.closeIdleConns() {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			s.cancelRequests()
+			return ctx.Err()
+		case <-ticker.C:
+		}
 	}
 }
 
@@ -88,17 +429,243 @@ func WriteError(w *response.Writer, statusCode response.StatusCode, message stri
 }
 
 func (s *Server) handle(conn net.Conn) {
-	defer conn.Close()
-	req, err := request.RequestFromReader(conn)
+	connID := s.lastConnID.Add(1)
+	var tlsState *tls.ConnectionState
 	resWriter := &response.Writer{
 		Writer: conn,
 	}
+	s.setState(conn, StateNew)
+	defer func() {
+		if !resWriter.Hijacked() {
+			conn.Close()
+			s.setState(conn, StateClosed)
+		}
+	}()
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		tlsConn.SetDeadline(time.Now().Add(tlsHandshakeTimeout))
+		if err := tlsConn.Handshake(); err != nil {
+			log.Printf("TLS handshake with %s failed: %v", conn.RemoteAddr(), err)
+			return
+		}
+		tlsConn.SetDeadline(time.Time{})
+		state := tlsConn.ConnectionState()
+		tlsState = &state
+		if state.NegotiatedProtocol == "h2" {
+			s.setState(conn, StateIdle)
+			http2.ServeConn(conn, nil, s.http2Options(conn, connID))
+			return
+		}
+	}
+	activity := &activityReader{s: s, conn: conn}
+	src := &pendingReader{r: activity}
+	reader := request.NewReader(src)
+	for sequence := 1; ; sequence++ {
+		if sequence > 1 {
+			resWriter = &response.Writer{Writer: conn}
+			if len(src.pending) == 0 {
+				activity.active = false
+				s.setState(conn, StateIdle)
+			}
+			if s.isClosed.Load() {
+				return
+			}
+		}
+		if !s.serveHTTP1(conn, connID, sequence, tlsState, reader, src, resWriter) {
+			return
+		}
+	}
+}
+
+// serveHTTP1 reads and answers one HTTP/1.1 request on conn and reports
+// whether the connection can carry another.
+func (s *Server) serveHTTP1(conn net.Conn, connID uint64, sequence int, tlsState *tls.ConnectionState, reader *request.Reader, src *pendingReader, resWriter *response.Writer) bool {
+	var watcher *disconnectWatcher
+	resWriter.SetHijacker(func() (net.Conn, []byte, error) {
+		buffered := append(reader.Buffered(), src.pending...)
+		if watcher != nil {
+			buffered = append(buffered, watcher.stop()...)
+		}
+		s.setState(conn, StateHijacked)
+		return conn, buffered, nil
+	})
+	resWriter.OnWriteHeaders(s.addDefaultHeaders)
+	var resHeaders headers.Headers
+	resWriter.OnWriteHeaders(func(_ response.StatusCode, h headers.Headers) {
+		// Later hooks change the same map, so this sees the final headers.
+		resHeaders = h
+	})
+	req, err := reader.Next()
+	if errors.Is(err, io.EOF) {
+		return false
+	}
+	if errors.Is(err, request.ErrHTTP2Preface) && sequence == 1 {
+		s.setState(conn, StateIdle)
+		http2.ServeConn(conn, reader.Buffered(), s.http2Options(conn, connID))
+		return false
+	}
+	if err != nil && s.isClosed.Load() {
+		return false
+	}
 	if err != nil {
+		if s.parseErrorHook != nil {
+			s.parseErrorHook(err)
+		}
 		err = WriteError(resWriter, response.BadRequest, "could not process request")
 		if err != nil {
 			log.Printf("error %s", err)
 		}
-		return
+		return false
+	}
+	req.RemoteAddr = conn.RemoteAddr().String()
+	req.LocalAddr = conn.LocalAddr().String()
+	req.TLS = tlsState
+	req.Scheme = "http"
+	if tlsState != nil {
+		req.Scheme = "https"
+	}
+	req.ConnID = connID
+	req.Sequence = sequence
+	// h2c is cleartext only; over TLS HTTP/2 is negotiated with ALPN.
+	if tlsState == nil && http2.IsUpgrade(req) {
+		http2.ServeUpgrade(conn, reader.Buffered(), req, s.http2Options(conn, connID))
+		return false
+	}
+	ctx, cancel := context.WithCancel(s.baseContext())
+	defer cancel()
+	req = req.WithContext(ctx)
+	watcher = watchDisconnect(conn, cancel)
+	s.serveRequest(resWriter, req)
+	if resWriter.Hijacked() {
+		return false
+	}
+	err = resWriter.Finish()
+	src.pending = append(src.pending, watcher.stop()...)
+	if err != nil {
+		log.Printf("error finishing response: %v", err)
+		return false
+	}
+	return reusable(req, resHeaders, resWriter.BodyBytes())
+}
+
+// reusable reports whether a connection can be kept open after req was
+// answered with headers h and bodyBytes of body. Anything short of a
+// complete, delimited response that nobody asked to close ends it.
+func reusable(req *request.Request, h headers.Headers, bodyBytes int64) bool {
+	if h == nil || hasToken(req.Headers, "connection", "close") || hasToken(h, "connection", "close") {
+		return false
+	}
+	if _, err := req.Headers.Get("transfer-encoding"); err == nil {
+		// Only Content-Length request bodies are read.
+		return false
+	}
+	if hasToken(h, "transfer-encoding", "chunked") {
+		return true
+	}
+	cl, err := h.Get("content-length")
+	if err != nil {
+		return false
+	}
+	n, err := strconv.ParseInt(cl, 10, 64)
+	return err == nil && n == bodyBytes
+}
+
+func hasToken(h headers.Headers, name string, token string) bool {
+	value, err := h.Get(name)
+	if err != nil {
+		return false
+	}
+	for _, v := range strings.Split(value, ",") {
+		if strings.EqualFold(strings.TrimSpace(v), token) {
+			return true
+		}
+	}
+	return false
+}
+
+// pendingReader returns bytes read off the connection on its behalf
+// before reading further from r.
+type pendingReader struct {
+	r       io.Reader
+	pending []byte
+}
+
+func (p *pendingReader) Read(b []byte) (int, error) {
+	if len(p.pending) > 0 {
+		n := copy(b, p.pending)
+		p.pending = p.pending[n:]
+		return n, nil
+	}
+	return p.r.Read(b)
+}
+
+func (s *Server) http2Options(conn net.Conn, connID uint64) http2.Options {
+	return http2.Options{
+		Handler: s.serveRequest,
+		ConfigureWriter: func(w *response.Writer) {
+			w.OnWriteHeaders(s.addDefaultHeaders)
+		},
+		Shutdown:     s.doneChan(),
+		BaseContext:  s.baseContext(),
+		ConnID:       connID,
+		OnParseError: s.parseErrorHook,
+		OnActivity: func(active bool) {
+			if active {
+				s.setState(conn, StateActive)
+			} else {
+				s.setState(conn, StateIdle)
+			}
+		},
+	}
+}
+
+// A disconnectWatcher reads from a connection while its request is being
+// handled, to notice the client going away. Requests are read in full
+// before the handler runs, so the connection is otherwise idle.
+type disconnectWatcher struct {
+	conn net.Conn
+	done chan struct{}
+	buf  []byte
+}
+
+func watchDisconnect(conn net.Conn, cancel context.CancelFunc) *disconnectWatcher {
+	w := &disconnectWatcher{conn: conn, done: make(chan struct{})}
+	go func() {
+		defer close(w.done)
+		b := make([]byte, 1)
+		n, err := conn.Read(b)
+		if n > 0 {
+			// Data the client sent early, such as the start of a
+			// pipelined request, rather than a disconnect.
+			w.buf = b[:n]
+			return
+		}
+		var ne net.Error
+		if err != nil && !(errors.As(err, &ne) && ne.Timeout()) {
+			cancel()
+		}
+	}()
+	return w
+}
+
+// stop ends the watch and returns any byte it read.
+func (w *disconnectWatcher) stop() []byte {
+	select {
+	case <-w.done:
+	default:
+		w.conn.SetReadDeadline(time.Unix(1, 0))
+		<-w.done
+		w.conn.SetReadDeadline(time.Time{})
+	}
+	buf := w.buf
+	w.buf = nil
+	return buf
+}
+
+func (s *Server) addDefaultHeaders(_ response.StatusCode, h headers.Headers) {
+	if _, err := h.Get("date"); err != nil {
+		h.Set("date", response.HTTPDate())
+	}
+	if _, err := h.Get("server"); err != nil && s.Name != "" {
+		h.Set("server", s.Name)
 	}
-	s.Handler(resWriter, req)
 }
@@ -0,0 +1,561 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/PeterKWIlliams/http/internal/request"
+	"github.com/PeterKWIlliams/http/internal/response"
+)
+
+func okHandler(w *response.Writer, req *request.Request) {
+	body := []byte("ok")
+	w.Write(response.OK, response.GetDefaultHeaders(len(body)), body)
+}
+
+func roundTrip(t *testing.T, network string, addr string) *http.Response {
+	t.Helper()
+	conn, err := net.Dial(network, addr)
+	require.NoError(t, err)
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	_, err = conn.Write([]byte("GET / HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	require.NoError(t, err)
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	require.NoError(t, err)
+	return resp
+}
+
+func TestServer_Serve(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	s := New(okHandler, WithName("test"))
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- s.Serve(l)
+	}()
+
+	resp := roundTrip(t, "tcp", l.Addr().String())
+	assert.Equal(t, 200, resp.StatusCode)
+	assert.Equal(t, "test", resp.Header.Get("Server"))
+
+	require.NoError(t, s.Close())
+	assert.ErrorIs(t, <-errCh, ErrServerClosed)
+	assert.NoError(t, s.Close())
+
+	// Test: Serving after Close refuses the listener
+	l, err = net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	assert.ErrorIs(t, s.Serve(l), ErrServerClosed)
+	_, err = net.Dial("tcp", l.Addr().String())
+	assert.Error(t, err)
+}
+
+func TestServer_DefaultHeaders(t *testing.T) {
+	ownHeaders := func(w *response.Writer, req *request.Request) {
+		h := response.GetDefaultHeaders(0)
+		h.Set("date", "Thu, 01 Jan 1970 00:00:00 GMT")
+		h.Set("server", "handler")
+		w.WriteStatusLine(response.OK)
+		w.WriteHeaders(h)
+	}
+	serve := func(handler Handler, opts ...Option) string {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		s := New(handler, opts...)
+		go s.Serve(l)
+		t.Cleanup(func() { s.Close() })
+		return l.Addr().String()
+	}
+
+	resp := roundTrip(t, "tcp", serve(okHandler))
+	date, err := http.ParseTime(resp.Header.Get("Date"))
+	require.NoError(t, err)
+	assert.WithinDuration(t, time.Now(), date, 2*time.Second)
+	// Test: No Server header without a name
+	assert.Empty(t, resp.Header.Values("Server"))
+
+	resp = roundTrip(t, "tcp", serve(okHandler, WithName("test")))
+	assert.Equal(t, "test", resp.Header.Get("Server"))
+
+	// Test: Headers set by the handler are not overwritten
+	resp = roundTrip(t, "tcp", serve(ownHeaders, WithName("test")))
+	assert.Equal(t, "Thu, 01 Jan 1970 00:00:00 GMT", resp.Header.Get("Date"))
+	assert.Equal(t, "handler", resp.Header.Get("Server"))
+}
+
+func TestServe_ReportsBoundAddr(t *testing.T) {
+	s, err := Serve(0, okHandler)
+	require.NoError(t, err)
+	defer s.Close()
+	_, port, err := net.SplitHostPort(s.Addr)
+	require.NoError(t, err)
+	assert.NotEqual(t, "0", port)
+	assert.Equal(t, 200, roundTrip(t, "tcp", net.JoinHostPort("127.0.0.1", port)).StatusCode)
+}
+
+func TestServeUnix(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "http.sock")
+
+	// Test: A stale socket from a dead process is replaced
+	stale, err := net.Listen("unix", path)
+	require.NoError(t, err)
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+	require.FileExists(t, path)
+
+	s, err := ServeUnix(path, 0o660, okHandler)
+	require.NoError(t, err)
+	assert.Equal(t, path, s.Addr)
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0o660), info.Mode().Perm())
+	assert.Equal(t, 200, roundTrip(t, "unix", path).StatusCode)
+
+	// Test: A live socket is not taken over
+	_, err = ListenUnix(path, 0o600)
+	assert.ErrorContains(t, err, "already in use")
+
+	// Test: The socket file is removed on Close
+	require.NoError(t, s.Close())
+	assert.NoFileExists(t, path)
+
+	// Test: Other files are never removed
+	require.NoError(t, os.WriteFile(path, []byte("data"), 0o600))
+	_, err = ListenUnix(path, 0o600)
+	assert.ErrorContains(t, err, "not a socket")
+	assert.FileExists(t, path)
+}
+
+func TestWithRestrictiveUmask(t *testing.T) {
+	// Test: Files created while listening are never wider than the socket mode
+	path := filepath.Join(t.TempDir(), "file")
+	err := withRestrictiveUmask(0o600, func() error {
+		return os.WriteFile(path, nil, 0o666)
+	})
+	require.NoError(t, err)
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	assert.Zero(t, info.Mode().Perm()&^0o600)
+}
+
+func TestServer_Shutdown(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	started := make(chan struct{})
+	release := make(chan struct{})
+	s := New(func(w *response.Writer, req *request.Request) {
+		close(started)
+		<-release
+		okHandler(w, req)
+	})
+	go s.Serve(l)
+
+	idle, err := net.Dial("tcp", l.Addr().String())
+	require.NoError(t, err)
+	defer idle.Close()
+	active, err := net.Dial("tcp", l.Addr().String())
+	require.NoError(t, err)
+	defer active.Close()
+	active.SetDeadline(time.Now().Add(5 * time.Second))
+	_, err = active.Write([]byte("GET / HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	require.NoError(t, err)
+	<-started
+
+	// Test: Shutdown gives up when the context ends before requests finish
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	assert.ErrorIs(t, s.Shutdown(ctx), context.DeadlineExceeded)
+
+	// Test: Idle connections are closed and new ones refused
+	idle.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err = idle.Read(make([]byte, 1))
+	assert.ErrorIs(t, err, io.EOF)
+	_, err = net.Dial("tcp", l.Addr().String())
+	assert.Error(t, err)
+
+	// Test: The in-flight request completes and Shutdown then returns
+	done := make(chan error, 1)
+	go func() {
+		done <- s.Shutdown(context.Background())
+	}()
+	close(release)
+	resp, err := http.ReadResponse(bufio.NewReader(active), nil)
+	require.NoError(t, err)
+	assert.Equal(t, 200, resp.StatusCode)
+	assert.NoError(t, <-done)
+}
+
+// blockingHandler holds requests until release is closed.
+func blockingHandler(started chan<- struct{}, release <-chan struct{}) Handler {
+	return func(w *response.Writer, req *request.Request) {
+		started <- struct{}{}
+		<-release
+		okHandler(w, req)
+	}
+}
+
+func sendRequest(t *testing.T, addr string) net.Conn {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	_, err = conn.Write([]byte("GET / HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	require.NoError(t, err)
+	return conn
+}
+
+func TestServer_KeepAlive(t *testing.T) {
+	s, err := Serve(0, func(w *response.Writer, req *request.Request) {
+		body := []byte(fmt.Sprintf("%d %d", req.ConnID, req.Sequence))
+		h := response.GetDefaultHeaders(len(body))
+		h.Delete("connection")
+		w.Write(response.OK, h, body)
+	})
+	require.NoError(t, err)
+	defer s.Close()
+
+	// Test: Pipelined requests on one connection are numbered in order
+	conn, err := net.Dial("tcp", s.Addr)
+	require.NoError(t, err)
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	_, err = conn.Write([]byte("GET / HTTP/1.1\r\nHost: localhost\r\n\r\nGET / HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\n\r\n"))
+	require.NoError(t, err)
+	reader := bufio.NewReader(conn)
+	var connID string
+	for _, sequence := range []string{"1", "2"} {
+		resp, err := http.ReadResponse(reader, nil)
+		require.NoError(t, err)
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		id, seq, _ := strings.Cut(string(body), " ")
+		assert.Equal(t, sequence, seq)
+		if connID == "" {
+			connID = id
+		}
+		assert.Equal(t, connID, id)
+	}
+
+	// Test: The connection is closed after a request that asked for it
+	_, err = reader.ReadByte()
+	assert.ErrorIs(t, err, io.EOF)
+
+	// Test: Responses that say close still end the connection
+	s2, err := Serve(0, okHandler)
+	require.NoError(t, err)
+	defer s2.Close()
+	conn, err = net.Dial("tcp", s2.Addr)
+	require.NoError(t, err)
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	_, err = conn.Write([]byte("GET / HTTP/1.1\r\nHost: localhost\r\n\r\nGET / HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	require.NoError(t, err)
+	reader = bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, nil)
+	require.NoError(t, err)
+	assert.Equal(t, 200, resp.StatusCode)
+	_, err = io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	_, err = http.ReadResponse(reader, nil)
+	assert.Error(t, err)
+}
+
+func TestServer_MaxConnections(t *testing.T) {
+	// Test: A full server waits for a connection to close
+	started := make(chan struct{}, 2)
+	release := make(chan struct{})
+	s, err := Serve(0, blockingHandler(started, release), WithMaxConnections(1))
+	require.NoError(t, err)
+	defer s.Close()
+	first := sendRequest(t, s.Addr)
+	<-started
+	second := sendRequest(t, s.Addr)
+	select {
+	case <-started:
+		t.Fatal("second connection served while at the limit")
+	case <-time.After(100 * time.Millisecond):
+	}
+	close(release)
+	for _, conn := range []net.Conn{first, second} {
+		resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		require.NoError(t, err)
+		assert.Equal(t, 200, resp.StatusCode)
+	}
+
+	// Test: With a Retry-After, excess connections get 503
+	release = make(chan struct{})
+	defer close(release)
+	s, err = Serve(0, blockingHandler(started, release), WithMaxConnections(1), WithRetryAfter(1500*time.Millisecond))
+	require.NoError(t, err)
+	defer s.Close()
+	sendRequest(t, s.Addr)
+	<-started
+	resp, err := http.ReadResponse(bufio.NewReader(sendRequest(t, s.Addr)), nil)
+	require.NoError(t, err)
+	assert.Equal(t, 503, resp.StatusCode)
+	assert.Equal(t, "2", resp.Header.Get("Retry-After"))
+
+	// Test: The 503 does not wait for the request body
+	conn, err := net.Dial("tcp", s.Addr)
+	require.NoError(t, err)
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(time.Second))
+	_, err = conn.Write([]byte("POST / HTTP/1.1\r\nHost: localhost\r\nContent-Length: 1048576\r\n\r\n"))
+	require.NoError(t, err)
+	resp, err = http.ReadResponse(bufio.NewReader(conn), nil)
+	require.NoError(t, err)
+	assert.Equal(t, 503, resp.StatusCode)
+
+	// Test: Once enough connections are being turned away, further ones
+	// are closed without a response. The two above still hold their slots.
+	for i := 2; i < maxRejecting; i++ {
+		resp, err := http.ReadResponse(bufio.NewReader(sendRequest(t, s.Addr)), nil)
+		require.NoError(t, err)
+		assert.Equal(t, 503, resp.StatusCode)
+	}
+	reply, err := io.ReadAll(sendRequest(t, s.Addr))
+	assert.Empty(t, reply)
+	var ne net.Error
+	assert.False(t, errors.As(err, &ne) && ne.Timeout(), "connection was not closed")
+}
+
+func TestServer_MaxRequests(t *testing.T) {
+	started := make(chan struct{}, 2)
+	release := make(chan struct{})
+	defer close(release)
+	s, err := Serve(0, blockingHandler(started, release), WithMaxRequests(1), WithRetryAfter(time.Second))
+	require.NoError(t, err)
+	defer s.Close()
+	sendRequest(t, s.Addr)
+	<-started
+	resp, err := http.ReadResponse(bufio.NewReader(sendRequest(t, s.Addr)), nil)
+	require.NoError(t, err)
+	assert.Equal(t, 503, resp.StatusCode)
+	assert.Equal(t, "1", resp.Header.Get("Retry-After"))
+}
+
+func TestServer_NoLimit(t *testing.T) {
+	// Test: Limits of zero or less leave the server unbounded
+	for _, n := range []int{0, -1} {
+		s, err := Serve(0, okHandler, WithMaxConnections(n), WithMaxRequests(n))
+		require.NoError(t, err)
+		assert.Equal(t, 200, roundTrip(t, "tcp", s.Addr).StatusCode, n)
+		s.Close()
+	}
+}
+
+// failingListener fails Accept a number of times before reporting that
+// it is closed.
+type failingListener struct {
+	net.Listener
+	failures int
+	calls    []time.Time
+}
+
+func (l *failingListener) Accept() (net.Conn, error) {
+	l.calls = append(l.calls, time.Now())
+	if len(l.calls) > l.failures {
+		return nil, net.ErrClosed
+	}
+	return nil, errors.New("too many open files")
+}
+
+func TestServer_AcceptBackoff(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+	fl := &failingListener{Listener: l, failures: 4}
+	assert.ErrorIs(t, New(okHandler).Serve(fl), net.ErrClosed)
+	require.Len(t, fl.calls, 5)
+	for i, want := range []time.Duration{5, 10, 20, 40} {
+		assert.GreaterOrEqual(t, fl.calls[i+1].Sub(fl.calls[i]), want*time.Millisecond)
+	}
+}
+
+func TestServer_RequestContext(t *testing.T) {
+	errs := make(chan error, 1)
+	waitForCancel := func(w *response.Writer, req *request.Request) {
+		select {
+		case <-req.Context().Done():
+			errs <- req.Context().Err()
+		case <-time.After(5 * time.Second):
+			errs <- nil
+		}
+	}
+
+	// Test: The client going away cancels the request
+	s, err := Serve(0, waitForCancel)
+	require.NoError(t, err)
+	defer s.Close()
+	sendRequest(t, s.Addr).Close()
+	assert.ErrorIs(t, <-errs, context.Canceled)
+
+	// Test: Close cancels requests in flight
+	sendRequest(t, s.Addr)
+	time.Sleep(50 * time.Millisecond)
+	s.Close()
+	assert.ErrorIs(t, <-errs, context.Canceled)
+
+	// Test: Requests time out
+	s, err = Serve(0, waitForCancel, WithRequestTimeout(50*time.Millisecond))
+	require.NoError(t, err)
+	defer s.Close()
+	sendRequest(t, s.Addr)
+	assert.ErrorIs(t, <-errs, context.DeadlineExceeded)
+}
+
+func TestServer_HijackAfterWatch(t *testing.T) {
+	got := make(chan string, 1)
+	s, err := Serve(0, func(w *response.Writer, req *request.Request) {
+		// Give the disconnect watcher time to read what the client sent.
+		time.Sleep(100 * time.Millisecond)
+		conn, buffered, err := w.Hijack()
+		if err != nil {
+			got <- err.Error()
+			return
+		}
+		defer conn.Close()
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		rest := make([]byte, 5-len(buffered))
+		io.ReadFull(conn, rest)
+		got <- string(buffered) + string(rest)
+	})
+	require.NoError(t, err)
+	defer s.Close()
+	conn := sendRequest(t, s.Addr)
+	time.Sleep(20 * time.Millisecond)
+	_, err = conn.Write([]byte("hello"))
+	require.NoError(t, err)
+	assert.Equal(t, "hello", <-got)
+}
+
+func TestRequestID(t *testing.T) {
+	seen := make(chan string, 1)
+	handler := Chain(func(w *response.Writer, req *request.Request) {
+		seen <- request.IDFromContext(req.Context())
+		okHandler(w, req)
+	}, RequestID())
+	s, err := Serve(0, handler)
+	require.NoError(t, err)
+	defer s.Close()
+
+	get := func(id string) *http.Response {
+		conn, err := net.Dial("tcp", s.Addr)
+		require.NoError(t, err)
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		extra := ""
+		if id != "" {
+			extra = "X-Request-Id: " + id + "\r\n"
+		}
+		_, err = conn.Write([]byte("GET / HTTP/1.1\r\nHost: localhost\r\n" + extra + "\r\n"))
+		require.NoError(t, err)
+		resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		require.NoError(t, err)
+		return resp
+	}
+
+	// Test: IDs are generated when the client sends none
+	resp := get("")
+	id := <-seen
+	assert.Len(t, id, 32)
+	assert.Equal(t, id, resp.Header.Get("X-Request-Id"))
+
+	// Test: A client's ID is kept
+	assert.Equal(t, "abc-123", get("abc-123").Header.Get("X-Request-Id"))
+	assert.Equal(t, "abc-123", <-seen)
+
+	// Test: A malformed one is replaced
+	assert.Len(t, get("bad id").Header.Get("X-Request-Id"), 32)
+	<-seen
+}
+
+// stateRecorder collects the states reported for each connection, in the
+// order they were reported.
+type stateRecorder struct {
+	mu     sync.Mutex
+	states [][]ConnState
+	index  map[net.Conn]int
+}
+
+func (r *stateRecorder) hook(conn net.Conn, state ConnState) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.index == nil {
+		r.index = map[net.Conn]int{}
+	}
+	i, ok := r.index[conn]
+	if !ok {
+		i = len(r.states)
+		r.index[conn] = i
+		r.states = append(r.states, nil)
+	}
+	r.states[i] = append(r.states[i], state)
+}
+
+func (r *stateRecorder) get() [][]ConnState {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	out := make([][]ConnState, len(r.states))
+	for i, s := range r.states {
+		out[i] = append([]ConnState(nil), s...)
+	}
+	return out
+}
+
+func TestServer_ConnState(t *testing.T) {
+	rec := &stateRecorder{}
+	s, err := Serve(0, func(w *response.Writer, req *request.Request) {
+		if req.RequestLine.RequestTarget == "/hijack" {
+			conn, _, err := w.Hijack()
+			if err == nil {
+				conn.Close()
+			}
+			return
+		}
+		okHandler(w, req)
+	}, WithConnState(rec.hook))
+	require.NoError(t, err)
+	defer s.Close()
+
+	// Test: A request moves its connection from new to active to closed
+	resp := roundTrip(t, "tcp", s.Addr)
+	assert.Equal(t, 200, resp.StatusCode)
+	assert.Eventually(t, func() bool { return len(rec.get()) == 1 && len(rec.get()[0]) == 3 }, 5*time.Second, 5*time.Millisecond)
+	assert.Equal(t, []ConnState{StateNew, StateActive, StateClosed}, rec.get()[0])
+
+	// Test: Hijacking is final
+	conn, err := net.Dial("tcp", s.Addr)
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = conn.Write([]byte("GET /hijack HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	require.NoError(t, err)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	io.ReadAll(conn)
+	assert.Equal(t, []ConnState{StateNew, StateActive, StateHijacked}, rec.get()[1])
+
+	// Test: A connection that never sends a request is closed by Shutdown
+	idle, err := net.Dial("tcp", s.Addr)
+	require.NoError(t, err)
+	defer idle.Close()
+	assert.Eventually(t, func() bool { return len(rec.get()) == 3 }, 5*time.Second, 5*time.Millisecond)
+	require.NoError(t, s.Shutdown(context.Background()))
+	assert.Equal(t, []ConnState{StateNew, StateClosed}, rec.get()[2])
+	assert.Equal(t, "hijacked", StateHijacked.String())
+}
@@ -0,0 +1,166 @@
+package server
+
+import (
+	"crypto/tls"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	DefaultCertCheckInterval = 10 * time.Second
+	tlsHandshakeTimeout      = 10 * time.Second
+)
+
+// CertReloader serves a certificate loaded from disk and swaps in a new
+// one when the files change. Connections already established keep the
+// certificate they were set up with.
+type CertReloader struct {
+	certFile string
+	keyFile  string
+
+	mu      sync.RWMutex
+	cert    *tls.Certificate
+	modTime time.Time
+}
+
+func NewCertReloader(certFile string, keyFile string) (*CertReloader, error) {
+	r := &CertReloader{certFile: certFile, keyFile: keyFile}
+	if err := r.Reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Reload reads the certificate and key again. On error the current
+// certificate stays in use.
+func (r *CertReloader) Reload() error {
+	modTime, err := r.latestModTime()
+	if err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return fmt.Errorf("failed to load certificate: %w", err)
+	}
+	r.mu.Lock()
+	r.cert = &cert
+	r.modTime = modTime
+	r.mu.Unlock()
+	return nil
+}
+
+func (r *CertReloader) latestModTime() (time.Time, error) {
+	var latest time.Time
+	for _, name := range []string{r.certFile, r.keyFile} {
+		info, err := os.Stat(name)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("failed to stat certificate: %w", err)
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+// GetCertificate is meant for tls.Config.GetCertificate.
+func (r *CertReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.cert, nil
+}
+
+// Watch reloads the certificate when either file's modification time
+// changes, checking every interval, and whenever the process receives
+// SIGHUP. It returns once stop is closed.
+func (r *CertReloader) Watch(interval time.Duration, stop <-chan struct{}) {
+	if interval <= 0 {
+		interval = DefaultCertCheckInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	sighup := make(chan os.Signal, 1)
+	signal.Notify(sighup, syscall.SIGHUP)
+	defer signal.Stop(sighup)
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-sighup:
+			r.reload("SIGHUP")
+		case <-ticker.C:
+			modTime, err := r.latestModTime()
+			if err != nil {
+				log.Printf("could not check certificate: %v", err)
+				continue
+			}
+			r.mu.RLock()
+			changed := !modTime.Equal(r.modTime)
+			r.mu.RUnlock()
+			if changed {
+				r.reload("file change")
+			}
+		}
+	}
+}
+
+func (r *CertReloader) reload(reason string) {
+	if err := r.Reload(); err != nil {
+		log.Printf("certificate reload after %s failed, keeping the current one: %v", reason, err)
+		return
+	}
+	log.Printf("reloaded certificate %s after %s", r.certFile, reason)
+}
+
+// ServeTLS serves HTTPS on port using the certificate and key files,
+// which are reloaded as they change or on SIGHUP.
+func ServeTLS(port int, handler Handler, certFile string, keyFile string, opts ...Option) (*Server, error) {
+	reloader, err := NewCertReloader(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	server, err := ServeTLSConfig(port, handler, &tls.Config{GetCertificate: reloader.GetCertificate}, opts...)
+	if err != nil {
+		return nil, err
+	}
+	go reloader.Watch(DefaultCertCheckInterval, server.doneChan())
+	return server, nil
+}
+
+// ServeTLSConfig serves HTTPS on port with config in the background.
+func ServeTLSConfig(port int, handler Handler, config *tls.Config, opts ...Option) (*Server, error) {
+	listener, err := net.Listen("tcp", ":"+strconv.Itoa(port))
+	if err != nil {
+		return nil, err
+	}
+	listener = tlsListener(listener, config)
+	server := New(handler, opts...)
+	server.track(listener)
+	go server.serve(listener)
+	return server, nil
+}
+
+// ServeTLS is like Serve but speaks TLS on l. HTTP/2 and HTTP/1.1 are
+// offered through ALPN unless config sets NextProtos itself.
+func (s *Server) ServeTLS(l net.Listener, config *tls.Config) error {
+	return s.Serve(tlsListener(l, config))
+}
+
+func tlsListener(l net.Listener, config *tls.Config) net.Listener {
+	config = config.Clone()
+	if len(config.NextProtos) == 0 {
+		config.NextProtos = []string{"h2", "http/1.1"}
+	}
+	if config.MinVersion == 0 {
+		config.MinVersion = tls.VersionTLS12
+	}
+	return tls.NewListener(l, config)
+}
@@ -0,0 +1,246 @@
+package server
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/PeterKWIlliams/http/internal/request"
+	"github.com/PeterKWIlliams/http/internal/response"
+)
+
+// writeCert writes a self-signed certificate for 127.0.0.1 and returns it
+// parsed.
+func writeCert(t *testing.T, certFile string, keyFile string, commonName string) *x509.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: commonName},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600))
+	require.NoError(t, os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600))
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	return cert
+}
+
+func localAddr(s *Server) string {
+	_, port, _ := net.SplitHostPort(s.Addr)
+	return net.JoinHostPort("127.0.0.1", port)
+}
+
+func localURL(s *Server) string {
+	return "https://" + localAddr(s) + "/"
+}
+
+func testClient(roots *x509.CertPool, nextProtos ...string) *http.Client {
+	return &http.Client{Transport: &http.Transport{
+		TLSClientConfig:   &tls.Config{RootCAs: roots, NextProtos: nextProtos},
+		ForceAttemptHTTP2: len(nextProtos) == 0,
+	}}
+}
+
+func protoHandler(w *response.Writer, req *request.Request) {
+	body := []byte("served over HTTP/" + req.RequestLine.HttpVersion)
+	w.Write(response.OK, response.GetDefaultHeaders(len(body)), body)
+}
+
+func TestServeTLS(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	first := writeCert(t, certFile, keyFile, "first")
+
+	server, err := ServeTLS(0, protoHandler, certFile, keyFile)
+	require.NoError(t, err)
+	defer server.Close()
+	url := localURL(server)
+
+	roots := x509.NewCertPool()
+	roots.AddCert(first)
+
+	// Test: ALPN picks HTTP/2 when offered and HTTP/1.1 otherwise
+	for proto, client := range map[string]*http.Client{
+		"2.0": testClient(roots),
+		"1.1": testClient(roots, "http/1.1"),
+	} {
+		resp, err := client.Get(url)
+		require.NoError(t, err)
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		require.NoError(t, err)
+		assert.Equal(t, "served over HTTP/"+proto, string(body))
+	}
+
+	// Test: An h2c upgrade over TLS is served as plain HTTP/1.1
+	tlsConn, err := tls.Dial("tcp", localAddr(server), &tls.Config{RootCAs: roots, NextProtos: []string{"http/1.1"}})
+	require.NoError(t, err)
+	tlsConn.Write([]byte("GET / HTTP/1.1\r\nHost: x\r\nConnection: Upgrade, HTTP2-Settings\r\n" +
+		"Upgrade: h2c\r\nHTTP2-Settings: AAMAAABkAAQCAAAAAAIAAAAA\r\n\r\n"))
+	tlsConn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	resp, err := http.ReadResponse(bufio.NewReader(tlsConn), nil)
+	require.NoError(t, err)
+	body, err := io.ReadAll(resp.Body)
+	tlsConn.Close()
+	require.NoError(t, err)
+	assert.Equal(t, 200, resp.StatusCode)
+	assert.Equal(t, "served over HTTP/1.1", string(body))
+
+	// Test: Plain HTTP on the TLS port fails the handshake
+	conn, err := net.Dial("tcp", localAddr(server))
+	require.NoError(t, err)
+	conn.Write([]byte("GET / HTTP/1.1\r\nHost: x\r\n\r\n"))
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	reply, _ := io.ReadAll(conn)
+	conn.Close()
+	assert.NotContains(t, string(reply), "HTTP/1.1 200")
+}
+
+func TestCertReloader(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	first := writeCert(t, certFile, keyFile, "first")
+
+	reloader, err := NewCertReloader(certFile, keyFile)
+	require.NoError(t, err)
+	stop := make(chan struct{})
+	defer close(stop)
+	go reloader.Watch(10*time.Millisecond, stop)
+
+	server, err := ServeTLSConfig(0, protoHandler, &tls.Config{GetCertificate: reloader.GetCertificate})
+	require.NoError(t, err)
+	defer server.Close()
+	url := localURL(server)
+
+	roots := x509.NewCertPool()
+	roots.AddCert(first)
+	client := testClient(roots)
+	resp, err := client.Get(url)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, "first", resp.TLS.PeerCertificates[0].Subject.CommonName)
+
+	// Test: A changed certificate is picked up for new handshakes
+	second := writeCert(t, certFile, keyFile, "second")
+	future := time.Now().Add(time.Minute)
+	require.NoError(t, os.Chtimes(certFile, future, future))
+	assert.Eventually(t, func() bool {
+		cert, _ := reloader.GetCertificate(nil)
+		return mustParse(t, cert).Subject.CommonName == "second"
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// Test: The existing HTTP/2 connection keeps working
+	resp, err = client.Get(url)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, "first", resp.TLS.PeerCertificates[0].Subject.CommonName)
+
+	roots.AddCert(second)
+	resp, err = testClient(roots).Get(url)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, "second", resp.TLS.PeerCertificates[0].Subject.CommonName)
+
+	// Test: A broken file keeps the current certificate
+	require.NoError(t, os.WriteFile(keyFile, []byte("garbage"), 0o600))
+	assert.Error(t, reloader.Reload())
+	cert, err := reloader.GetCertificate(nil)
+	require.NoError(t, err)
+	assert.Equal(t, "second", mustParse(t, cert).Subject.CommonName)
+}
+
+func mustParse(t *testing.T, cert *tls.Certificate) *x509.Certificate {
+	t.Helper()
+	parsed, err := x509.ParseCertificate(cert.Certificate[0])
+	require.NoError(t, err)
+	return parsed
+}
+
+func TestServeTLS_ConnMetadata(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	cert := writeCert(t, certFile, keyFile, "meta")
+	server, err := ServeTLS(0, func(w *response.Writer, req *request.Request) {
+		body := []byte(fmt.Sprintf("%d %d %s %s", req.ConnID, req.Sequence, req.TLS.NegotiatedProtocol, req.LocalAddr))
+		w.Write(response.OK, response.GetDefaultHeaders(len(body)), body)
+	}, certFile, keyFile)
+	require.NoError(t, err)
+	defer server.Close()
+	roots := x509.NewCertPool()
+	roots.AddCert(cert)
+
+	get := func(client *http.Client) string {
+		resp, err := client.Get(localURL(server))
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		return string(body)
+	}
+
+	// Test: HTTP/1.1 connections each get a new ID
+	h1 := testClient(roots, "http/1.1")
+	assert.Equal(t, "1 1 http/1.1 "+localAddr(server), get(h1))
+	assert.Equal(t, "2 1 http/1.1 "+localAddr(server), get(h1))
+
+	// Test: HTTP/2 requests share their connection and count up
+	h2 := testClient(roots)
+	assert.Equal(t, "3 1 h2 "+localAddr(server), get(h2))
+	assert.Equal(t, "3 2 h2 "+localAddr(server), get(h2))
+}
+
+func TestServeTLS_HTTP2ConnState(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	cert := writeCert(t, certFile, keyFile, "states")
+	rec := &stateRecorder{}
+	server, err := ServeTLS(0, protoHandler, certFile, keyFile, WithConnState(rec.hook))
+	require.NoError(t, err)
+	defer server.Close()
+	roots := x509.NewCertPool()
+	roots.AddCert(cert)
+
+	// Test: An HTTP/2 connection is active only while streams are open
+	client := testClient(roots)
+	for i := 0; i < 2; i++ {
+		resp, err := client.Get(localURL(server))
+		require.NoError(t, err)
+		io.ReadAll(resp.Body)
+		resp.Body.Close()
+	}
+	client.CloseIdleConnections()
+	want := []ConnState{StateNew, StateIdle, StateActive, StateIdle, StateActive, StateIdle, StateClosed}
+	assert.Eventually(t, func() bool {
+		states := rec.get()
+		return len(states) == 1 && assert.ObjectsAreEqual(want, states[0])
+	}, 5*time.Second, 5*time.Millisecond)
+}
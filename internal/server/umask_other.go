@@ -0,0 +1,9 @@
+//go:build !unix
+
+package server
+
+import "os"
+
+func withRestrictiveUmask(mode os.FileMode, fn func() error) error {
+	return fn()
+}
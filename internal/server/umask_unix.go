@@ -0,0 +1,23 @@
+//go:build unix
+
+package server
+
+import (
+	"os"
+	"sync"
+	"syscall"
+)
+
+var umaskMu sync.Mutex
+
+// withRestrictiveUmask runs fn with the process umask tightened so that
+// files it creates get no permission outside mode. Other goroutines
+// creating files meanwhile only ever get stricter permissions.
+func withRestrictiveUmask(mode os.FileMode, fn func() error) error {
+	umaskMu.Lock()
+	defer umaskMu.Unlock()
+	old := syscall.Umask(0o777)
+	defer syscall.Umask(old)
+	syscall.Umask(old | int(^mode.Perm()&0o777))
+	return fn()
+}
@@ -0,0 +1,73 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"syscall"
+	"time"
+)
+
+// ListenUnix listens on a Unix domain socket at path and sets the socket
+// file's permissions to mode. The socket is created under a umask that
+// keeps it from ever being more accessible than mode. A stale socket left behind by a process
+// that died is removed first, but a socket something is still listening
+// on, or any other kind of file, is left alone. The socket file is
+// removed when the listener is closed.
+func ListenUnix(path string, mode os.FileMode) (net.Listener, error) {
+	if err := removeStaleSocket(path); err != nil {
+		return nil, err
+	}
+	var listener net.Listener
+	err := withRestrictiveUmask(mode, func() (err error) {
+		listener, err = net.Listen("unix", path)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, mode); err != nil {
+		listener.Close()
+		return nil, fmt.Errorf("failed to set socket permissions: %w", err)
+	}
+	return listener, nil
+}
+
+func removeStaleSocket(path string) error {
+	info, err := os.Lstat(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if info.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("%s exists and is not a socket", path)
+	}
+	conn, err := net.DialTimeout("unix", path, time.Second)
+	if err == nil {
+		conn.Close()
+		return fmt.Errorf("%s is already in use", path)
+	}
+	if !errors.Is(err, syscall.ECONNREFUSED) {
+		return fmt.Errorf("could not check socket %s: %w", path, err)
+	}
+	if err := os.Remove(path); err != nil {
+		return fmt.Errorf("failed to remove stale socket: %w", err)
+	}
+	return nil
+}
+
+// ServeUnix serves connections on a Unix domain socket at path in the
+// background. See ListenUnix for how the socket file is managed.
+func ServeUnix(path string, mode os.FileMode, handler Handler, opts ...Option) (*Server, error) {
+	listener, err := ListenUnix(path, mode)
+	if err != nil {
+		return nil, err
+	}
+	server := New(handler, opts...)
+	server.track(listener)
+	go server.serve(listener)
+	return server, nil
+}
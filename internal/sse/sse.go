@@ -0,0 +1,203 @@
+package sse
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/PeterKWIlliams/http/internal/request"
+	"github.com/PeterKWIlliams/http/internal/response"
+)
+
+const DefaultKeepAlive = 15 * time.Second
+
+type Options struct {
+	// KeepAlive is the interval between keep-alive comments sent while no
+	// events are written. Zero uses DefaultKeepAlive and a negative value
+	// disables keep-alives.
+	KeepAlive time.Duration
+}
+
+// Event is a single server-sent event. Empty fields are omitted.
+type Event struct {
+	ID    string
+	Event string
+	Data  string
+	Retry time.Duration
+}
+
+var (
+	ErrStreamClosed = errors.New("sse: stream closed")
+	errInvalidField = errors.New("sse: id and event fields must not contain line breaks")
+)
+
+// Stream writes server-sent events to a response. All methods are safe for
+// concurrent use.
+type Stream struct {
+	w           *response.Writer
+	lastEventID string
+
+	mu     sync.Mutex
+	err    error
+	done   chan struct{}
+	closed bool
+}
+
+// NewStream writes the event-stream response headers and starts sending
+// keep-alive comments. The handler should call Close before returning.
+func NewStream(w *response.Writer, req *request.Request, opts Options) (*Stream, error) {
+	h := response.GetDefaultHeaders(0)
+	h.Delete("content-length")
+	h.Set("content-type", "text/event-stream")
+	h.Set("cache-control", "no-cache")
+	h.Set("transfer-encoding", "chunked")
+	h.Set("x-accel-buffering", "no")
+	if err := w.WriteStatusLine(response.OK); err != nil {
+		return nil, err
+	}
+	if err := w.WriteHeaders(h); err != nil {
+		return nil, err
+	}
+	if err := w.Flush(); err != nil {
+		return nil, err
+	}
+
+	s := &Stream{
+		w:           w,
+		lastEventID: LastEventID(req),
+		done:        make(chan struct{}),
+	}
+	// End the stream as soon as the client goes away rather than at the
+	// next failed write.
+	ctx := req.Context()
+	context.AfterFunc(ctx, func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.stop(fmt.Errorf("sse: request ended: %w", ctx.Err()))
+	})
+	keepAlive := opts.KeepAlive
+	if keepAlive == 0 {
+		keepAlive = DefaultKeepAlive
+	}
+	if keepAlive > 0 {
+		go s.keepAlive(keepAlive)
+	}
+	return s, nil
+}
+
+// LastEventID returns the Last-Event-ID sent by a reconnecting client, or
+// "" on the first connection.
+func LastEventID(req *request.Request) string {
+	id, err := req.Headers.Get("last-event-id")
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(id)
+}
+
+func (s *Stream) LastEventID() string {
+	return s.lastEventID
+}
+
+// Done is closed once the stream is closed or a write to the client fails,
+// which usually means the client has gone away.
+func (s *Stream) Done() <-chan struct{} {
+	return s.done
+}
+
+// Send writes an event and flushes it to the client.
+func (s *Stream) Send(e Event) error {
+	if strings.ContainsAny(e.ID, "\r\n\x00") || strings.ContainsAny(e.Event, "\r\n") {
+		return errInvalidField
+	}
+
+	var b strings.Builder
+	if e.ID != "" {
+		b.WriteString("id: " + e.ID + "\n")
+	}
+	if e.Event != "" {
+		b.WriteString("event: " + e.Event + "\n")
+	}
+	if e.Retry > 0 {
+		b.WriteString("retry: " + strconv.FormatInt(e.Retry.Milliseconds(), 10) + "\n")
+	}
+	if e.Data != "" || (e.ID == "" && e.Event == "" && e.Retry <= 0) {
+		for _, line := range splitLines(e.Data) {
+			b.WriteString("data: " + line + "\n")
+		}
+	}
+	b.WriteString("\n")
+	return s.write(b.String())
+}
+
+// Comment writes a comment line, which clients ignore.
+func (s *Stream) Comment(text string) error {
+	var b strings.Builder
+	for _, line := range splitLines(text) {
+		b.WriteString(": " + line + "\n")
+	}
+	b.WriteString("\n")
+	return s.write(b.String())
+}
+
+// Close stops the keep-alives. The response itself is finished by the
+// server once the handler returns.
+func (s *Stream) Close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.stop(ErrStreamClosed)
+}
+
+func (s *Stream) write(data string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err != nil {
+		return s.err
+	}
+	if _, err := s.w.WriteBody([]byte(data)); err != nil {
+		s.stop(fmt.Errorf("sse: write failed: %w", err))
+		return s.err
+	}
+	if err := s.w.Flush(); err != nil {
+		s.stop(fmt.Errorf("sse: flush failed: %w", err))
+		return s.err
+	}
+	return nil
+}
+
+// stop records why the stream ended. The caller must hold mu.
+func (s *Stream) stop(err error) {
+	if s.closed {
+		return
+	}
+	s.closed = true
+	s.err = err
+	close(s.done)
+}
+
+func (s *Stream) keepAlive(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+			if err := s.write(":\n\n"); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// splitLines splits on any of the line endings the event-stream format
+// recognises, so that a value cannot inject extra fields.
+func splitLines(s string) []string {
+	s = strings.ReplaceAll(s, "\r\n", "\n")
+	s = strings.ReplaceAll(s, "\r", "\n")
+	return strings.Split(s, "\n")
+}
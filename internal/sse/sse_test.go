@@ -0,0 +1,124 @@
+package sse
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/PeterKWIlliams/http/internal/request"
+	"github.com/PeterKWIlliams/http/internal/response"
+)
+
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) Bytes() []byte {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return append([]byte(nil), b.buf.Bytes()...)
+}
+
+func newRequest(t *testing.T, extraHeaders string) *request.Request {
+	t.Helper()
+	req, err := request.RequestFromReader(strings.NewReader("GET /events HTTP/1.1\r\nHost: localhost\r\n" + extraHeaders + "\r\n"))
+	require.NoError(t, err)
+	return req
+}
+
+func readStream(t *testing.T, out *syncBuffer, w *response.Writer) (*http.Response, string) {
+	t.Helper()
+	require.NoError(t, w.Finish())
+	resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(out.Bytes())), nil)
+	require.NoError(t, err)
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	return resp, string(body)
+}
+
+func TestStream_Send(t *testing.T) {
+	out := &syncBuffer{}
+	w := &response.Writer{Writer: out}
+	s, err := NewStream(w, newRequest(t, "Last-Event-ID: 41\r\n"), Options{KeepAlive: -1})
+	require.NoError(t, err)
+	assert.Equal(t, "41", s.LastEventID())
+
+	require.NoError(t, s.Send(Event{ID: "42", Event: "update", Data: "first\nsecond\r\nthird\rfourth", Retry: 3 * time.Second}))
+	require.NoError(t, s.Send(Event{Data: "data: injected\n\nid: 99"}))
+	require.NoError(t, s.Comment("hello\nworld"))
+	assert.ErrorIs(t, s.Send(Event{ID: "1\n2"}), errInvalidField)
+	assert.ErrorIs(t, s.Send(Event{Event: "a\rb"}), errInvalidField)
+	s.Close()
+	assert.ErrorIs(t, s.Send(Event{Data: "late"}), ErrStreamClosed)
+
+	resp, body := readStream(t, out, w)
+	assert.Equal(t, 200, resp.StatusCode)
+	assert.Equal(t, "text/event-stream", resp.Header.Get("Content-Type"))
+	assert.Equal(t, "no-cache", resp.Header.Get("Cache-Control"))
+	assert.Equal(t, []string{"chunked"}, resp.TransferEncoding)
+	assert.Equal(t, "id: 42\n"+
+		"event: update\n"+
+		"retry: 3000\n"+
+		"data: first\ndata: second\ndata: third\ndata: fourth\n\n"+
+		"data: data: injected\ndata: \ndata: id: 99\n\n"+
+		": hello\n: world\n\n", body)
+}
+
+func TestStream_KeepAlive(t *testing.T) {
+	out := &syncBuffer{}
+	w := &response.Writer{Writer: out}
+	s, err := NewStream(w, newRequest(t, ""), Options{KeepAlive: 10 * time.Millisecond})
+	require.NoError(t, err)
+	assert.Equal(t, "", s.LastEventID())
+
+	assert.Eventually(t, func() bool {
+		return bytes.Count(out.Bytes(), []byte(":\n\n")) >= 2
+	}, time.Second, 5*time.Millisecond)
+	s.Close()
+	select {
+	case <-s.Done():
+	default:
+		t.Fatal("Done not closed after Close")
+	}
+
+	_, body := readStream(t, out, w)
+	assert.True(t, strings.HasPrefix(body, ":\n\n:\n\n"))
+}
+
+type failingWriter struct {
+	fail bool
+}
+
+func (f *failingWriter) Write(p []byte) (int, error) {
+	if f.fail {
+		return 0, io.ErrClosedPipe
+	}
+	return len(p), nil
+}
+
+func TestStream_WriteFailureEndsStream(t *testing.T) {
+	fw := &failingWriter{}
+	w := &response.Writer{Writer: fw}
+	s, err := NewStream(w, newRequest(t, ""), Options{KeepAlive: -1})
+	require.NoError(t, err)
+	fw.fail = true
+
+	assert.Error(t, s.Send(Event{Data: "gone"}))
+	<-s.Done()
+	assert.ErrorIs(t, s.Send(Event{Data: "again"}), io.ErrClosedPipe)
+}
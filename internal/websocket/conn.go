@@ -0,0 +1,383 @@
+package websocket
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+type MessageType int
+
+const (
+	TextMessage   MessageType = 1
+	BinaryMessage MessageType = 2
+)
+
+const (
+	opContinuation = 0x0
+	opText         = 0x1
+	opBinary       = 0x2
+	opClose        = 0x8
+	opPing         = 0x9
+	opPong         = 0xA
+)
+
+// Close status codes from RFC 6455 section 7.4.1.
+const (
+	CloseNormalClosure    = 1000
+	CloseGoingAway        = 1001
+	CloseProtocolError    = 1002
+	CloseUnsupportedData  = 1003
+	CloseNoStatusReceived = 1005
+	CloseInvalidPayload   = 1007
+	ClosePolicyViolation  = 1008
+	CloseMessageTooBig    = 1009
+	CloseInternalError    = 1011
+)
+
+const (
+	maxControlPayload = 125
+	closeTimeout      = 5 * time.Second
+)
+
+// CloseError is returned by ReadMessage once the close handshake is done.
+type CloseError struct {
+	Code   int
+	Reason string
+}
+
+func (e *CloseError) Error() string {
+	return fmt.Sprintf("websocket: close %d %s", e.Code, e.Reason)
+}
+
+var ErrClosed = errors.New("websocket: connection closed")
+
+type Conn struct {
+	conn           net.Conn
+	reader         *bufio.Reader
+	subprotocol    string
+	compress       bool
+	maxMessageSize int64
+
+	readMu    sync.Mutex
+	writeMu   sync.Mutex
+	closeSent bool
+	inflater  *inflater
+}
+
+func newConn(conn net.Conn, reader *bufio.Reader, subprotocol string, compress bool, maxMessageSize int64) *Conn {
+	c := &Conn{
+		conn:           conn,
+		reader:         reader,
+		subprotocol:    subprotocol,
+		compress:       compress,
+		maxMessageSize: maxMessageSize,
+	}
+	if compress {
+		c.inflater = &inflater{}
+	}
+	return c
+}
+
+func (c *Conn) Subprotocol() string {
+	return c.subprotocol
+}
+
+func (c *Conn) RemoteAddr() net.Addr {
+	return c.conn.RemoteAddr()
+}
+
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	return c.conn.SetReadDeadline(t)
+}
+
+type frame struct {
+	fin     bool
+	rsv1    bool
+	opcode  byte
+	payload []byte
+}
+
+// protocolError closes the connection with code after a violation by the
+// peer and returns the matching CloseError.
+func (c *Conn) protocolError(code int, reason string) error {
+	c.writeClose(code, reason)
+	c.conn.Close()
+	return &CloseError{Code: code, Reason: reason}
+}
+
+func (c *Conn) readFrame() (*frame, error) {
+	var header [2]byte
+	if _, err := io.ReadFull(c.reader, header[:]); err != nil {
+		return nil, err
+	}
+	f := &frame{
+		fin:    header[0]&0x80 != 0,
+		rsv1:   header[0]&0x40 != 0,
+		opcode: header[0] & 0x0F,
+	}
+	if header[0]&0x30 != 0 {
+		return nil, c.protocolError(CloseProtocolError, "reserved bits set")
+	}
+	if header[1]&0x80 == 0 {
+		return nil, c.protocolError(CloseProtocolError, "client frames must be masked")
+	}
+
+	length := int64(header[1] & 0x7F)
+	switch length {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(c.reader, ext[:]); err != nil {
+			return nil, err
+		}
+		length = int64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err := io.ReadFull(c.reader, ext[:]); err != nil {
+			return nil, err
+		}
+		if ext[0]&0x80 != 0 {
+			return nil, c.protocolError(CloseProtocolError, "invalid payload length")
+		}
+		length = int64(binary.BigEndian.Uint64(ext[:]))
+	}
+
+	if f.opcode >= opClose {
+		if !f.fin {
+			return nil, c.protocolError(CloseProtocolError, "fragmented control frame")
+		}
+		if length > maxControlPayload {
+			return nil, c.protocolError(CloseProtocolError, "control frame too large")
+		}
+		if f.rsv1 {
+			return nil, c.protocolError(CloseProtocolError, "compressed control frame")
+		}
+	}
+	if length > c.maxMessageSize {
+		return nil, c.protocolError(CloseMessageTooBig, "message too big")
+	}
+
+	var mask [4]byte
+	if _, err := io.ReadFull(c.reader, mask[:]); err != nil {
+		return nil, err
+	}
+	f.payload = make([]byte, length)
+	if _, err := io.ReadFull(c.reader, f.payload); err != nil {
+		return nil, err
+	}
+	for i := range f.payload {
+		f.payload[i] ^= mask[i%4]
+	}
+	return f, nil
+}
+
+// ReadMessage returns the next complete data message. Pings are answered
+// and pongs dropped along the way. When the peer closes the connection the
+// close is acknowledged and a *CloseError is returned.
+func (c *Conn) ReadMessage() (MessageType, []byte, error) {
+	c.readMu.Lock()
+	defer c.readMu.Unlock()
+
+	var messageType MessageType
+	var message []byte
+	compressed := false
+	for {
+		f, err := c.readFrame()
+		if err != nil {
+			return 0, nil, err
+		}
+
+		switch f.opcode {
+		case opPing:
+			if err := c.writeFrame(opPong, f.payload, false); err != nil && !errors.Is(err, ErrClosed) {
+				return 0, nil, err
+			}
+			continue
+		case opPong:
+			continue
+		case opClose:
+			return 0, nil, c.handleClose(f.payload)
+		case opText, opBinary:
+			if messageType != 0 {
+				return 0, nil, c.protocolError(CloseProtocolError, "expected continuation frame")
+			}
+			if f.rsv1 && !c.compress {
+				return 0, nil, c.protocolError(CloseProtocolError, "unexpected compressed frame")
+			}
+			messageType = MessageType(f.opcode)
+			compressed = f.rsv1
+		case opContinuation:
+			if messageType == 0 {
+				return 0, nil, c.protocolError(CloseProtocolError, "unexpected continuation frame")
+			}
+			if f.rsv1 {
+				return 0, nil, c.protocolError(CloseProtocolError, "rsv1 set on continuation frame")
+			}
+		default:
+			return 0, nil, c.protocolError(CloseProtocolError, "unknown opcode")
+		}
+
+		if int64(len(message)+len(f.payload)) > c.maxMessageSize {
+			return 0, nil, c.protocolError(CloseMessageTooBig, "message too big")
+		}
+		message = append(message, f.payload...)
+		if !f.fin {
+			continue
+		}
+
+		if compressed {
+			message, err = c.inflater.inflate(message, c.maxMessageSize)
+			if errors.Is(err, errInflatedTooLarge) {
+				return 0, nil, c.protocolError(CloseMessageTooBig, "message too big")
+			}
+			if err != nil {
+				return 0, nil, c.protocolError(CloseInvalidPayload, "invalid compressed message")
+			}
+		}
+		if messageType == TextMessage && !utf8.Valid(message) {
+			return 0, nil, c.protocolError(CloseInvalidPayload, "invalid UTF-8 in text message")
+		}
+		return messageType, message, nil
+	}
+}
+
+func (c *Conn) handleClose(payload []byte) error {
+	code := CloseNoStatusReceived
+	reason := ""
+	switch {
+	case len(payload) == 1:
+		return c.protocolError(CloseProtocolError, "invalid close payload")
+	case len(payload) >= 2:
+		code = int(binary.BigEndian.Uint16(payload))
+		reason = string(payload[2:])
+		if !validCloseCode(code) {
+			return c.protocolError(CloseProtocolError, "invalid close code")
+		}
+		if !utf8.ValidString(reason) {
+			return c.protocolError(CloseInvalidPayload, "invalid UTF-8 in close reason")
+		}
+	}
+
+	replyCode := code
+	if code == CloseNoStatusReceived {
+		replyCode = CloseNormalClosure
+	}
+	c.writeClose(replyCode, "")
+	c.conn.Close()
+	return &CloseError{Code: code, Reason: reason}
+}
+
+func validCloseCode(code int) bool {
+	switch {
+	case code >= 1000 && code <= 1003:
+		return true
+	case code >= 1007 && code <= 1011:
+		return true
+	case code >= 3000 && code <= 4999:
+		return true
+	}
+	return false
+}
+
+// WriteMessage sends data as a single frame, compressing it when
+// permessage-deflate was negotiated.
+func (c *Conn) WriteMessage(messageType MessageType, data []byte) error {
+	if messageType != TextMessage && messageType != BinaryMessage {
+		return fmt.Errorf("websocket: invalid message type %d", messageType)
+	}
+	if messageType == TextMessage && !utf8.Valid(data) {
+		return errors.New("websocket: text message is not valid UTF-8")
+	}
+	if c.compress {
+		compressed, err := deflate(data)
+		if err != nil {
+			return err
+		}
+		return c.writeFrame(byte(messageType), compressed, true)
+	}
+	return c.writeFrame(byte(messageType), data, false)
+}
+
+func (c *Conn) Ping(data []byte) error {
+	if len(data) > maxControlPayload {
+		return errors.New("websocket: ping payload too large")
+	}
+	return c.writeFrame(opPing, data, false)
+}
+
+// Close starts the closing handshake and waits briefly for the peer to
+// answer before closing the connection. If another goroutine is inside
+// ReadMessage it receives the peer's close and shuts the connection down.
+func (c *Conn) Close(code int, reason string) error {
+	if err := c.writeClose(code, reason); err != nil {
+		c.conn.Close()
+		return err
+	}
+	c.conn.SetReadDeadline(time.Now().Add(closeTimeout))
+	if !c.readMu.TryLock() {
+		return nil
+	}
+	defer c.readMu.Unlock()
+	defer c.conn.Close()
+	for {
+		f, err := c.readFrame()
+		if err != nil || f.opcode == opClose {
+			return nil
+		}
+	}
+}
+
+func (c *Conn) writeClose(code int, reason string) error {
+	payload := make([]byte, 2, 2+len(reason))
+	binary.BigEndian.PutUint16(payload, uint16(code))
+	payload = append(payload, reason...)
+	if len(payload) > maxControlPayload {
+		// Cut on a rune boundary so the reason stays valid UTF-8.
+		n := maxControlPayload
+		for n > 2 && !utf8.RuneStart(payload[n]) {
+			n--
+		}
+		payload = payload[:n]
+	}
+	return c.writeFrame(opClose, payload, false)
+}
+
+func (c *Conn) writeFrame(opcode byte, payload []byte, rsv1 bool) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	if c.closeSent {
+		return ErrClosed
+	}
+	if opcode == opClose {
+		c.closeSent = true
+	}
+
+	header := make([]byte, 0, 10)
+	first := 0x80 | opcode
+	if rsv1 {
+		first |= 0x40
+	}
+	header = append(header, first)
+	switch length := len(payload); {
+	case length <= 125:
+		header = append(header, byte(length))
+	case length <= 0xFFFF:
+		header = append(header, 126)
+		header = binary.BigEndian.AppendUint16(header, uint16(length))
+	default:
+		header = append(header, 127)
+		header = binary.BigEndian.AppendUint64(header, uint64(length))
+	}
+
+	c.conn.SetWriteDeadline(time.Now().Add(closeTimeout * 2))
+	if _, err := c.conn.Write(append(header, payload...)); err != nil {
+		return fmt.Errorf("websocket: write failed: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,60 @@
+package websocket
+
+import (
+	"bytes"
+	"compress/flate"
+	"errors"
+	"io"
+)
+
+// permessage-deflate strips this empty stored block from the end of every
+// message (RFC 7692 section 7.2.1).
+var deflateTail = []byte{0x00, 0x00, 0xff, 0xff}
+
+const windowSize = 32 * 1024
+
+var errInflatedTooLarge = errors.New("websocket: inflated message too large")
+
+// inflater decompresses messages from a client that may use context
+// takeover by carrying the last window of output into the next message
+// as a preset dictionary.
+type inflater struct {
+	window []byte
+}
+
+func (i *inflater) inflate(data []byte, maxSize int64) ([]byte, error) {
+	input := io.MultiReader(bytes.NewReader(data), bytes.NewReader(deflateTail))
+	fr := flate.NewReaderDict(input, i.window)
+	defer fr.Close()
+
+	out, err := io.ReadAll(io.LimitReader(fr, maxSize+1))
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) {
+		return nil, err
+	}
+	if int64(len(out)) > maxSize {
+		return nil, errInflatedTooLarge
+	}
+
+	i.window = append(i.window, out...)
+	if len(i.window) > windowSize {
+		i.window = append([]byte(nil), i.window[len(i.window)-windowSize:]...)
+	}
+	return out, nil
+}
+
+// deflate compresses one message without context takeover, as announced
+// by server_no_context_takeover.
+func deflate(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	fw, err := flate.NewWriter(&buf, flate.DefaultCompression)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := fw.Write(data); err != nil {
+		return nil, err
+	}
+	if err := fw.Flush(); err != nil {
+		return nil, err
+	}
+	return bytes.TrimSuffix(buf.Bytes(), deflateTail), nil
+}
@@ -0,0 +1,181 @@
+package websocket
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+
+	"github.com/PeterKWIlliams/http/internal/headers"
+	"github.com/PeterKWIlliams/http/internal/request"
+	"github.com/PeterKWIlliams/http/internal/response"
+	"github.com/PeterKWIlliams/http/internal/server"
+)
+
+// The GUID from RFC 6455 section 1.3 appended to the client key.
+const acceptGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+const DefaultMaxMessageSize = 1 << 20
+
+type Options struct {
+	// Subprotocols lists the supported subprotocols in order of
+	// preference.
+	Subprotocols []string
+	// MaxMessageSize limits the size of a reassembled message. Larger
+	// messages close the connection with status 1009.
+	MaxMessageSize int64
+	// EnableCompression negotiates permessage-deflate when the client
+	// offers it.
+	EnableCompression bool
+	// CheckOrigin rejects the handshake when it returns false. All origins
+	// are accepted when it is nil.
+	CheckOrigin func(req *request.Request) bool
+}
+
+var ErrBadHandshake = errors.New("websocket: bad handshake")
+
+// Upgrade validates the opening handshake, answers it with 101 Switching
+// Protocols and takes over the connection. On failure it has already
+// written an error response and the handler should simply return.
+func Upgrade(w *response.Writer, req *request.Request, opts Options) (*Conn, error) {
+	if err := checkHandshake(req); err != nil {
+		statusCode := response.BadRequest
+		if errors.Is(err, errBadVersion) {
+			statusCode = response.UpgradeRequired
+			w.OnWriteHeaders(func(_ response.StatusCode, h headers.Headers) {
+				h.Set("sec-websocket-version", "13")
+			})
+		}
+		writeError(w, statusCode, err.Error())
+		return nil, fmt.Errorf("%w: %s", ErrBadHandshake, err)
+	}
+	if opts.CheckOrigin != nil && !opts.CheckOrigin(req) {
+		writeError(w, response.Forbidden, "origin not allowed")
+		return nil, fmt.Errorf("%w: origin not allowed", ErrBadHandshake)
+	}
+
+	key, _ := req.Headers.Get("sec-websocket-key")
+	var resp bytes.Buffer
+	resp.WriteString("HTTP/1.1 101 Switching Protocols\r\n")
+	resp.WriteString("Upgrade: websocket\r\n")
+	resp.WriteString("Connection: Upgrade\r\n")
+	resp.WriteString("Sec-WebSocket-Accept: " + AcceptKey(key) + "\r\n")
+
+	subprotocol := selectSubprotocol(req, opts.Subprotocols)
+	if subprotocol != "" {
+		resp.WriteString("Sec-WebSocket-Protocol: " + subprotocol + "\r\n")
+	}
+	compress := false
+	if opts.EnableCompression {
+		if extensions, err := req.Headers.Get("sec-websocket-extensions"); err == nil && offersDeflate(extensions) {
+			compress = true
+			resp.WriteString("Sec-WebSocket-Extensions: permessage-deflate; server_no_context_takeover\r\n")
+		}
+	}
+	resp.WriteString("\r\n")
+
+	netConn, buffered, err := w.Hijack()
+	if err != nil {
+		writeError(w, response.InternalServerError, "websocket upgrade unavailable")
+		return nil, fmt.Errorf("websocket: could not hijack connection: %w", err)
+	}
+	if _, err := netConn.Write(resp.Bytes()); err != nil {
+		netConn.Close()
+		return nil, fmt.Errorf("websocket: could not write handshake: %w", err)
+	}
+	w.SetHijackedStatus(response.SwitchingProtocols)
+
+	maxMessageSize := opts.MaxMessageSize
+	if maxMessageSize <= 0 {
+		maxMessageSize = DefaultMaxMessageSize
+	}
+	return newConn(netConn, bufio.NewReader(io.MultiReader(bytes.NewReader(buffered), netConn)), subprotocol, compress, maxMessageSize), nil
+}
+
+// AcceptKey computes the Sec-WebSocket-Accept value for a client key.
+func AcceptKey(key string) string {
+	sum := sha1.Sum([]byte(key + acceptGUID))
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+var errBadVersion = errors.New("unsupported websocket version")
+
+func checkHandshake(req *request.Request) error {
+	if req.RequestLine.Method != "GET" {
+		return errors.New("websocket handshake must use GET")
+	}
+	if connection, _ := req.Headers.Get("connection"); !headerContainsToken(connection, "upgrade") {
+		return errors.New("missing 'Connection: Upgrade'")
+	}
+	if upgrade, _ := req.Headers.Get("upgrade"); !headerContainsToken(upgrade, "websocket") {
+		return errors.New("missing 'Upgrade: websocket'")
+	}
+	if version, _ := req.Headers.Get("sec-websocket-version"); strings.TrimSpace(version) != "13" {
+		return errBadVersion
+	}
+	key, err := req.Headers.Get("sec-websocket-key")
+	if err != nil {
+		return errors.New("missing Sec-WebSocket-Key")
+	}
+	decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(key))
+	if err != nil || len(decoded) != 16 {
+		return errors.New("invalid Sec-WebSocket-Key")
+	}
+	return nil
+}
+
+func selectSubprotocol(req *request.Request, supported []string) string {
+	offered, err := req.Headers.Get("sec-websocket-protocol")
+	if err != nil {
+		return ""
+	}
+	for _, protocol := range supported {
+		if headerContainsToken(offered, protocol) {
+			return protocol
+		}
+	}
+	return ""
+}
+
+// offersDeflate reports whether the client offers permessage-deflate in a
+// form we can honour. Offers that shrink the server's window are declined
+// since compress/flate always uses a 32KB window.
+func offersDeflate(extensions string) bool {
+	for _, extension := range strings.Split(extensions, ",") {
+		params := strings.Split(extension, ";")
+		if !strings.EqualFold(strings.TrimSpace(params[0]), "permessage-deflate") {
+			continue
+		}
+		acceptable := true
+		for _, param := range params[1:] {
+			name, value, _ := strings.Cut(strings.TrimSpace(param), "=")
+			if strings.EqualFold(strings.TrimSpace(name), "server_max_window_bits") && strings.Trim(strings.TrimSpace(value), `"`) != "15" {
+				acceptable = false
+			}
+		}
+		if acceptable {
+			return true
+		}
+	}
+	return false
+}
+
+func headerContainsToken(value string, token string) bool {
+	for _, v := range strings.Split(value, ",") {
+		if strings.EqualFold(strings.TrimSpace(v), token) {
+			return true
+		}
+	}
+	return false
+}
+
+func writeError(w *response.Writer, statusCode response.StatusCode, message string) {
+	if err := server.WriteError(w, statusCode, message); err != nil {
+		log.Printf("could not write websocket handshake error: %v", err)
+	}
+}
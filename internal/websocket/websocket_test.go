@@ -0,0 +1,312 @@
+package websocket
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/PeterKWIlliams/http/internal/request"
+	"github.com/PeterKWIlliams/http/internal/response"
+)
+
+const handshake = "GET /chat HTTP/1.1\r\n" +
+	"Host: localhost\r\n" +
+	"Upgrade: websocket\r\n" +
+	"Connection: keep-alive, Upgrade\r\n" +
+	"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n" +
+	"Sec-WebSocket-Version: 13\r\n"
+
+type testClient struct {
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+func clientFrame(fin bool, rsv1 bool, opcode byte, payload []byte, masked bool) []byte {
+	first := opcode
+	if fin {
+		first |= 0x80
+	}
+	if rsv1 {
+		first |= 0x40
+	}
+	frame := []byte{first}
+	maskBit := byte(0)
+	if masked {
+		maskBit = 0x80
+	}
+	switch {
+	case len(payload) <= 125:
+		frame = append(frame, maskBit|byte(len(payload)))
+	case len(payload) <= 0xFFFF:
+		frame = append(frame, maskBit|126)
+		frame = binary.BigEndian.AppendUint16(frame, uint16(len(payload)))
+	default:
+		frame = append(frame, maskBit|127)
+		frame = binary.BigEndian.AppendUint64(frame, uint64(len(payload)))
+	}
+	if !masked {
+		return append(frame, payload...)
+	}
+	mask := []byte{0x12, 0x34, 0x56, 0x78}
+	frame = append(frame, mask...)
+	for i, b := range payload {
+		frame = append(frame, b^mask[i%4])
+	}
+	return frame
+}
+
+func (c *testClient) send(t *testing.T, frame []byte) {
+	t.Helper()
+	_, err := c.conn.Write(frame)
+	require.NoError(t, err)
+}
+
+func (c *testClient) readFrame(t *testing.T) (byte, bool, []byte) {
+	t.Helper()
+	var header [2]byte
+	_, err := io.ReadFull(c.reader, header[:])
+	require.NoError(t, err)
+	require.Zero(t, header[1]&0x80, "server frames must not be masked")
+	length := int(header[1] & 0x7F)
+	switch length {
+	case 126:
+		var ext [2]byte
+		_, err = io.ReadFull(c.reader, ext[:])
+		require.NoError(t, err)
+		length = int(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		_, err = io.ReadFull(c.reader, ext[:])
+		require.NoError(t, err)
+		length = int(binary.BigEndian.Uint64(ext[:]))
+	}
+	payload := make([]byte, length)
+	_, err = io.ReadFull(c.reader, payload)
+	require.NoError(t, err)
+	return header[0] & 0x0F, header[0]&0x40 != 0, payload
+}
+
+func closePayload(code int, reason string) []byte {
+	return append(binary.BigEndian.AppendUint16(nil, uint16(code)), reason...)
+}
+
+// dial performs the handshake against handler over an in-memory connection.
+func dial(t *testing.T, extraHeaders string, handler func(*response.Writer, *request.Request)) (*testClient, *http.Response, chan struct{}) {
+	t.Helper()
+	req, err := request.RequestFromReader(strings.NewReader(handshake + extraHeaders + "\r\n"))
+	require.NoError(t, err)
+
+	clientConn, serverConn := net.Pipe()
+	t.Cleanup(func() { clientConn.Close() })
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		w := &response.Writer{Writer: serverConn}
+		handler(w, req)
+		if !w.Hijacked() {
+			_ = w.Finish()
+			serverConn.Close()
+		}
+	}()
+
+	client := &testClient{conn: clientConn, reader: bufio.NewReader(clientConn)}
+	resp, err := http.ReadResponse(client.reader, nil)
+	require.NoError(t, err)
+	return client, resp, done
+}
+
+func echoHandler(opts Options, closeErr chan error) func(*response.Writer, *request.Request) {
+	return func(w *response.Writer, req *request.Request) {
+		conn, err := Upgrade(w, req, opts)
+		if err != nil {
+			return
+		}
+		for {
+			messageType, data, err := conn.ReadMessage()
+			if err != nil {
+				closeErr <- err
+				return
+			}
+			if err := conn.WriteMessage(messageType, data); err != nil {
+				closeErr <- err
+				return
+			}
+		}
+	}
+}
+
+func TestAcceptKey(t *testing.T) {
+	assert.Equal(t, "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=", AcceptKey("dGhlIHNhbXBsZSBub25jZQ=="))
+}
+
+func TestUpgrade_BadHandshake(t *testing.T) {
+	req, err := request.RequestFromReader(strings.NewReader(strings.Replace(handshake, "Version: 13", "Version: 8", 1) + "\r\n"))
+	require.NoError(t, err)
+	var out bytes.Buffer
+	w := &response.Writer{Writer: &out}
+	_, err = Upgrade(w, req, Options{})
+	assert.ErrorIs(t, err, ErrBadHandshake)
+	assert.True(t, strings.HasPrefix(out.String(), "HTTP/1.1 426 "))
+	assert.Contains(t, out.String(), "sec-websocket-version: 13\r\n")
+
+	req, err = request.RequestFromReader(strings.NewReader("GET /chat HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	require.NoError(t, err)
+	out.Reset()
+	_, err = Upgrade(&response.Writer{Writer: &out}, req, Options{})
+	assert.ErrorIs(t, err, ErrBadHandshake)
+	assert.True(t, strings.HasPrefix(out.String(), "HTTP/1.1 400 "))
+}
+
+func TestConn_Echo(t *testing.T) {
+	closeErr := make(chan error, 1)
+	opts := Options{Subprotocols: []string{"chat.v2", "chat.v1"}}
+	client, resp, done := dial(t, "Sec-WebSocket-Protocol: chat.v1, chat.v2\r\n", echoHandler(opts, closeErr))
+
+	assert.Equal(t, 101, resp.StatusCode)
+	assert.Equal(t, "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=", resp.Header.Get("Sec-WebSocket-Accept"))
+	assert.Equal(t, "chat.v2", resp.Header.Get("Sec-WebSocket-Protocol"))
+
+	// Test: Fragmented message with an interleaved ping
+	client.send(t, clientFrame(false, false, opText, []byte("Hel"), true))
+	client.send(t, clientFrame(true, false, opPing, []byte("are you there"), true))
+	opcode, _, payload := client.readFrame(t)
+	assert.Equal(t, byte(opPong), opcode)
+	assert.Equal(t, "are you there", string(payload))
+	client.send(t, clientFrame(true, false, opContinuation, []byte("lo"), true))
+	opcode, _, payload = client.readFrame(t)
+	assert.Equal(t, byte(opText), opcode)
+	assert.Equal(t, "Hello", string(payload))
+
+	// Test: Large binary message
+	big := bytes.Repeat([]byte{0xAB}, 70000)
+	client.send(t, clientFrame(true, false, opBinary, big, true))
+	opcode, _, payload = client.readFrame(t)
+	assert.Equal(t, byte(opBinary), opcode)
+	assert.Equal(t, big, payload)
+
+	// Test: Close handshake initiated by the client
+	client.send(t, clientFrame(true, false, opClose, closePayload(CloseGoingAway, "bye"), true))
+	opcode, _, payload = client.readFrame(t)
+	assert.Equal(t, byte(opClose), opcode)
+	assert.Equal(t, CloseGoingAway, int(binary.BigEndian.Uint16(payload)))
+
+	var ce *CloseError
+	require.ErrorAs(t, <-closeErr, &ce)
+	assert.Equal(t, CloseGoingAway, ce.Code)
+	assert.Equal(t, "bye", ce.Reason)
+	<-done
+}
+
+func TestConn_ProtocolViolations(t *testing.T) {
+	tests := []struct {
+		name  string
+		frame []byte
+		code  int
+	}{
+		{"invalid utf-8", clientFrame(true, false, opText, []byte{0xff, 0xfe}, true), CloseInvalidPayload},
+		{"unmasked frame", clientFrame(true, false, opText, []byte("hi"), false), CloseProtocolError},
+		{"unexpected continuation", clientFrame(true, false, opContinuation, []byte("hi"), true), CloseProtocolError},
+		{"fragmented ping", clientFrame(false, false, opPing, nil, true), CloseProtocolError},
+		{"unknown opcode", clientFrame(true, false, 0x3, nil, true), CloseProtocolError},
+		{"compressed without negotiation", clientFrame(true, true, opText, []byte("hi"), true), CloseProtocolError},
+		{"message too big", clientFrame(true, false, opBinary, make([]byte, 200), true), CloseMessageTooBig},
+		{"invalid close code", clientFrame(true, false, opClose, closePayload(1004, ""), true), CloseProtocolError},
+	}
+	for _, tc := range tests {
+		closeErr := make(chan error, 1)
+		client, _, done := dial(t, "", echoHandler(Options{MaxMessageSize: 100}, closeErr))
+		client.send(t, tc.frame)
+		opcode, _, payload := client.readFrame(t)
+		assert.Equal(t, byte(opClose), opcode, tc.name)
+		require.GreaterOrEqual(t, len(payload), 2, tc.name)
+		assert.Equal(t, tc.code, int(binary.BigEndian.Uint16(payload)), tc.name)
+		var ce *CloseError
+		require.ErrorAs(t, <-closeErr, &ce, tc.name)
+		assert.Equal(t, tc.code, ce.Code, tc.name)
+		<-done
+	}
+}
+
+func TestConn_ServerClose(t *testing.T) {
+	closed := make(chan error, 1)
+	client, _, done := dial(t, "", func(w *response.Writer, req *request.Request) {
+		conn, err := Upgrade(w, req, Options{})
+		require.NoError(t, err)
+		closed <- conn.Close(CloseNormalClosure, "done")
+	})
+
+	opcode, _, payload := client.readFrame(t)
+	assert.Equal(t, byte(opClose), opcode)
+	assert.Equal(t, closePayload(CloseNormalClosure, "done"), payload)
+	client.send(t, clientFrame(true, false, opClose, closePayload(CloseNormalClosure, ""), true))
+
+	select {
+	case err := <-closed:
+		assert.NoError(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("Close did not return after the peer answered")
+	}
+	<-done
+}
+
+func TestConn_ServerCloseLongReason(t *testing.T) {
+	// Test: A reason longer than a control frame is cut on a rune boundary
+	reason := strings.Repeat("é", 100)
+	client, _, done := dial(t, "", func(w *response.Writer, req *request.Request) {
+		conn, err := Upgrade(w, req, Options{})
+		require.NoError(t, err)
+		_ = conn.Close(CloseGoingAway, reason)
+	})
+
+	opcode, _, payload := client.readFrame(t)
+	assert.Equal(t, byte(opClose), opcode)
+	assert.Equal(t, closePayload(CloseGoingAway, reason[:122]), payload)
+	assert.True(t, utf8.Valid(payload[2:]))
+	client.send(t, clientFrame(true, false, opClose, closePayload(CloseNormalClosure, ""), true))
+	<-done
+}
+
+func TestConn_PermessageDeflate(t *testing.T) {
+	closeErr := make(chan error, 1)
+	client, resp, done := dial(t, "Sec-WebSocket-Extensions: permessage-deflate; client_max_window_bits\r\n", echoHandler(Options{EnableCompression: true}, closeErr))
+	assert.Equal(t, "permessage-deflate; server_no_context_takeover", resp.Header.Get("Sec-WebSocket-Extensions"))
+
+	// The client keeps its compression context across both messages.
+	var compressed bytes.Buffer
+	fw, err := flate.NewWriter(&compressed, flate.BestCompression)
+	require.NoError(t, err)
+	message := strings.Repeat("compress me please ", 20)
+	for i := 0; i < 2; i++ {
+		compressed.Reset()
+		_, err = fw.Write([]byte(message))
+		require.NoError(t, err)
+		require.NoError(t, fw.Flush())
+		client.send(t, clientFrame(true, true, opText, bytes.TrimSuffix(compressed.Bytes(), deflateTail), true))
+
+		opcode, rsv1, payload := client.readFrame(t)
+		assert.Equal(t, byte(opText), opcode)
+		assert.True(t, rsv1)
+		fr := flate.NewReader(io.MultiReader(bytes.NewReader(payload), bytes.NewReader(deflateTail)))
+		decoded, _ := io.ReadAll(fr)
+		assert.Equal(t, message, string(decoded))
+	}
+
+	client.send(t, clientFrame(true, false, opClose, nil, true))
+	opcode, _, _ := client.readFrame(t)
+	assert.Equal(t, byte(opClose), opcode)
+	var ce *CloseError
+	require.ErrorAs(t, <-closeErr, &ce)
+	assert.Equal(t, CloseNoStatusReceived, ce.Code)
+	<-done
+}